@@ -4,6 +4,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 type StorageConfig struct {
@@ -16,6 +17,175 @@ type StorageConfig struct {
 	Size resource.Quantity `json:"size"`
 }
 
+type PodDisruptionBudgetConfig struct {
+	// +kubebuilder:validation:Optional
+	// 从库最多允许同时被驱逐的数量，可以是整数或百分比，默认为1
+	// 主库单独由maxUnavailable=0的PDB保护，节点排水时operator会先把主库切走
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 允许直接驱逐主库，主库PDB的maxUnavailable变为1，驱逐后由operator重新选主
+	// 默认主库的maxUnavailable=0，只有先cordon再驱逐的kubectl drain能触发计划内切换
+	// 使用cluster-autoscaler缩容、Karpenter合并节点或者不先cordon的节点升级时需要开启，否则节点上有主库时会一直无法排空
+	AllowMasterEviction bool `json:"allowMasterEviction,omitempty"`
+}
+
+// 合并到operator生成的pod模板中，同名的条目以用户为准（类似strategic merge）
+// mysql容器、data和config卷、root密码相关的环境变量由operator管理，不允许覆盖
+type PodTemplateOverrides struct {
+	// +kubebuilder:validation:Optional
+	// app和role标签用于选择pod，不允许覆盖
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 在operator的初始化逻辑之前执行
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// sidecar容器，例如日志收集
+	Containers []corev1.Container `json:"containers,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 追加到mysql容器的挂载点
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 追加到mysql容器的环境变量
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// 心跳配置，开启后每个pod增加一个心跳sidecar，主库上的sidecar定期写入心跳表，用于计算真实的复制延迟
+type HeartbeatConfig struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Optional
+	// 写入间隔（秒），也是延迟的精度
+	IntervalSeconds int32 `json:"intervalSeconds,omitempty"`
+}
+
+// 监控配置，开启后每个pod增加一个mysqld_exporter sidecar，使用operator创建的最小权限监控账号
+type MonitoringConfig struct {
+	// +kubebuilder:default="prom/mysqld-exporter:v0.15.1"
+	// +kubebuilder:validation:Optional
+	// mysqld_exporter镜像，需要v0.15.0及以上版本（支持通过环境变量传入密码）
+	Image string `json:"image,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// exporter容器的资源限制，不设置时使用较小的默认值
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 为集群生成ServiceMonitor或PodMonitor，需要集群中安装了prometheus-operator，没有安装时忽略
+	ServiceMonitor *ServiceMonitorConfig `json:"serviceMonitor,omitempty"`
+}
+
+type ServiceMonitorConfig struct {
+	// +kubebuilder:validation:Enum=ServiceMonitor;PodMonitor
+	// +kubebuilder:default=ServiceMonitor
+	// +kubebuilder:validation:Optional
+	Kind string `json:"kind,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 额外的标签，用于匹配Prometheus的serviceMonitorSelector/podMonitorSelector
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 抓取间隔，例如30s，不设置时使用Prometheus的全局配置
+	Interval string `json:"interval,omitempty"`
+}
+
+// 读服务（-svc-slave）的配置，只有复制正常且延迟在阈值以内的从库才会承接读流量
+type ReadServiceConfig struct {
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	// 承接读流量的从库允许的最大复制延迟（秒），不设置时使用maxReplicationLagSeconds
+	MaxLagSeconds *int32 `json:"maxLagSeconds,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 没有符合条件的从库时是否把主库加入读服务，不设置时为true
+	FallbackToMaster *bool `json:"fallbackToMaster,omitempty"`
+}
+
+// 在集群前面部署ProxySQL，提供读写分离和连接池的统一入口
+// 写请求和SELECT ... FOR UPDATE发往主库，其他SELECT发往读服务中的节点，后端列表由operator在每次选主后同步
+type RouterConfig struct {
+	// +kubebuilder:default="proxysql/proxysql:2.5.5"
+	// +kubebuilder:validation:Optional
+	Image string `json:"image,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=2
+	// +kubebuilder:validation:Optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 允许通过ProxySQL连接的数据库账号，root账号总是允许
+	// 账号需要在mysql中自行创建，这里只是把密码同步给ProxySQL
+	Users []RouterUser `json:"users,omitempty"`
+}
+
+type RouterUser struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:Required
+	// 同一个namespace中保存该账号密码的secret
+	PasswordSecret corev1.SecretKeySelector `json:"passwordSecret"`
+}
+
+// 各角色service的暴露方式，不设置的角色使用ClusterIP
+type ServicesConfig struct {
+	// +kubebuilder:validation:Optional
+	// 写服务（-svc-master）
+	Master *ServiceConfig `json:"master,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 读服务（-svc-slave）
+	Slave *ServiceConfig `json:"slave,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// ProxySQL的统一入口（-svc-router），只有开启router时生效
+	Router *ServiceConfig `json:"router,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 设置后为每个mysql pod创建一个service（-svc-pod-<序号>），按statefulset.kubernetes.io/pod-name选择pod
+	// 用于调试或从集群外连接指定节点，缩容后多余的service会被删除
+	PerPod *ServiceConfig `json:"perPod,omitempty"`
+}
+
+type ServiceConfig struct {
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +kubebuilder:default=ClusterIP
+	// +kubebuilder:validation:Optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 例如云厂商负载均衡器的注解，从spec中删除的注解也会从service上删除
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +kubebuilder:validation:Optional
+	// 只对NodePort和LoadBalancer生效，不设置时为Cluster
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy `json:"externalTrafficPolicy,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 只对LoadBalancer生效，允许访问的来源网段
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// mysql端口之外的额外端口，例如给sidecar使用，名字必填且不能是mysql，端口不能是3306
+	ExtraPorts []corev1.ServicePort `json:"extraPorts,omitempty"`
+}
+
 type MysqlClusterSpec struct {
 
 	// +kubebuilder:validation:Required
@@ -38,6 +208,73 @@ type MysqlClusterSpec struct {
 	// +kubebuilder:validation:Required
 	// 强制要求用户自己创建一个secret，并有2个key，一个root-password，一个repl-password用于主从同步，否则直接报错
 	SecretName corev1.LocalObjectReference `json:"secretName"`
+
+	// +kubebuilder:validation:Optional
+	// 自定义的mysqld参数，key为变量名（-和_等价），value原样写入my.cnf
+	// 会合并到operator生成的my.cnf中，gtid-mode、log-bin等主从复制必需的参数不允许覆盖，未知的变量名会被拒绝
+	MysqlConfig map[string]string `json:"mysqlConfig,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 开启后根据resources中的内存和cpu限制自动计算innodb_buffer_pool_size、max_connections等参数
+	// mysqlConfig中显式设置的同名参数优先
+	AutoTune bool `json:"autoTune,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// PodDisruptionBudget配置，不设置时使用默认值
+	PodDisruptionBudget *PodDisruptionBudgetConfig `json:"podDisruptionBudget,omitempty"`
+
+	// 以下为调度相关的配置，直接应用到statefulset的pod模板，修改后会触发滚动重启
+
+	// +kubebuilder:validation:Optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 不设置时默认使用按主机名的preferred反亲和，尽量把mysql pod分散到不同节点
+	// 调度相关的字段修改后会同步到statefulset，触发滚动重启
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 不设置时默认按topology.kubernetes.io/zone尽量均匀分布（ScheduleAnyway）
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 选主时gtid相同的候选人中优先选择该可用区的节点，不设置时优先选择与故障主库同一可用区的节点
+	PrimaryZone string `json:"primaryZone,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	// 从库允许的最大复制延迟（秒），超过后集群phase变为Degraded，不设置时为30
+	MaxReplicationLagSeconds *int32 `json:"maxReplicationLagSeconds,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 读服务配置，不设置时使用默认值
+	ReadService *ReadServiceConfig `json:"readService,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 各角色service的类型、注解和额外端口，修改后会同步到已有的service
+	Services *ServicesConfig `json:"services,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 部署ProxySQL作为统一的读写分离入口（-svc-router），不设置时不部署
+	Router *RouterConfig `json:"router,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 开启基于心跳表的复制延迟测量，不设置时使用Seconds_Behind_Master，修改后会触发滚动重启
+	Heartbeat *HeartbeatConfig `json:"heartbeat,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 开启mysqld_exporter监控，修改exporter的镜像或资源会触发滚动重启
+	Monitoring *MonitoringConfig `json:"monitoring,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	// 对pod模板的补充，如sidecar、额外的卷和环境变量，修改后会触发滚动重启
+	PodTemplate *PodTemplateOverrides `json:"podTemplate,omitempty"`
 }
 
 // +kubebuilder:validation:Enum=Pending;Initializing;Running;Failed;Degraded;Terminating
@@ -59,8 +296,56 @@ type PodStatus struct {
 	IsReady       bool   `json:"isReady"`       // k8s层面ready
 	IsConnectable bool   `json:"IsConnectable"` // 数据库层面可连接
 
+	// pod所在节点的topology.kubernetes.io/zone标签
+	Zone string `json:"zone,omitempty"`
+
+	// 静态参数已变更但pod还没有重启，动态参数由operator在线生效，不会出现在这里
+	PendingRestart bool `json:"pendingRestart,omitempty"`
+
+	// 以下为从库的复制状态，取自SHOW SLAVE STATUS，主库为空
+	// sql线程没有运行时mysql返回NULL，这里也为空
+	SecondsBehindMaster *int64 `json:"secondsBehindMaster,omitempty"`
+	SlaveIORunning      string `json:"slaveIORunning,omitempty"`
+	SlaveSQLRunning     string `json:"slaveSQLRunning,omitempty"`
+	// Last_IO_Error，没有时为Last_SQL_Error
+	LastError string `json:"lastError,omitempty"`
+	// 开启心跳时根据心跳表计算的延迟（毫秒），比secondsBehindMaster更准确
+	HeartbeatLagMilliseconds *int64 `json:"heartbeatLagMilliseconds,omitempty"`
+
 	// 不建议放gtid，频繁变动会导致更多的网络io
 }
+
+// 一次故障切换或计划内切换的记录
+type FailoverRecord struct {
+	Time metav1.Time `json:"time"`
+
+	// 被替换的主库，脑裂时为多个，用逗号分隔
+	OldMaster string `json:"oldMaster,omitempty"`
+	NewMaster string `json:"newMaster"`
+
+	// no_master、master_unhealthy、split_brain或switchover
+	Reason string `json:"reason"`
+
+	// 参与比较的gtid集合，旧主库不可连接时为之前记录的值
+	OldMasterGTID string `json:"oldMasterGTID,omitempty"`
+	NewMasterGTID string `json:"newMasterGTID,omitempty"`
+
+	// 从决定选主到角色标签打完所用的时间
+	DurationMilliseconds int64 `json:"durationMilliseconds"`
+
+	// 旧主库上有而新主库上没有的事务数量，即可能丢失的数据，无法估算时为空
+	LostTransactions *int64 `json:"lostTransactions,omitempty"`
+}
+
+// 最近一次观察到的健康主库
+type MasterObservation struct {
+	Name string `json:"name"`
+	// 观察时主库的gtid_executed
+	GTID string `json:"gtid,omitempty"`
+
+	ObservedTime metav1.Time `json:"observedTime"`
+}
+
 type MysqlClusterStatus struct {
 
 	// 表示当前集群的状态
@@ -74,8 +359,25 @@ type MysqlClusterStatus struct {
 	CurrentMaster  string `json:"currentMaster"`
 
 	Pods []PodStatus `json:"nodes,omitempty"`
-	// 使用标准的Condition结构来表示更详细的状态信息，但是较为繁琐没有实现，留待后续升级
+
+	// 使用标准的Condition结构来表示更详细的状态信息
+	// 类型有Ready、MasterAvailable、ReplicationHealthy、ConfigApplied、SecretValid、ScalingBlocked、FailoverInProgress
+	// +listType=map
+	// +listMapKey=type
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// 最近的切换记录，按时间从旧到新，最多保留10条
+	FailoverHistory []FailoverRecord `json:"failoverHistory,omitempty"`
+
+	// operator最近一次处理的spec版本，等于metadata.generation时说明status反映的是最新的spec
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// 主库挂掉后就查不到它的gtid了，切换时用这里记下的值估算丢失的事务
+	// 保存在status中，operator重启或者切换leader后依然可用
+	LastMaster *MasterObservation `json:"lastMaster,omitempty"`
+
+	// operator通过SET GLOBAL在线修改过的动态参数，从spec.mysqlConfig中删除后据此恢复成my.cnf中的值
+	AppliedDynamicVariables []string `json:"appliedDynamicVariables,omitempty"`
 }
 
 // 这一句是为下面的结构体生成实现runtime.Object接口所需的方法，否则就只是普通的go结构体，而不是k8s资源
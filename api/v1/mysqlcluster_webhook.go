@@ -0,0 +1,257 @@
+/*
+Copyright 2025 rumraisin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var mysqlclusterlog = logf.Log.WithName("mysqlcluster-resource")
+
+// 和CRD中+kubebuilder:default以及controller中nil时使用的值保持一致
+const (
+	DefaultReplicas                 int32 = 3
+	DefaultRouterImage                    = "proxysql/proxysql:2.5.5"
+	DefaultRouterReplicas           int32 = 2
+	DefaultHeartbeatIntervalSeconds int32 = 1
+	DefaultMonitoringImage                = "prom/mysqld-exporter:v0.15.1"
+	DefaultServiceMonitorKind             = "ServiceMonitor"
+	DefaultMaxReplicationLagSeconds int32 = 30
+)
+
+// 镜像引用：[registry[:port]/]path[:tag][@digest]，只做格式检查，不检查镜像是否存在
+var imageReferenceRegexp = regexp.MustCompile(
+	`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+		`[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*)*` +
+		`(?::[\w][\w.-]{0,127})?` +
+		`(?:@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+// SetupWebhookWithManager 把默认值和校验webhook注册到manager的webhookServer上
+func (r *MysqlCluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&mysqlClusterDefaulter{}).
+		WithValidator(&mysqlClusterValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-apps-rumraisin-me-v1-mysqlcluster,mutating=true,failurePolicy=fail,sideEffects=None,groups=apps.rumraisin.me,resources=mysqlclusters,verbs=create;update,versions=v1,name=mmysqlcluster.kb.io,admissionReviewVersions=v1
+
+type mysqlClusterDefaulter struct{}
+
+var _ webhook.CustomDefaulter = &mysqlClusterDefaulter{}
+
+func (d *mysqlClusterDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	cluster, ok := obj.(*MysqlCluster)
+	if !ok {
+		return fmt.Errorf("期望MysqlCluster，实际为%T", obj)
+	}
+	mysqlclusterlog.V(1).Info("default", "name", cluster.Name)
+
+	cluster.Default()
+	return nil
+}
+
+// Default 填充未设置的字段，把controller中“nil时使用默认值”的约定写回spec，kubectl get时能直接看到生效的值
+// 只填充用户已经开启的可选功能，不会替用户开启router、心跳、监控等
+func (r *MysqlCluster) Default() {
+	spec := &r.Spec
+
+	if spec.Replicas == nil {
+		spec.Replicas = int32Ptr(DefaultReplicas)
+	}
+	if spec.MaxReplicationLagSeconds == nil {
+		spec.MaxReplicationLagSeconds = int32Ptr(DefaultMaxReplicationLagSeconds)
+	}
+
+	if spec.PodDisruptionBudget != nil && spec.PodDisruptionBudget.MaxUnavailable == nil {
+		maxUnavailable := intstr.FromInt32(1)
+		spec.PodDisruptionBudget.MaxUnavailable = &maxUnavailable
+	}
+
+	// maxLagSeconds不填充，nil表示跟随maxReplicationLagSeconds
+	if spec.ReadService != nil && spec.ReadService.FallbackToMaster == nil {
+		fallback := true
+		spec.ReadService.FallbackToMaster = &fallback
+	}
+
+	if spec.Services != nil {
+		for _, service := range []*ServiceConfig{spec.Services.Master, spec.Services.Slave, spec.Services.Router, spec.Services.PerPod} {
+			if service != nil && service.Type == "" {
+				service.Type = corev1.ServiceTypeClusterIP
+			}
+		}
+	}
+
+	if router := spec.Router; router != nil {
+		if router.Image == "" {
+			router.Image = DefaultRouterImage
+		}
+		if router.Replicas == nil {
+			router.Replicas = int32Ptr(DefaultRouterReplicas)
+		}
+	}
+
+	if spec.Heartbeat != nil && spec.Heartbeat.IntervalSeconds == 0 {
+		spec.Heartbeat.IntervalSeconds = DefaultHeartbeatIntervalSeconds
+	}
+
+	if monitoring := spec.Monitoring; monitoring != nil {
+		if monitoring.Image == "" {
+			monitoring.Image = DefaultMonitoringImage
+		}
+		if monitoring.ServiceMonitor != nil && monitoring.ServiceMonitor.Kind == "" {
+			monitoring.ServiceMonitor.Kind = DefaultServiceMonitorKind
+		}
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-apps-rumraisin-me-v1-mysqlcluster,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps.rumraisin.me,resources=mysqlclusters,verbs=create;update,versions=v1,name=vmysqlcluster.kb.io,admissionReviewVersions=v1
+
+type mysqlClusterValidator struct{}
+
+var _ webhook.CustomValidator = &mysqlClusterValidator{}
+
+func (v *mysqlClusterValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	cluster, ok := obj.(*MysqlCluster)
+	if !ok {
+		return nil, fmt.Errorf("期望MysqlCluster，实际为%T", obj)
+	}
+	mysqlclusterlog.V(1).Info("validate create", "name", cluster.Name)
+
+	return nil, cluster.invalid(cluster.ValidateSpec())
+}
+
+func (v *mysqlClusterValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldCluster, ok := oldObj.(*MysqlCluster)
+	if !ok {
+		return nil, fmt.Errorf("期望MysqlCluster，实际为%T", oldObj)
+	}
+	cluster, ok := newObj.(*MysqlCluster)
+	if !ok {
+		return nil, fmt.Errorf("期望MysqlCluster，实际为%T", newObj)
+	}
+	mysqlclusterlog.V(1).Info("validate update", "name", cluster.Name)
+
+	// 正在删除的集群只会更新finalizer，不再校验spec，否则旧数据不合法时finalizer无法移除
+	if cluster.DeletionTimestamp != nil {
+		return nil, nil
+	}
+
+	allErrs := cluster.ValidateSpec()
+	allErrs = append(allErrs, cluster.ValidateSpecUpdate(oldCluster)...)
+	return nil, cluster.invalid(allErrs)
+}
+
+func (v *mysqlClusterValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// ValidateSpec 校验和旧对象无关的规则
+func (r *MysqlCluster) ValidateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	allErrs = append(allErrs, validateImage(r.Spec.Image, specPath.Child("image"))...)
+	if r.Spec.Router != nil && r.Spec.Router.Image != "" {
+		allErrs = append(allErrs, validateImage(r.Spec.Router.Image, specPath.Child("router", "image"))...)
+	}
+	if r.Spec.Monitoring != nil && r.Spec.Monitoring.Image != "" {
+		allErrs = append(allErrs, validateImage(r.Spec.Monitoring.Image, specPath.Child("monitoring", "image"))...)
+	}
+
+	if r.Spec.Storage.Size.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("storage", "size"), r.Spec.Storage.Size.String(), "存储大小必须大于0"))
+	}
+
+	// 没有内存限制时mysqld可能把节点内存用光，autoTune也无法计算innodb_buffer_pool_size
+	resourcesPath := specPath.Child("resources")
+	if _, ok := r.Spec.Resources.Limits[corev1.ResourceMemory]; !ok {
+		allErrs = append(allErrs, field.Required(resourcesPath.Child("limits", "memory"), "必须设置mysql容器的内存限制"))
+	} else if request, ok := r.Spec.Resources.Requests[corev1.ResourceMemory]; ok && request.Cmp(r.Spec.Resources.Limits[corev1.ResourceMemory]) > 0 {
+		allErrs = append(allErrs, field.Invalid(resourcesPath.Child("requests", "memory"), request.String(), "内存请求不能大于内存限制"))
+	}
+
+	if r.Spec.SecretName.Name == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("secretName", "name"), "必须指定保存root-password和repl-password的secret"))
+	}
+
+	return allErrs
+}
+
+// ValidateSpecUpdate 校验修改前后的差异：不支持缩容和缩小存储，存储类不可修改，运行中的集群不能更换secret
+func (r *MysqlCluster) ValidateSpecUpdate(old *MysqlCluster) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if old.Spec.Replicas != nil && r.Spec.Replicas != nil && *r.Spec.Replicas < *old.Spec.Replicas {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("replicas"),
+			fmt.Sprintf("不支持缩容，副本数不能从%d减少到%d", *old.Spec.Replicas, *r.Spec.Replicas)))
+	}
+
+	// pvc不能缩小；statefulset的volumeClaimTemplates不可修改，增大后需要手动扩容已有的pvc
+	if r.Spec.Storage.Size.Cmp(old.Spec.Storage.Size) < 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("storage", "size"),
+			fmt.Sprintf("存储大小不能从%s减小到%s", old.Spec.Storage.Size.String(), r.Spec.Storage.Size.String())))
+	}
+
+	if !apiequality.Semantic.DeepEqual(r.Spec.Storage.StorageClassName, old.Spec.Storage.StorageClassName) {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("storage", "storageClassName"), "存储类创建后不能修改"))
+	}
+
+	// 初始化之后root和复制账号的密码已经写入数据目录，更换secret会导致operator和从库都连不上
+	if old.Status.Phase != "" && r.Spec.SecretName.Name != old.Spec.SecretName.Name {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("secretName"),
+			fmt.Sprintf("集群已经初始化，不能把secret从%s更换为%s，需要修改密码时请更新原secret的内容", old.Spec.SecretName.Name, r.Spec.SecretName.Name)))
+	}
+
+	return allErrs
+}
+
+func (r *MysqlCluster) invalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("MysqlCluster").GroupKind(), r.Name, allErrs)
+}
+
+func validateImage(image string, path *field.Path) field.ErrorList {
+	if image == "" {
+		return field.ErrorList{field.Required(path, "必须指定镜像")}
+	}
+	if len(image) > 255 || !imageReferenceRegexp.MatchString(image) {
+		return field.ErrorList{field.Invalid(path, image, "不是合法的镜像地址，格式为[registry/]name[:tag][@digest]")}
+	}
+	return nil
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
@@ -0,0 +1,197 @@
+package v1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var _ = Describe("MysqlCluster webhook", func() {
+
+	var (
+		ctx       = context.Background()
+		validator = &mysqlClusterValidator{}
+		defaulter = &mysqlClusterDefaulter{}
+		cluster   *MysqlCluster
+	)
+
+	BeforeEach(func() {
+		cluster = &MysqlCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"},
+			Spec: MysqlClusterSpec{
+				Image:    "mysql:5.7",
+				Replicas: int32Ptr(3),
+				Storage:  StorageConfig{Size: resource.MustParse("1Gi")},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+				},
+				SecretName: corev1.LocalObjectReference{Name: "test-secret"},
+			},
+		}
+	})
+
+	// 返回被拒绝的字段路径，通过时为空
+	invalidFields := func(err error) []string {
+		if err == nil {
+			return nil
+		}
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), err.Error())
+		var fields []string
+		for _, cause := range err.(*apierrors.StatusError).ErrStatus.Details.Causes {
+			fields = append(fields, cause.Field)
+		}
+		return fields
+	}
+
+	validateUpdate := func(mutate func(*MysqlCluster)) []string {
+		updated := cluster.DeepCopy()
+		mutate(updated)
+		_, err := validator.ValidateUpdate(ctx, cluster, updated)
+		return invalidFields(err)
+	}
+
+	Context("默认值", func() {
+		It("填充副本数和延迟阈值，不开启可选功能", func() {
+			cluster.Spec.Replicas = nil
+			Expect(defaulter.Default(ctx, cluster)).To(Succeed())
+
+			Expect(*cluster.Spec.Replicas).To(Equal(DefaultReplicas))
+			Expect(*cluster.Spec.MaxReplicationLagSeconds).To(Equal(DefaultMaxReplicationLagSeconds))
+			Expect(cluster.Spec.Router).To(BeNil())
+			Expect(cluster.Spec.Heartbeat).To(BeNil())
+			Expect(cluster.Spec.Monitoring).To(BeNil())
+		})
+
+		It("填充已开启功能中未设置的字段，保留用户设置的值", func() {
+			cluster.Spec.Router = &RouterConfig{}
+			cluster.Spec.Heartbeat = &HeartbeatConfig{}
+			cluster.Spec.Monitoring = &MonitoringConfig{ServiceMonitor: &ServiceMonitorConfig{}}
+			cluster.Spec.ReadService = &ReadServiceConfig{}
+			cluster.Spec.PodDisruptionBudget = &PodDisruptionBudgetConfig{}
+			cluster.Spec.Services = &ServicesConfig{
+				Master: &ServiceConfig{Type: corev1.ServiceTypeLoadBalancer},
+				Slave:  &ServiceConfig{},
+			}
+			cluster.Spec.MaxReplicationLagSeconds = int32Ptr(60)
+			Expect(defaulter.Default(ctx, cluster)).To(Succeed())
+
+			Expect(cluster.Spec.Router.Image).To(Equal(DefaultRouterImage))
+			Expect(*cluster.Spec.Router.Replicas).To(Equal(DefaultRouterReplicas))
+			Expect(cluster.Spec.Heartbeat.IntervalSeconds).To(Equal(DefaultHeartbeatIntervalSeconds))
+			Expect(cluster.Spec.Monitoring.Image).To(Equal(DefaultMonitoringImage))
+			Expect(cluster.Spec.Monitoring.ServiceMonitor.Kind).To(Equal(DefaultServiceMonitorKind))
+			Expect(*cluster.Spec.ReadService.FallbackToMaster).To(BeTrue())
+			Expect(cluster.Spec.ReadService.MaxLagSeconds).To(BeNil())
+			Expect(*cluster.Spec.PodDisruptionBudget.MaxUnavailable).To(Equal(intstr.FromInt32(1)))
+			Expect(cluster.Spec.Services.Master.Type).To(Equal(corev1.ServiceTypeLoadBalancer))
+			Expect(cluster.Spec.Services.Slave.Type).To(Equal(corev1.ServiceTypeClusterIP))
+			Expect(*cluster.Spec.MaxReplicationLagSeconds).To(Equal(int32(60)))
+		})
+	})
+
+	Context("创建", func() {
+		It("接受合法的集群", func() {
+			_, err := validator.ValidateCreate(ctx, cluster)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		DescribeTable("镜像地址",
+			func(image string, valid bool) {
+				cluster.Spec.Image = image
+				_, err := validator.ValidateCreate(ctx, cluster)
+				if valid {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(invalidFields(err)).To(ConsistOf("spec.image"))
+				}
+			},
+			Entry("官方镜像", "mysql", true),
+			Entry("带端口的私有仓库", "registry.example.com:5000/db/mysql:8.0.36", true),
+			Entry("digest", "mysql@sha256:"+"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true),
+			Entry("空", "", false),
+			Entry("包含空格", "mysql: 5.7", false),
+			Entry("大写的仓库名", "MySQL:5.7", false),
+			Entry("空tag", "mysql:", false),
+		)
+
+		It("拒绝router和监控的非法镜像", func() {
+			cluster.Spec.Router = &RouterConfig{Image: "proxysql/proxysql:2.5.5 "}
+			cluster.Spec.Monitoring = &MonitoringConfig{Image: "http://prom/mysqld-exporter"}
+			_, err := validator.ValidateCreate(ctx, cluster)
+			Expect(invalidFields(err)).To(ConsistOf("spec.router.image", "spec.monitoring.image"))
+		})
+
+		It("必须设置内存限制，且请求不能大于限制", func() {
+			cluster.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+			_, err := validator.ValidateCreate(ctx, cluster)
+			Expect(invalidFields(err)).To(ConsistOf("spec.resources.limits.memory"))
+
+			cluster.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}
+			_, err = validator.ValidateCreate(ctx, cluster)
+			Expect(invalidFields(err)).To(ConsistOf("spec.resources.requests.memory"))
+		})
+
+		It("存储大小必须大于0", func() {
+			cluster.Spec.Storage.Size = resource.MustParse("0")
+			_, err := validator.ValidateCreate(ctx, cluster)
+			Expect(invalidFields(err)).To(ConsistOf("spec.storage.size"))
+		})
+	})
+
+	Context("更新", func() {
+		It("允许扩容副本和存储", func() {
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.Replicas = int32Ptr(5)
+				c.Spec.Storage.Size = resource.MustParse("2Gi")
+			})).To(BeEmpty())
+		})
+
+		It("拒绝缩容和缩小存储", func() {
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.Replicas = int32Ptr(2)
+				c.Spec.Storage.Size = resource.MustParse("512Mi")
+			})).To(ConsistOf("spec.replicas", "spec.storage.size"))
+		})
+
+		It("存储类不可修改", func() {
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.Storage.StorageClassName = ptrTo("fast")
+			})).To(ConsistOf("spec.storage.storageClassName"))
+
+			cluster.Spec.Storage.StorageClassName = ptrTo("standard")
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.Storage.StorageClassName = ptrTo("fast")
+			})).To(ConsistOf("spec.storage.storageClassName"))
+		})
+
+		It("初始化之前可以更换secret，之后不行", func() {
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.SecretName.Name = "other-secret"
+			})).To(BeEmpty())
+
+			cluster.Status.Phase = MysqlClusterPhaseRunning
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				c.Spec.SecretName.Name = "other-secret"
+			})).To(ConsistOf("spec.secretName"))
+		})
+
+		It("正在删除的集群不再校验", func() {
+			Expect(validateUpdate(func(c *MysqlCluster) {
+				now := metav1.Now()
+				c.DeletionTimestamp = &now
+				c.Spec.Replicas = int32Ptr(2)
+			})).To(BeEmpty())
+		})
+	})
+})
+
+func ptrTo(s string) *string {
+	return &s
+}
@@ -20,6 +20,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -59,6 +60,7 @@ func main() {
 	var secureMetrics bool
 	var enableHTTP2 bool
 	var tlsOpts []func(*tls.Config)
+	var mysqlOptions controller.MysqlClientOptions
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -69,6 +71,16 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.DurationVar(&mysqlOptions.ConnectTimeout, "mysql-connect-timeout", time.Second,
+		"Timeout for establishing a connection to a MySQL pod.")
+	flag.DurationVar(&mysqlOptions.QueryTimeout, "mysql-query-timeout", 3*time.Second,
+		"Timeout for a single statement executed by the operator against a MySQL pod.")
+	flag.DurationVar(&mysqlOptions.IdleTimeout, "mysql-idle-timeout", 5*time.Minute,
+		"Close pooled connections to a MySQL pod after they have been unused for this long.")
+	flag.DurationVar(&mysqlOptions.HealthCheckInterval, "mysql-health-check-interval", 10*time.Second,
+		"Ping pooled connections before reuse if they have not been checked for this long.")
+	flag.IntVar(&mysqlOptions.MaxOpenConnsPerPod, "mysql-max-conns-per-pod", 4,
+		"Maximum number of open connections the operator keeps to each MySQL pod.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -149,10 +161,19 @@ func main() {
 		// client 用于与 K8s API 交互（钥匙），Scheme 用于识别资源类型（地图）
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		// 按pod复用到mysql的连接
+		Mysql: controller.NewMysqlClient(mysqlOptions),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MysqlCluster")
 		os.Exit(1)
 	}
+	// 本地用make run调试时没有证书，设置ENABLE_WEBHOOKS=false跳过
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&appsv1.MysqlCluster{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "MysqlCluster")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,188 @@
+/*
+Copyright 2025 rumraisin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// mysql-chaos-check 在故障注入期间持续向主库写入，结束后从所有节点读回，检查确认过的写入是否丢失
+// 输出不可写的时间窗口和复制延迟，结果不满足阈值时返回非0，可以直接在CI中使用
+//
+// 需要能访问主库service和pod ip，一般在测试集群内以Job运行，或者在kind节点上运行
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+// 退出码
+const (
+	exitPassed = 0
+	// 有确认过的写入丢失，或者超过了阈值
+	exitFailed = 1
+	// 参数错误或者无法开始测试
+	exitError = 2
+)
+
+type options struct {
+	cluster   string
+	namespace string
+	secret    string
+
+	masterAddr string
+	database   string
+
+	duration      time.Duration
+	interval      time.Duration
+	writeTimeout  time.Duration
+	settleTimeout time.Duration
+
+	maxUnavailable time.Duration
+	maxLag         time.Duration
+
+	output string
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.cluster, "cluster", "", "Name of the MysqlCluster to check.")
+	flag.StringVar(&opts.namespace, "namespace", "default", "Namespace of the MysqlCluster.")
+	flag.StringVar(&opts.secret, "secret", "",
+		"Secret holding root-password. Defaults to spec.secretName of the cluster.")
+	flag.StringVar(&opts.masterAddr, "master-addr", "",
+		"Address of the write endpoint. Defaults to <cluster>-svc-master.<namespace>:3306.")
+	flag.StringVar(&opts.database, "database", "test_write", "Database used for the check table.")
+	flag.DurationVar(&opts.duration, "duration", 2*time.Minute,
+		"How long to keep writing. Inject failures during this period. SIGINT/SIGTERM stops writing early.")
+	flag.DurationVar(&opts.interval, "interval", 100*time.Millisecond, "Interval between writes.")
+	flag.DurationVar(&opts.writeTimeout, "write-timeout", time.Second,
+		"Timeout of a single write. A write is acknowledged only if it returns without error within this time.")
+	flag.DurationVar(&opts.settleTimeout, "settle-timeout", 2*time.Minute,
+		"How long to wait for the cluster to become Running and for replicas to catch up after writing.")
+	flag.DurationVar(&opts.maxUnavailable, "max-unavailable", 0,
+		"Fail if the longest write unavailability window exceeds this. 0 disables the check.")
+	flag.DurationVar(&opts.maxLag, "max-lag", 0,
+		"Fail if a replica needs longer than this to catch up after writing stops. 0 disables the check.")
+	flag.StringVar(&opts.output, "output", "text", "Summary format: text or json.")
+	flag.Parse()
+
+	if opts.cluster == "" {
+		fmt.Fprintln(os.Stderr, "--cluster is required")
+		os.Exit(exitError)
+	}
+	if opts.output != "text" && opts.output != "json" {
+		fmt.Fprintln(os.Stderr, "--output must be text or json")
+		os.Exit(exitError)
+	}
+	if opts.masterAddr == "" {
+		opts.masterAddr = fmt.Sprintf("%s-svc-master.%s:3306", opts.cluster, opts.namespace)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	summary, err := run(ctx, opts)
+	if err != nil {
+		log.Printf("检查失败: %v", err)
+		os.Exit(exitError)
+	}
+
+	if err := summary.print(os.Stdout, opts.output); err != nil {
+		log.Printf("输出结果失败: %v", err)
+		os.Exit(exitError)
+	}
+	if !summary.Passed {
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitPassed)
+}
+
+func run(ctx context.Context, opts options) (*summary, error) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(dbv1.AddToScheme(scheme))
+
+	k8sClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("创建k8s客户端失败: %w", err)
+	}
+
+	cluster := &dbv1.MysqlCluster{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: opts.namespace, Name: opts.cluster}, cluster); err != nil {
+		return nil, fmt.Errorf("获取集群%s/%s失败: %w", opts.namespace, opts.cluster, err)
+	}
+
+	secretName := opts.secret
+	if secretName == "" {
+		secretName = cluster.Spec.SecretName.Name
+	}
+	secret := &corev1.Secret{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: opts.namespace, Name: secretName}, secret); err != nil {
+		return nil, fmt.Errorf("获取secret %s失败: %w", secretName, err)
+	}
+	rootPassword, ok := secret.Data["root-password"]
+	if !ok {
+		return nil, fmt.Errorf("secret %s缺少root-password", secretName)
+	}
+
+	w := &writer{
+		addr:     opts.masterAddr,
+		password: string(rootPassword),
+		database: opts.database,
+		runID:    time.Now().UTC().Format("20060102-150405.000"),
+		timeout:  opts.writeTimeout,
+	}
+
+	log.Printf("准备测试表，主库地址%s", opts.masterAddr)
+	if err := w.prepare(ctx, opts.settleTimeout); err != nil {
+		return nil, err
+	}
+
+	log.Printf("开始写入，持续%s，运行id %s", opts.duration, w.runID)
+	writeCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	stats, err := w.run(writeCtx, opts.interval)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("写入结束，确认%d，失败%d", len(stats.acked), stats.Failed)
+
+	// 被信号打断时也要读回数据，这里用新的context
+	verifyCtx := context.Background()
+	settled := waitForRunning(verifyCtx, k8sClient, cluster, opts.settleTimeout)
+	nodes, err := verifyNodes(verifyCtx, k8sClient, cluster, w, stats, opts.settleTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildSummary(opts, w.runID, stats, nodes, settled), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// 检查结果，json输出时字段名保持稳定，CI可以直接解析
+type summary struct {
+	Cluster string `json:"cluster"`
+	RunID   string `json:"runID"`
+
+	Passed bool `json:"passed"`
+	// 不通过的原因
+	Failures []string `json:"failures,omitempty"`
+
+	Attempted int `json:"attempted"`
+	Acked     int `json:"acked"`
+	Failed    int `json:"failed"`
+	// 确认过但是在任意节点上读不到的写入数量
+	LostAcked int `json:"lostAcked"`
+
+	UnavailableWindows        int      `json:"unavailableWindows"`
+	UnavailableTotalSeconds   float64  `json:"unavailableTotalSeconds"`
+	LongestUnavailableSeconds float64  `json:"longestUnavailableSeconds"`
+	Outages                   []outage `json:"outages,omitempty"`
+	// 按顺序处理过写入的主库
+	Masters []string `json:"masters"`
+
+	// 写入结束后集群是否恢复为Running
+	ClusterSettled bool `json:"clusterSettled"`
+	// 从库追平主库花费的最长时间
+	MaxCatchUpSeconds float64      `json:"maxCatchUpSeconds"`
+	Nodes             []nodeResult `json:"nodes"`
+}
+
+func buildSummary(opts options, runID string, stats *writeStats, nodes []nodeResult, settled bool) *summary {
+	s := &summary{
+		Cluster:        opts.namespace + "/" + opts.cluster,
+		RunID:          runID,
+		Attempted:      stats.Attempted,
+		Acked:          len(stats.acked),
+		Failed:         stats.Failed,
+		Outages:        stats.Outages,
+		Masters:        stats.Masters,
+		ClusterSettled: settled,
+		Nodes:          nodes,
+	}
+
+	var longest time.Duration
+	for _, o := range stats.Outages {
+		s.UnavailableWindows++
+		s.UnavailableTotalSeconds += o.duration().Seconds()
+		if o.duration() > longest {
+			longest = o.duration()
+		}
+	}
+	s.LongestUnavailableSeconds = longest.Seconds()
+
+	for _, node := range nodes {
+		if node.LostCount > s.LostAcked {
+			s.LostAcked = node.LostCount
+		}
+		if node.CatchUpSeconds > s.MaxCatchUpSeconds {
+			s.MaxCatchUpSeconds = node.CatchUpSeconds
+		}
+
+		switch {
+		case node.Error != "":
+			s.Failures = append(s.Failures, fmt.Sprintf("无法检查节点%s: %s", node.Pod, node.Error))
+		case node.LostCount > 0:
+			s.Failures = append(s.Failures, fmt.Sprintf("节点%s丢失%d条确认过的写入: %v", node.Pod, node.LostCount, node.Lost))
+		case !node.CaughtUp:
+			s.Failures = append(s.Failures, fmt.Sprintf("节点%s在%s内没有追平主库", node.Pod, opts.settleTimeout))
+		}
+	}
+
+	if s.Acked == 0 {
+		s.Failures = append(s.Failures, "没有任何写入成功")
+	}
+	if !settled {
+		s.Failures = append(s.Failures, fmt.Sprintf("集群在%s内没有恢复Running", opts.settleTimeout))
+	}
+	if opts.maxUnavailable > 0 && longest > opts.maxUnavailable {
+		s.Failures = append(s.Failures, fmt.Sprintf("最长不可写%s，超过%s", longest.Round(time.Millisecond), opts.maxUnavailable))
+	}
+	if opts.maxLag > 0 && s.MaxCatchUpSeconds > opts.maxLag.Seconds() {
+		s.Failures = append(s.Failures, fmt.Sprintf("从库追平最长%.1fs，超过%s", s.MaxCatchUpSeconds, opts.maxLag))
+	}
+
+	s.Passed = len(s.Failures) == 0
+	return s
+}
+
+func (s *summary) print(out io.Writer, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(s)
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "集群: %s  运行id: %s\n", s.Cluster, s.RunID)
+	fmt.Fprintf(b, "写入: 尝试%d  确认%d  失败%d  确认后丢失%d\n", s.Attempted, s.Acked, s.Failed, s.LostAcked)
+	fmt.Fprintf(b, "不可写: %d次  合计%.1fs  最长%.1fs\n", s.UnavailableWindows, s.UnavailableTotalSeconds, s.LongestUnavailableSeconds)
+	for _, o := range s.Outages {
+		suffix := ""
+		if o.Open {
+			suffix = "（结束时仍不可写）"
+		}
+		fmt.Fprintf(b, "  %s ~ %s  %.1fs  失败%d次%s\n",
+			o.Start.Format("15:04:05.000"), o.End.Format("15:04:05.000"), o.duration().Seconds(), o.Failed, suffix)
+	}
+	fmt.Fprintf(b, "主库: %s\n", strings.Join(s.Masters, " -> "))
+	fmt.Fprintf(b, "集群恢复Running: %v  从库追平最长: %.1fs\n", s.ClusterSettled, s.MaxCatchUpSeconds)
+
+	fmt.Fprintf(b, "节点:\n")
+	for _, node := range s.Nodes {
+		lag := "-"
+		if node.SecondsBehindMaster != nil {
+			lag = fmt.Sprintf("%ds", *node.SecondsBehindMaster)
+		}
+		fmt.Fprintf(b, "  %-32s %-7s 延迟%-6s 追平%-5v %.1fs  行数%-6d 丢失%-4d 未确认已提交%d",
+			node.Pod, node.Role, lag, node.CaughtUp, node.CatchUpSeconds, node.Rows, node.LostCount, node.UnackedCommitted)
+		if node.Error != "" {
+			fmt.Fprintf(b, "  错误: %s", node.Error)
+		}
+		fmt.Fprintln(b)
+	}
+
+	if s.Passed {
+		fmt.Fprintln(b, "结果: 通过")
+	} else {
+		fmt.Fprintln(b, "结果: 不通过")
+		for _, failure := range s.Failures {
+			fmt.Fprintf(b, "  - %s\n", failure)
+		}
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
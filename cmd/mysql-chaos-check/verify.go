@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+// 单个节点的检查结果
+type nodeResult struct {
+	Pod   string `json:"pod"`
+	Role  string `json:"role"`
+	Error string `json:"error,omitempty"`
+
+	// 写入结束时的Seconds_Behind_Master，主库和没有配置复制的节点为空
+	SecondsBehindMaster *int64 `json:"secondsBehindMaster,omitempty"`
+	// 追平主库的gtid花费的时间
+	CaughtUp       bool    `json:"caughtUp"`
+	CatchUpSeconds float64 `json:"catchUpSeconds"`
+
+	// 本次运行写入的行数
+	Rows int `json:"rows"`
+	// 确认过但是读不到的序号，最多列出20个
+	Lost      []int `json:"lost,omitempty"`
+	LostCount int   `json:"lostCount"`
+	// 没有确认但是已经提交的写入，超时的写入可能已经成功，不算错误
+	UnackedCommitted int `json:"unackedCommitted"`
+}
+
+// 等待集群恢复为Running，超时返回false
+func waitForRunning(ctx context.Context, c client.Client, cluster *dbv1.MysqlCluster, timeout time.Duration) bool {
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		current := &dbv1.MysqlCluster{}
+		err := c.Get(ctx, key, current)
+		if err == nil && current.Status.Phase == dbv1.MysqlClusterPhaseRunning {
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("集群在%s内没有恢复Running，当前状态%s", timeout, current.Status.Phase)
+			return false
+		}
+		log.Printf("等待集群恢复Running，当前状态%s", current.Status.Phase)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// 从所有节点读回本次写入的数据，从库先等待追平主库
+func verifyNodes(ctx context.Context, c client.Client, cluster *dbv1.MysqlCluster, w *writer, stats *writeStats, timeout time.Duration) ([]nodeResult, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(cluster.Namespace), client.MatchingLabels{"app": cluster.Name}); err != nil {
+		return nil, fmt.Errorf("获取pod列表失败: %w", err)
+	}
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+
+	// 连接pod ip，读超时要比等待追平的时间长
+	open := func(pod *corev1.Pod) (*sql.DB, error) {
+		if pod.Status.PodIP == "" {
+			return nil, fmt.Errorf("pod没有ip")
+		}
+		return sql.Open("mysql", w.dsn(pod.Status.PodIP+":3306", w.database, timeout+5*time.Second))
+	}
+
+	// 主库的gtid，从库需要追平它
+	var masterGTID string
+	for i := range pods {
+		if pods[i].Labels["role"] != "master" {
+			continue
+		}
+		db, err := open(&pods[i])
+		if err == nil {
+			err = db.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&masterGTID)
+			db.Close()
+		}
+		if err != nil {
+			log.Printf("读取主库%s的gtid失败: %v", pods[i].Name, err)
+		}
+	}
+
+	var results []nodeResult
+	for i := range pods {
+		pod := &pods[i]
+		result := nodeResult{Pod: pod.Name, Role: pod.Labels["role"]}
+
+		db, err := open(pod)
+		if err == nil {
+			err = verifyNode(ctx, db, w, stats, masterGTID, timeout, &result)
+			db.Close()
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		log.Printf("节点%s(%s): 行数%d，丢失%d，追平%v", result.Pod, result.Role, result.Rows, result.LostCount, result.CaughtUp)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func verifyNode(ctx context.Context, db *sql.DB, w *writer, stats *writeStats, masterGTID string, timeout time.Duration, result *nodeResult) error {
+	if result.Role == "master" {
+		result.CaughtUp = true
+	} else {
+		lag, err := secondsBehindMaster(ctx, db)
+		if err != nil {
+			return fmt.Errorf("查询复制状态失败: %w", err)
+		}
+		result.SecondsBehindMaster = lag
+
+		if masterGTID != "" {
+			start := time.Now()
+			var waitResult sql.NullInt64
+			err := db.QueryRowContext(ctx, "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)", masterGTID, int(timeout.Seconds())).Scan(&waitResult)
+			if err != nil {
+				return fmt.Errorf("等待追平主库失败: %w", err)
+			}
+			result.CatchUpSeconds = time.Since(start).Seconds()
+			result.CaughtUp = waitResult.Valid && waitResult.Int64 == 0
+		}
+	}
+
+	query := fmt.Sprintf("SELECT seq_no FROM `%s` WHERE run_id = ?", checkTable)
+	rows, err := db.QueryContext(ctx, query, w.runID)
+	if err != nil {
+		return fmt.Errorf("读取数据失败: %w", err)
+	}
+	defer rows.Close()
+
+	found := map[int]bool{}
+	for rows.Next() {
+		var seq int
+		if err := rows.Scan(&seq); err != nil {
+			return err
+		}
+		found[seq] = true
+		if _, ok := stats.acked[seq]; !ok {
+			result.UnackedCommitted++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	result.Rows = len(found)
+
+	var lost []int
+	for seq := range stats.acked {
+		if !found[seq] {
+			lost = append(lost, seq)
+		}
+	}
+	sort.Ints(lost)
+	result.LostCount = len(lost)
+	if len(lost) > 20 {
+		lost = lost[:20]
+	}
+	result.Lost = lost
+	return nil
+}
+
+// SHOW SLAVE STATUS中的Seconds_Behind_Master，没有配置复制或者值为NULL时返回nil
+func secondsBehindMaster(ctx context.Context, db *sql.DB) (*int64, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return nil, err
+	}
+
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" || values[i] == nil {
+			continue
+		}
+		lag, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+		return &lag, nil
+	}
+	return nil, nil
+}
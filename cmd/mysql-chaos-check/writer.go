@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// 检查用的表，每次运行用run_id区分，可以在同一个库里反复运行
+const checkTable = "chaos_check"
+
+// 向主库写入，只有在超时时间内返回成功的写入才算确认
+type writer struct {
+	addr     string
+	password string
+	database string
+	runID    string
+	timeout  time.Duration
+}
+
+// 一段不可写的时间，从最后一次成功写入到下一次成功写入
+type outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// 期间失败的写入次数
+	Failed int `json:"failed"`
+	// 写入结束时还没有恢复
+	Open bool `json:"open,omitempty"`
+}
+
+func (o outage) duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+type writeStats struct {
+	Attempted int
+	Failed    int
+	// 确认的序号和处理写入的主库
+	acked map[int]string
+	// 按顺序观察到的主库，连续相同的只记一次
+	Masters []string
+	Outages []outage
+}
+
+func (w *writer) dsn(addr, database string, readTimeout time.Duration) string {
+	config := mysql.NewConfig()
+	config.User = "root"
+	config.Passwd = w.password
+	config.Net = "tcp"
+	config.Addr = addr
+	config.DBName = database
+	config.Timeout = w.timeout
+	config.ReadTimeout = readTimeout
+	config.WriteTimeout = w.timeout
+	config.InterpolateParams = true
+	return config.FormatDSN()
+}
+
+// 建库建表，主库还没有就绪时一直重试
+func (w *writer) prepare(ctx context.Context, timeout time.Duration) error {
+	db, err := sql.Open("mysql", w.dsn(w.addr, "", w.timeout))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	queries := []string{
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", w.database),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` ("+
+			"run_id VARCHAR(64) NOT NULL, "+
+			"seq_no INT NOT NULL, "+
+			"host VARCHAR(64), "+
+			"write_time TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3), "+
+			"PRIMARY KEY (run_id, seq_no))", w.database, checkTable),
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = nil
+		for _, query := range queries {
+			if _, err = db.ExecContext(ctx, query); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("准备测试表失败: %w", err)
+		}
+		log.Printf("等待主库可写: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// 按间隔持续写入直到ctx结束
+func (w *writer) run(ctx context.Context, interval time.Duration) (*writeStats, error) {
+	stats := &writeStats{acked: map[int]string{}}
+
+	db, err := sql.Open("mysql", w.dsn(w.addr, w.database, w.timeout))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// 每次写入都重新建立连接，切换后service指向新主库时能立即生效，不会一直连着旧主
+	db.SetMaxIdleConns(0)
+
+	var (
+		lastSuccess time.Time
+		current     *outage
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for seq := 1; ctx.Err() == nil; seq++ {
+		start := time.Now()
+		host, err := w.write(ctx, db, seq)
+		stats.Attempted++
+
+		if err != nil {
+			if ctx.Err() != nil {
+				// 结束时被取消的写入不算
+				stats.Attempted--
+				break
+			}
+			stats.Failed++
+			if current == nil {
+				current = &outage{Start: start}
+				if !lastSuccess.IsZero() {
+					current.Start = lastSuccess
+				}
+				log.Printf("SEQ %d 写入失败，开始不可写: %v", seq, err)
+			}
+			current.Failed++
+		} else {
+			now := time.Now()
+			stats.acked[seq] = host
+			if len(stats.Masters) == 0 || stats.Masters[len(stats.Masters)-1] != host {
+				stats.Masters = append(stats.Masters, host)
+				log.Printf("SEQ %d 由%s处理", seq, host)
+			}
+			if current != nil {
+				current.End = now
+				stats.Outages = append(stats.Outages, *current)
+				log.Printf("SEQ %d 恢复写入，不可写%s", seq, current.duration().Round(time.Millisecond))
+				current = nil
+			}
+			lastSuccess = now
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	if current != nil {
+		current.End = time.Now()
+		current.Open = true
+		stats.Outages = append(stats.Outages, *current)
+	}
+	return stats, nil
+}
+
+// 在同一个连接上查询主机名并写入，返回处理写入的主库
+func (w *writer) write(ctx context.Context, db *sql.DB, seq int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var host string
+	if err := conn.QueryRowContext(ctx, "SELECT @@hostname").Scan(&host); err != nil {
+		return "", err
+	}
+
+	query := fmt.Sprintf("INSERT INTO `%s` (run_id, seq_no, host) VALUES (?, ?, ?)", checkTable)
+	if _, err := conn.ExecContext(ctx, query, w.runID, seq, host); err != nil {
+		return "", err
+	}
+	return host, nil
+}
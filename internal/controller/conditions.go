@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	dbv1 "mysql-operator/api/v1"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// status.conditions的类型，kubectl wait --for=condition=Ready和GitOps的健康检查依赖它们，已有的值不要修改
+const (
+	// phase为Running
+	ConditionReady = "Ready"
+	// 有且只有一个可连接的主库
+	ConditionMasterAvailable = "MasterAvailable"
+	// 所有从库的复制线程都在运行，且延迟在阈值以内
+	ConditionReplicationHealthy = "ReplicationHealthy"
+	// spec中的配置已经应用到所有pod
+	ConditionConfigApplied = "ConfigApplied"
+	// spec.secretName指向的secret存在且格式正确
+	ConditionSecretValid = "SecretValid"
+	// spec.replicas小于当前副本数，缩容被忽略
+	ConditionScalingBlocked = "ScalingBlocked"
+	// 本轮调谐正在切换主库
+	ConditionFailoverInProgress = "FailoverInProgress"
+)
+
+// 设置一个condition，只有status变化时才会更新lastTransitionTime
+func setCondition(conditions *[]metav1.Condition, cluster *dbv1.MysqlCluster, conditionType string, status bool, reason, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: cluster.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// 在提前返回的错误路径上单独更新一个condition，其他status字段保持不变
+func (r *MysqlClusterReconciler) updateCondition(ctx context.Context, cluster *dbv1.MysqlCluster, conditionType string, status bool, reason, message string) error {
+	conditions := append([]metav1.Condition{}, cluster.Status.Conditions...)
+	setCondition(&conditions, cluster, conditionType, status, reason, message)
+
+	if reflect.DeepEqual(conditions, cluster.Status.Conditions) {
+		return nil
+	}
+
+	cluster.Status.Conditions = conditions
+	if err := r.Status().Update(ctx, cluster); err != nil {
+		return fmt.Errorf("更新condition %s失败：%w", conditionType, err)
+	}
+	return nil
+}
+
+// 选主原因对应的condition reason
+var failoverConditionReasons = map[string]string{
+	"bootstrap":        "Bootstrap",
+	"no_master":        "NoMaster",
+	"master_unhealthy": "MasterUnhealthy",
+	"split_brain":      "SplitBrain",
+	"switchover":       "Switchover",
+}
+
+// 根据快照和推导出的phase计算所有condition，conditions是status中原有的列表
+// laggingSlaves是复制异常的从库，desiredSlaves是期望的从库数量
+func buildConditions(conditions []metav1.Condition, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot, phase dbv1.MysqlClusterPhase, laggingSlaves []string, desiredSlaves int32) []metav1.Condition {
+	conditions = append([]metav1.Condition{}, conditions...)
+
+	var (
+		masters         []string
+		connectedSlaves int32
+		pendingRestart  []string
+		applyFailed     []string
+	)
+	for _, pod := range snapshot.Pods {
+		if pod.IsConnectable && pod.Role == "master" {
+			masters = append(masters, pod.Pod.Name)
+		}
+		if pod.IsConnectable && pod.Role == "slave" {
+			connectedSlaves++
+		}
+		if pod.PendingRestart {
+			pendingRestart = append(pendingRestart, pod.Pod.Name)
+		}
+		if pod.ConfigApplyError != "" {
+			applyFailed = append(applyFailed, pod.ConfigApplyError)
+		}
+	}
+
+	if phase == dbv1.MysqlClusterPhaseRunning {
+		setCondition(&conditions, cluster, ConditionReady, true, "Running", "一主多从都正常")
+	} else {
+		setCondition(&conditions, cluster, ConditionReady, false, string(phase), fmt.Sprintf("集群状态为%s", phase))
+	}
+
+	switch len(masters) {
+	case 0:
+		setCondition(&conditions, cluster, ConditionMasterAvailable, false, "NoMaster", "没有可连接的主库")
+	case 1:
+		setCondition(&conditions, cluster, ConditionMasterAvailable, true, "MasterConnectable", fmt.Sprintf("主库为%s", masters[0]))
+	default:
+		setCondition(&conditions, cluster, ConditionMasterAvailable, false, "MultipleMasters", fmt.Sprintf("存在多个主库: %s", strings.Join(masters, ",")))
+	}
+
+	switch {
+	case len(masters) == 0:
+		setCondition(&conditions, cluster, ConditionReplicationHealthy, false, "NoMaster", "没有可连接的主库")
+	case len(laggingSlaves) > 0:
+		setCondition(&conditions, cluster, ConditionReplicationHealthy, false, "ReplicationLagging", fmt.Sprintf("从库%s复制中断或延迟超过阈值", strings.Join(laggingSlaves, ",")))
+	case connectedSlaves < desiredSlaves:
+		setCondition(&conditions, cluster, ConditionReplicationHealthy, false, "SlavesUnavailable", fmt.Sprintf("可连接的从库%d/%d", connectedSlaves, desiredSlaves))
+	default:
+		setCondition(&conditions, cluster, ConditionReplicationHealthy, true, "Replicating", "所有从库复制正常")
+	}
+
+	switch {
+	case len(applyFailed) > 0:
+		setCondition(&conditions, cluster, ConditionConfigApplied, false, "ApplyFailed", strings.Join(applyFailed, "; "))
+	case len(pendingRestart) > 0:
+		setCondition(&conditions, cluster, ConditionConfigApplied, false, "PendingRestart", fmt.Sprintf("等待重启生效: %s", strings.Join(pendingRestart, ",")))
+	default:
+		setCondition(&conditions, cluster, ConditionConfigApplied, true, "Applied", "配置已应用到所有节点")
+	}
+
+	// 能走到这里说明secret已经校验通过
+	setCondition(&conditions, cluster, ConditionSecretValid, true, "Valid", "secret存在且包含必需的键")
+
+	if snapshot.ScaleInBlocked {
+		message := snapshot.ScaleInMessage
+		if message == "" {
+			message = "不支持自动缩容，spec.replicas小于当前副本数"
+		}
+		setCondition(&conditions, cluster, ConditionScalingBlocked, true, "ScaleInNotSupported", message)
+	} else {
+		setCondition(&conditions, cluster, ConditionScalingBlocked, false, "NotBlocked", "")
+	}
+
+	if reason, ok := failoverConditionReasons[snapshot.FailoverReason]; ok {
+		setCondition(&conditions, cluster, ConditionFailoverInProgress, true, reason, "正在切换主库")
+	} else {
+		setCondition(&conditions, cluster, ConditionFailoverInProgress, false, "Stable", "")
+	}
+
+	return conditions
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("status conditions", func() {
+
+	cluster := &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Generation: 3}}
+
+	pod := func(name, role string, connectable bool) *PodInfo {
+		return &PodInfo{
+			Pod:           &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}},
+			Role:          role,
+			IsReady:       connectable,
+			IsConnectable: connectable,
+		}
+	}
+
+	It("集群正常时Ready为True，并记录observedGeneration", func() {
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			pod("test-cluster-0", "master", true),
+			pod("test-cluster-1", "slave", true),
+			pod("test-cluster-2", "slave", true),
+		}}
+
+		conditions := buildConditions(nil, cluster, snapshot, dbv1.MysqlClusterPhaseRunning, nil, 2)
+
+		for _, conditionType := range []string{ConditionReady, ConditionMasterAvailable, ConditionReplicationHealthy, ConditionConfigApplied, ConditionSecretValid} {
+			Expect(meta.IsStatusConditionTrue(conditions, conditionType)).To(BeTrue(), conditionType)
+		}
+		Expect(meta.IsStatusConditionFalse(conditions, ConditionScalingBlocked)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(conditions, ConditionFailoverInProgress)).To(BeTrue())
+		Expect(meta.FindStatusCondition(conditions, ConditionReady).ObservedGeneration).To(Equal(int64(3)))
+	})
+
+	It("主库故障和切换中反映在对应的condition上", func() {
+		restarting := pod("test-cluster-2", "slave", true)
+		restarting.PendingRestart = true
+		snapshot := &ClusterSnapshot{
+			Pods: []*PodInfo{
+				pod("test-cluster-0", "master", false),
+				pod("test-cluster-1", "slave", true),
+				restarting,
+			},
+			FailoverReason: "master_unhealthy",
+			ScaleInBlocked: true,
+		}
+
+		conditions := buildConditions(nil, cluster, snapshot, dbv1.MysqlClusterPhaseFailed, nil, 2)
+
+		Expect(meta.FindStatusCondition(conditions, ConditionReady).Reason).To(Equal("Failed"))
+		Expect(meta.FindStatusCondition(conditions, ConditionMasterAvailable).Reason).To(Equal("NoMaster"))
+		Expect(meta.IsStatusConditionFalse(conditions, ConditionReplicationHealthy)).To(BeTrue())
+		Expect(meta.FindStatusCondition(conditions, ConditionConfigApplied).Reason).To(Equal("PendingRestart"))
+		Expect(meta.IsStatusConditionTrue(conditions, ConditionScalingBlocked)).To(BeTrue())
+		Expect(meta.FindStatusCondition(conditions, ConditionFailoverInProgress).Reason).To(Equal("MasterUnhealthy"))
+	})
+
+	It("复制延迟的从库使ReplicationHealthy为False", func() {
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			pod("test-cluster-0", "master", true),
+			pod("test-cluster-1", "slave", true),
+		}}
+
+		conditions := buildConditions(nil, cluster, snapshot, dbv1.MysqlClusterPhaseDegraded, []string{"test-cluster-1"}, 1)
+
+		condition := meta.FindStatusCondition(conditions, ConditionReplicationHealthy)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("ReplicationLagging"))
+		Expect(condition.Message).To(ContainSubstring("test-cluster-1"))
+	})
+
+	It("动态参数SET GLOBAL失败时ConfigApplied为ApplyFailed", func() {
+		failed := pod("test-cluster-1", "slave", true)
+		failed.ConfigApplyError = "9.3节点test-cluster-1设置变量max_connections=500失败"
+		restarting := pod("test-cluster-2", "slave", true)
+		restarting.PendingRestart = true
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			pod("test-cluster-0", "master", true),
+			failed,
+			restarting,
+		}}
+
+		conditions := buildConditions(nil, cluster, snapshot, dbv1.MysqlClusterPhaseRunning, nil, 2)
+
+		condition := meta.FindStatusCondition(conditions, ConditionConfigApplied)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("ApplyFailed"))
+		Expect(condition.Message).To(ContainSubstring("max_connections"))
+	})
+})
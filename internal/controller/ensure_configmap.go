@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	dbv1 "mysql-operator/api/v1"
+	"reflect"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -18,16 +19,29 @@ import (
 func (r *MysqlClusterReconciler) getOrCreateConfigMap(ctx context.Context, configMapName string, cluster *dbv1.MysqlCluster) (*corev1.ConfigMap, error) {
 	existingConfigMap := &corev1.ConfigMap{}
 	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: configMapName}, existingConfigMap)
-	if err == nil {
-		return existingConfigMap, nil
-
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("4.2获取%s失败：%w", configMapName, err)
 	}
+	found := err == nil
 
-	if !errors.IsNotFound(err) {
-		return nil, fmt.Errorf("4.2获取%s失败：%w", configMapName, err)
+	// 先校验并生成期望的configMap，自定义参数不合法时直接报错，不去动已有的configMap
+	newConfigMap, err := r.createConfigMap(configMapName, cluster)
+	if err != nil {
+		return nil, fmt.Errorf("4.2生成%s失败：%w", configMapName, err)
 	}
 
-	newConfigMap := r.createConfigMap(configMapName, cluster)
+	if found {
+		// spec是配置的唯一来源，手动修改configMap会被覆盖
+		if reflect.DeepEqual(existingConfigMap.Data, newConfigMap.Data) {
+			return existingConfigMap, nil
+		}
+
+		existingConfigMap.Data = newConfigMap.Data
+		if err := r.Update(ctx, existingConfigMap); err != nil {
+			return nil, fmt.Errorf("4.2更新%s失败：%w", configMapName, err)
+		}
+		return existingConfigMap, nil
+	}
 
 	if err := controllerutil.SetControllerReference(cluster, newConfigMap, r.Scheme); err != nil {
 		return nil, fmt.Errorf("4.2设置%s的OwnerReference时失败：%w", configMapName, err)
@@ -40,16 +54,12 @@ func (r *MysqlClusterReconciler) getOrCreateConfigMap(ctx context.Context, confi
 	return newConfigMap, nil
 }
 
-func (r *MysqlClusterReconciler) createConfigMap(configMapName string, cluster *dbv1.MysqlCluster) *corev1.ConfigMap {
-	myCnf := fmt.Sprintf(`[mysqld]
-
-binlog_format=row
-log-bin=mysql-bin
-gtid-mode=on
-enforce-gtid-consistency=true
-log-slave-updates=1
-relay_log_purge=0
-# other configurations`)
+func (r *MysqlClusterReconciler) createConfigMap(configMapName string, cluster *dbv1.MysqlCluster) (*corev1.ConfigMap, error) {
+	config, _, err := desiredMysqlConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	myCnf := renderMyCnf(config)
 
 	initScript := `#!/bin/bash
 set -e
@@ -73,12 +83,21 @@ echo "server-id=$SERVER_ID" >> /etc/mysql/conf.d/server-id.cnf
 			"my.cnf":  myCnf,
 			"init.sh": initScript,
 		},
-	}
+	}, nil
 }
 
 func (r *MysqlClusterReconciler) computeConfigMapHash(cm *corev1.ConfigMap) (string, error) {
+	// 动态变量不参与哈希，修改它们不会触发滚动重启
+	data := make(map[string]string, len(cm.Data))
+	for key, value := range cm.Data {
+		data[key] = value
+	}
+	if myCnf, ok := data["my.cnf"]; ok {
+		data["my.cnf"] = staticMyCnf(myCnf)
+	}
+
 	// 序列化为json，保证哈希的唯一性
-	dataBytes, err := json.Marshal(cm.Data)
+	dataBytes, err := json.Marshal(data)
 	if err != nil {
 		return "", err
 	}
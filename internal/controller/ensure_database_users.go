@@ -2,7 +2,6 @@ package controller
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"sync"
 
@@ -32,7 +31,7 @@ func (r *MysqlClusterReconciler) ensureDatabaseUsers(ctx context.Context, snapsh
 			defer wg.Done()
 
 			// 执行单个节点的初始化逻辑
-			if err := r.reconcileUserForPod(ctx, p, snapshot.RootPassword, snapshot.ReplPassword); err != nil {
+			if err := r.reconcileUserForPod(ctx, p, snapshot.RootPassword, snapshot.ReplPassword, snapshot.ExporterPassword); err != nil {
 
 				errChan <- fmt.Errorf("6.节点%s的数据库初始化失败: %w", p.Pod.Name, err)
 			}
@@ -51,56 +50,65 @@ func (r *MysqlClusterReconciler) ensureDatabaseUsers(ctx context.Context, snapsh
 }
 
 // 单个节点的初始化
-func (r *MysqlClusterReconciler) reconcileUserForPod(ctx context.Context, pod *PodInfo, rootPwd, replPwd string) error {
+func (r *MysqlClusterReconciler) reconcileUserForPod(ctx context.Context, pod *PodInfo, rootPwd, replPwd, exporterPwd string) error {
 
-	// interpolateParams=true表示在本地预编译sql语句
-	dsn := fmt.Sprintf("root:%s@tcp(%s:3306)/mysql?timeout=1s&readTimeout=3s&parseTime=true&interpolateParams=true", rootPwd, pod.Pod.Status.PodIP)
-	db, err := sql.Open("mysql", dsn)
+	node, err := r.Mysql.Connect(ctx, pod.Pod, rootPwd)
 	if err != nil {
-		return fmt.Errorf("6.1dsn格式错误或驱动未加载: %w", err)
-	}
-	defer db.Close()
-
-	if err := db.PingContext(ctx); err != nil {
+		recordConnectionError(pod)
 		return fmt.Errorf("6.2节点%s无法连接: %w", pod.Pod.Name, err)
 	}
+	defer node.Close()
 
-	// 关于sql语句，密码和where，value，set后的值使用?占位符
-	// 其他的标识符用fmt.Sprintf拼接
+	// 账号不记binlog，避免污染gtid，每个节点各自维护
 
-	// 保险操作：关闭二进制日志，避免污染gtid
-	if _, err := db.ExecContext(ctx, "SET SESSION sql_log_bin = 0"); err != nil {
-		return fmt.Errorf("6.3设置sql_log_bin=0失败: %w", err)
+	// 无论是新建的还是旧的，都强制刷新一次密码，授权也是幂等的，多执行几次没关系
+	replUser := MysqlUser{
+		Name:     ReplUser,
+		Password: replPwd,
+		Grants:   []string{"REPLICATION SLAVE ON *.*"},
+	}
+	if err := node.EnsureUser(ctx, replUser); err != nil {
+		return fmt.Errorf("6.4创建/更新repl用户失败: %w", err)
 	}
 
-	// CREATE USER IF NOT EXISTS 不存在就会创建，存在也不会报错
-	// %需要写成%%来转义
-	createUserQuery := fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY ?", ReplUser)
-	if _, err := db.ExecContext(ctx, createUserQuery, replPwd); err != nil {
-		return fmt.Errorf("6.4创建/检查repl用户失败: %w", err)
+	// 同样，ALTER USER 是幂等的，放心执行
+	if err := node.EnsureUser(ctx, MysqlUser{Name: "root", Password: rootPwd}); err != nil {
+		return fmt.Errorf("6.7更新root用户密码失败: %w", err)
 	}
 
-	// 无论是新建的还是旧的，都强制刷新一次密码
-	alterUserQuery := fmt.Sprintf("ALTER USER '%s'@'%%' IDENTIFIED BY ?", ReplUser)
-	if _, err := db.ExecContext(ctx, alterUserQuery, replPwd); err != nil {
-		return fmt.Errorf("6.5更新repl用户密码失败: %w", err)
+	if err := reconcileExporterUser(ctx, node, exporterPwd); err != nil {
+		return err
 	}
 
-	// 授权也是幂等的，多执行几次没关系
-	grantQuery := fmt.Sprintf("GRANT REPLICATION SLAVE ON *.* TO '%s'@'%%'", ReplUser)
-	if _, err := db.ExecContext(ctx, grantQuery); err != nil {
-		return fmt.Errorf("6.6授权repl用户失败: %w", err)
+	if err := node.FlushPrivileges(ctx); err != nil {
+		return fmt.Errorf("6.8刷新权限失败: %w", err)
 	}
 
-	// 同样，ALTER USER 是幂等的，放心执行
-	rootQuery := "ALTER USER 'root'@'%' IDENTIFIED BY ?"
+	return nil
+}
 
-	if _, err := db.ExecContext(ctx, rootQuery, rootPwd); err != nil {
-		return fmt.Errorf("6.7更新root用户密码失败: %w", err)
+// 监控账号只授予mysqld_exporter需要的最小权限，并限制连接数
+// 没有开启监控时删除该账号
+func reconcileExporterUser(ctx context.Context, node MysqlNode, exporterPwd string) error {
+
+	if exporterPwd == "" {
+		if err := node.DropUser(ctx, ExporterUser); err != nil {
+			return fmt.Errorf("6.9删除监控用户失败: %w", err)
+		}
+		return nil
 	}
 
-	if _, err := db.ExecContext(ctx, "FLUSH PRIVILEGES"); err != nil {
-		return fmt.Errorf("6.8刷新权限失败: %w", err)
+	exporterUser := MysqlUser{
+		Name:               ExporterUser,
+		Password:           exporterPwd,
+		MaxUserConnections: 3,
+		Grants: []string{
+			"PROCESS, REPLICATION CLIENT ON *.*",
+			"SELECT ON performance_schema.*",
+		},
+	}
+	if err := node.EnsureUser(ctx, exporterUser); err != nil {
+		return fmt.Errorf("6.9创建/更新监控用户失败: %w", err)
 	}
 
 	return nil
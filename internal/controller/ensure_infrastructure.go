@@ -8,7 +8,7 @@ import (
 )
 
 // 确保基础资源正常
-func (r *MysqlClusterReconciler) ensureInfrastructure(ctx context.Context, cluster *dbv1.MysqlCluster) error {
+func (r *MysqlClusterReconciler) ensureInfrastructure(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) error {
 
 	roles := []string{"master", "slave", "headless"}
 
@@ -29,11 +29,51 @@ func (r *MysqlClusterReconciler) ensureInfrastructure(ctx context.Context, clust
 	if err != nil {
 		return fmt.Errorf("4.configMap计算哈希失败: %w", err)
 	}
+	snapshot.ConfigHash = configHash
+
+	// 已经通过了configMap的校验，这里不会出错
+	config, dynamicConfig, _ := desiredMysqlConfig(cluster)
+	snapshot.DynamicConfig = dynamicConfig
+	snapshot.RevertConfig = revertedMysqlVariables(cluster.Status.AppliedDynamicVariables, config, dynamicConfig)
+	snapshot.AppliedVariables = appliedMysqlVariables(dynamicConfig, snapshot.RevertConfig)
+
+	// 监控账号的密码要在statefulset之前准备好，exporter会引用这个secret
+	if cluster.Spec.Monitoring != nil {
+		exporterPassword, err := r.getOrCreateExporterSecret(ctx, cluster)
+		if err != nil {
+			return fmt.Errorf("4.获取或创建监控账号secret失败: %w", err)
+		}
+		snapshot.ExporterPassword = exporterPassword
+	}
 
 	statefulSetName := fmt.Sprintf("%s-statefulset", cluster.Name)
-	if _, err := r.getOrCreateStatefulSet(ctx, statefulSetName, configHash, cluster); err != nil {
+	sts, err := r.getOrCreateStatefulSet(ctx, statefulSetName, configHash, cluster)
+	if err != nil {
 		return fmt.Errorf("4.获取或创建statefulSet失败: %w", err)
 	}
+	snapshot.ScaleInBlocked = cluster.Spec.Replicas != nil && *cluster.Spec.Replicas < *sts.Spec.Replicas
+	if snapshot.ScaleInBlocked {
+		snapshot.ScaleInMessage = scaleInIgnoredMessage(*sts.Spec.Replicas, *cluster.Spec.Replicas)
+	}
+
+	// 每个pod的service跟随statefulset的副本数
+	if err := r.ensurePodServices(ctx, cluster, sts); err != nil {
+		return fmt.Errorf("4.获取或创建pod service失败: %w", err)
+	}
+
+	for _, role := range []string{"master", "slave", pdbRoleUnlabeled} {
+		if _, err := r.getOrCreatePodDisruptionBudget(ctx, role, cluster); err != nil {
+			return fmt.Errorf("4.获取或创建PodDisruptionBudget失败: %w", err)
+		}
+	}
+
+	if err := r.ensureMonitor(ctx, cluster); err != nil {
+		return fmt.Errorf("4.同步ServiceMonitor失败: %w", err)
+	}
+
+	if err := r.ensureRouter(ctx, cluster, snapshot); err != nil {
+		return fmt.Errorf("4.同步ProxySQL失败: %w", err)
+	}
 
 	return nil
 }
@@ -0,0 +1,317 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	dbv1 "mysql-operator/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// 监控账号用户名
+	ExporterUser = "exporter"
+
+	// exporter sidecar的容器名和端口
+	exporterContainerName = "mysqld-exporter"
+	exporterPortName      = "metrics"
+	exporterPort          = 9104
+)
+
+// prometheus-operator的CRD，没有引入它的go依赖，使用unstructured操作
+var monitorGroupVersion = schema.GroupVersion{Group: "monitoring.coreos.com", Version: "v1"}
+
+// 获取或创建监控账号的密码，保存在operator生成的secret中，exporter通过环境变量引用
+// 密码只在第一次创建时随机生成，之后以secret为准
+func (r *MysqlClusterReconciler) getOrCreateExporterSecret(ctx context.Context, cluster *dbv1.MysqlCluster) (string, error) {
+
+	existingSecret := &corev1.Secret{}
+	secretName := exporterSecretName(cluster)
+
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: secretName}, existingSecret)
+
+	if err == nil {
+		password, ok := existingSecret.Data["password"]
+		if !ok || len(password) == 0 {
+			return "", fmt.Errorf("4.5%s中缺少password，删除它后operator会重新生成", secretName)
+		}
+		return string(password), nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return "", fmt.Errorf("4.5获取%s失败：%w", secretName, err)
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return "", fmt.Errorf("4.5生成监控账号密码失败：%w", err)
+	}
+
+	newSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: cluster.Namespace,
+			Labels: map[string]string{
+				"app":  cluster.Name,
+				"role": "secret-exporter",
+			},
+		},
+		Data: map[string][]byte{
+			"password": []byte(password),
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newSecret, r.Scheme); err != nil {
+		return "", fmt.Errorf("4.5设置%s的OwnerReference时失败：%w", secretName, err)
+	}
+
+	if err := r.Create(ctx, newSecret); err != nil {
+		return "", fmt.Errorf("4.5创建%s失败：%w", secretName, err)
+	}
+
+	return password, nil
+}
+
+func exporterSecretName(cluster *dbv1.MysqlCluster) string {
+	return fmt.Sprintf("%s-exporter-secret", cluster.Name)
+}
+
+// 生成随机密码，只包含url安全的字符，拼到dsn里也不会出问题
+func randomPassword() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// 生成mysqld_exporter sidecar，通过127.0.0.1连接本pod的mysqld
+func mysqldExporterContainer(cluster *dbv1.MysqlCluster) corev1.Container {
+	monitoring := cluster.Spec.Monitoring
+
+	image := monitoring.Image
+	if image == "" {
+		image = dbv1.DefaultMonitoringImage
+	}
+
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("50m"),
+			corev1.ResourceMemory: resource.MustParse("32Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+	}
+	if monitoring.Resources != nil {
+		resources = *monitoring.Resources
+	}
+
+	return corev1.Container{
+		Name:            exporterContainerName,
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+
+		Args: []string{
+			"--mysqld.address=127.0.0.1:3306",
+			"--mysqld.username=" + ExporterUser,
+			fmt.Sprintf("--web.listen-address=:%d", exporterPort),
+		},
+
+		// 密码通过环境变量传入，不出现在进程参数里
+		Env: []corev1.EnvVar{
+			{
+				Name: "MYSQLD_EXPORTER_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: exporterSecretName(cluster)},
+						Key:                  "password",
+					},
+				},
+			},
+		},
+
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          exporterPortName,
+				ContainerPort: exporterPort,
+			},
+		},
+
+		Resources: resources,
+	}
+}
+
+// 根据spec同步ServiceMonitor或PodMonitor
+// 集群中没有安装prometheus-operator时跳过，不影响其他资源
+func (r *MysqlClusterReconciler) ensureMonitor(ctx context.Context, cluster *dbv1.MysqlCluster) error {
+	logger := log.FromContext(ctx)
+
+	desiredKind := ""
+	if cluster.Spec.Monitoring != nil && cluster.Spec.Monitoring.ServiceMonitor != nil {
+		desiredKind = cluster.Spec.Monitoring.ServiceMonitor.Kind
+		if desiredKind == "" {
+			desiredKind = "ServiceMonitor"
+		}
+	}
+
+	for _, kind := range []string{"ServiceMonitor", "PodMonitor"} {
+		var err error
+		if kind == desiredKind {
+			err = r.createOrUpdateMonitor(ctx, kind, cluster)
+		} else {
+			// 关闭监控或者切换了kind，删除不再需要的对象
+			err = r.deleteMonitor(ctx, kind, cluster)
+		}
+
+		if meta.IsNoMatchError(err) {
+			if kind == desiredKind {
+				logger.Info("4.6集群中没有安装prometheus-operator，跳过创建", "kind", kind)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *MysqlClusterReconciler) createOrUpdateMonitor(ctx context.Context, kind string, cluster *dbv1.MysqlCluster) error {
+
+	desired := buildMonitor(kind, cluster)
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(monitorGroupVersion.WithKind(kind))
+
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: desired.GetName()}, existing)
+
+	if err == nil {
+		if equality.Semantic.DeepEqual(existing.Object["spec"], desired.Object["spec"]) &&
+			equality.Semantic.DeepEqual(existing.GetLabels(), desired.GetLabels()) {
+			return nil
+		}
+
+		existing.Object["spec"] = desired.Object["spec"]
+		existing.SetLabels(desired.GetLabels())
+		if err := r.Update(ctx, existing); err != nil {
+			return fmt.Errorf("4.6更新%s %s失败：%w", kind, desired.GetName(), err)
+		}
+		return nil
+	}
+
+	if meta.IsNoMatchError(err) {
+		return err
+	}
+
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("4.6获取%s %s失败：%w", kind, desired.GetName(), err)
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, desired, r.Scheme); err != nil {
+		return fmt.Errorf("4.6设置%s %s的OwnerReference时失败：%w", kind, desired.GetName(), err)
+	}
+
+	if err := r.Create(ctx, desired); err != nil {
+		if meta.IsNoMatchError(err) {
+			return err
+		}
+		return fmt.Errorf("4.6创建%s %s失败：%w", kind, desired.GetName(), err)
+	}
+
+	return nil
+}
+
+func (r *MysqlClusterReconciler) deleteMonitor(ctx context.Context, kind string, cluster *dbv1.MysqlCluster) error {
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(monitorGroupVersion.WithKind(kind))
+	existing.SetNamespace(cluster.Namespace)
+	existing.SetName(monitorName(cluster))
+
+	err := r.Delete(ctx, existing)
+	if err == nil || errors.IsNotFound(err) {
+		return nil
+	}
+	if meta.IsNoMatchError(err) {
+		return err
+	}
+	return fmt.Errorf("4.6删除%s %s失败：%w", kind, existing.GetName(), err)
+}
+
+func monitorName(cluster *dbv1.MysqlCluster) string {
+	return fmt.Sprintf("%s-monitor", cluster.Name)
+}
+
+// 生成ServiceMonitor或PodMonitor
+// 通过podTargetLabels把pod上的app和role标签带到指标上，面板可以按集群和主从区分
+func buildMonitor(kind string, cluster *dbv1.MysqlCluster) *unstructured.Unstructured {
+	config := cluster.Spec.Monitoring.ServiceMonitor
+
+	labels := map[string]interface{}{}
+	for key, value := range config.Labels {
+		labels[key] = value
+	}
+	// app和role放在最后，不允许被覆盖
+	labels["app"] = cluster.Name
+	labels["role"] = "monitor"
+
+	endpoint := map[string]interface{}{
+		"port": exporterPortName,
+		"path": "/metrics",
+	}
+	if config.Interval != "" {
+		endpoint["interval"] = config.Interval
+	}
+
+	spec := map[string]interface{}{
+		"podTargetLabels": []interface{}{"app", "role"},
+	}
+
+	if kind == "PodMonitor" {
+		// 直接选择pod
+		spec["selector"] = map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				"app": cluster.Name,
+			},
+		}
+		spec["podMetricsEndpoints"] = []interface{}{endpoint}
+	} else {
+		// 通过无头服务发现所有pod
+		spec["selector"] = map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				"app":  cluster.Name,
+				"role": "svc-headless",
+			},
+		}
+		spec["endpoints"] = []interface{}{endpoint}
+	}
+
+	monitor := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":      monitorName(cluster),
+				"namespace": cluster.Namespace,
+				"labels":    labels,
+			},
+			"spec": spec,
+		},
+	}
+	monitor.SetGroupVersionKind(monitorGroupVersion.WithKind(kind))
+
+	return monitor
+}
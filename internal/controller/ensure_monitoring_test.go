@@ -0,0 +1,63 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("监控", func() {
+
+	cluster := &dbv1.MysqlCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"},
+		Spec: dbv1.MysqlClusterSpec{
+			Monitoring: &dbv1.MonitoringConfig{
+				ServiceMonitor: &dbv1.ServiceMonitorConfig{
+					Interval: "30s",
+					Labels:   map[string]string{"release": "prometheus", "app": "other"},
+				},
+			},
+		},
+	}
+
+	It("ServiceMonitor通过无头服务发现pod并带上role标签", func() {
+		monitor := buildMonitor("ServiceMonitor", cluster)
+
+		Expect(monitor.GetKind()).To(Equal("ServiceMonitor"))
+		Expect(monitor.GetName()).To(Equal("test-cluster-monitor"))
+		Expect(monitor.GetLabels()).To(Equal(map[string]string{"release": "prometheus", "app": "test-cluster", "role": "monitor"}))
+
+		selector, _, _ := unstructured.NestedStringMap(monitor.Object, "spec", "selector", "matchLabels")
+		Expect(selector).To(Equal(map[string]string{"app": "test-cluster", "role": "svc-headless"}))
+
+		targetLabels, _, _ := unstructured.NestedStringSlice(monitor.Object, "spec", "podTargetLabels")
+		Expect(targetLabels).To(ConsistOf("app", "role"))
+
+		endpoints, _, _ := unstructured.NestedSlice(monitor.Object, "spec", "endpoints")
+		Expect(endpoints).To(HaveLen(1))
+		Expect(endpoints[0]).To(HaveKeyWithValue("port", "metrics"))
+		Expect(endpoints[0]).To(HaveKeyWithValue("interval", "30s"))
+	})
+
+	It("PodMonitor直接选择集群的pod", func() {
+		monitor := buildMonitor("PodMonitor", cluster)
+
+		selector, _, _ := unstructured.NestedStringMap(monitor.Object, "spec", "selector", "matchLabels")
+		Expect(selector).To(Equal(map[string]string{"app": "test-cluster"}))
+
+		endpoints, _, _ := unstructured.NestedSlice(monitor.Object, "spec", "podMetricsEndpoints")
+		Expect(endpoints).To(HaveLen(1))
+	})
+
+	It("exporter使用operator生成的secret，不把密码放在参数里", func() {
+		container := mysqldExporterContainer(cluster)
+
+		Expect(container.Image).To(Equal(dbv1.DefaultMonitoringImage))
+		Expect(container.Args).To(ContainElement("--mysqld.username=exporter"))
+		Expect(container.Env).To(HaveLen(1))
+		Expect(container.Env[0].ValueFrom.SecretKeyRef.Name).To(Equal("test-cluster-exporter-secret"))
+	})
+})
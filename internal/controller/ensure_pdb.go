@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	dbv1 "mysql-operator/api/v1"
+
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// 没有role标签的pod使用的PDB名字后缀，新建或重建的pod在operator打上标签之前属于这一组
+const pdbRoleUnlabeled = "unlabeled"
+
+// 主库、从库和还没有角色的pod各用一个PDB，一个pod同时被多个PDB选中时eviction接口会直接报错，所以按role标签分开选择
+// master: maxUnavailable=0，驱逐会被挡住，直到operator发现节点被cordon并把主库切走
+// 不先cordon的驱逐（cluster-autoscaler缩容、Karpenter合并等）会一直被挡住，开启allowMasterEviction后改为1，驱逐后被动选主
+// slave: maxUnavailable取自spec，默认为1
+// unlabeled: 选择role不是master和slave的pod（包括没有role标签的），和从库一样取自spec，避免这些pod不受任何PDB保护
+func (r *MysqlClusterReconciler) getOrCreatePodDisruptionBudget(ctx context.Context, role string, cluster *dbv1.MysqlCluster) (*policyv1.PodDisruptionBudget, error) {
+
+	existingPdb := &policyv1.PodDisruptionBudget{}
+	pdbName := fmt.Sprintf("%s-pdb-%s", cluster.Name, role)
+
+	newPdb := r.createPodDisruptionBudget(pdbName, role, cluster)
+
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: pdbName}, existingPdb)
+
+	if err == nil {
+		// 只同步maxUnavailable，selector是固定的
+		if equality.Semantic.DeepEqual(existingPdb.Spec.MaxUnavailable, newPdb.Spec.MaxUnavailable) {
+			return existingPdb, nil
+		}
+
+		existingPdb.Spec.MaxUnavailable = newPdb.Spec.MaxUnavailable
+		if err := r.Update(ctx, existingPdb); err != nil {
+			return nil, fmt.Errorf("4.4更新%s失败：%w", pdbName, err)
+		}
+		return existingPdb, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("4.4获取%s失败：%w", pdbName, err)
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newPdb, r.Scheme); err != nil {
+		return nil, fmt.Errorf("4.4设置%s的OwnerReference时失败：%w", pdbName, err)
+	}
+
+	if err := r.Create(ctx, newPdb); err != nil {
+		return nil, fmt.Errorf("4.4创建%s失败：%w", pdbName, err)
+	}
+
+	return newPdb, nil
+}
+
+func (r *MysqlClusterReconciler) createPodDisruptionBudget(pdbName, role string, cluster *dbv1.MysqlCluster) *policyv1.PodDisruptionBudget {
+
+	maxUnavailable := intstr.FromInt32(1)
+	if cluster.Spec.PodDisruptionBudget != nil && cluster.Spec.PodDisruptionBudget.MaxUnavailable != nil {
+		maxUnavailable = *cluster.Spec.PodDisruptionBudget.MaxUnavailable
+	}
+	if role == "master" {
+		maxUnavailable = intstr.FromInt32(0)
+		if cluster.Spec.PodDisruptionBudget != nil && cluster.Spec.PodDisruptionBudget.AllowMasterEviction {
+			maxUnavailable = intstr.FromInt32(1)
+		}
+	}
+
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app":  cluster.Name,
+			"role": role,
+		},
+	}
+	if role == pdbRoleUnlabeled {
+		// NotIn也会选中没有role标签的pod
+		selector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{"app": cluster.Name},
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      "role",
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"master", "slave"},
+			}},
+		}
+	}
+
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pdbName,
+			Namespace: cluster.Namespace,
+			Labels: map[string]string{
+				"app":  cluster.Name,
+				"role": "pdb-" + role,
+			},
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector:       selector,
+		},
+	}
+}
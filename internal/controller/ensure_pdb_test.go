@@ -0,0 +1,88 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("PodDisruptionBudget", func() {
+
+	var (
+		cluster    *dbv1.MysqlCluster
+		reconciler *MysqlClusterReconciler
+	)
+
+	BeforeEach(func() {
+		cluster = &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+		reconciler = &MysqlClusterReconciler{}
+	})
+
+	It("默认主库不允许驱逐，从库最多驱逐1个", func() {
+		master := reconciler.createPodDisruptionBudget("test-cluster-pdb-master", "master", cluster)
+		Expect(*master.Spec.MaxUnavailable).To(Equal(intstr.FromInt32(0)))
+		Expect(master.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "test-cluster", "role": "master"}))
+
+		slave := reconciler.createPodDisruptionBudget("test-cluster-pdb-slave", "slave", cluster)
+		Expect(*slave.Spec.MaxUnavailable).To(Equal(intstr.FromInt32(1)))
+		Expect(slave.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "test-cluster", "role": "slave"}))
+	})
+
+	It("还没有role标签的pod也受PDB保护，并且只被一个PDB选中", func() {
+		maxUnavailable := intstr.FromString("50%")
+		cluster.Spec.PodDisruptionBudget = &dbv1.PodDisruptionBudgetConfig{MaxUnavailable: &maxUnavailable}
+
+		var selectors []labels.Selector
+		for _, role := range []string{"master", "slave", pdbRoleUnlabeled} {
+			pdb := reconciler.createPodDisruptionBudget("test-cluster-pdb-"+role, role, cluster)
+			selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+			Expect(err).NotTo(HaveOccurred())
+			selectors = append(selectors, selector)
+
+			if role == pdbRoleUnlabeled {
+				Expect(*pdb.Spec.MaxUnavailable).To(Equal(maxUnavailable))
+			}
+		}
+
+		podLabels := []labels.Set{
+			{"app": "test-cluster"},
+			{"app": "test-cluster", "role": ""},
+			{"app": "test-cluster", "role": "master"},
+			{"app": "test-cluster", "role": "slave"},
+		}
+		for _, set := range podLabels {
+			matched := 0
+			for _, selector := range selectors {
+				if selector.Matches(set) {
+					matched++
+				}
+			}
+			Expect(matched).To(Equal(1), "pod标签%v", set)
+		}
+
+		// 其他集群和ProxySQL的pod不受影响
+		for _, set := range []labels.Set{{"app": "other"}, {"app": "test-cluster-router", "role": "router"}} {
+			for _, selector := range selectors {
+				Expect(selector.Matches(set)).To(BeFalse())
+			}
+		}
+	})
+
+	It("从库使用spec中的maxUnavailable，主库不受影响", func() {
+		maxUnavailable := intstr.FromString("50%")
+		cluster.Spec.PodDisruptionBudget = &dbv1.PodDisruptionBudgetConfig{MaxUnavailable: &maxUnavailable}
+
+		Expect(*reconciler.createPodDisruptionBudget("test-cluster-pdb-slave", "slave", cluster).Spec.MaxUnavailable).To(Equal(maxUnavailable))
+		Expect(*reconciler.createPodDisruptionBudget("test-cluster-pdb-master", "master", cluster).Spec.MaxUnavailable).To(Equal(intstr.FromInt32(0)))
+	})
+
+	It("开启allowMasterEviction后主库可以被驱逐", func() {
+		cluster.Spec.PodDisruptionBudget = &dbv1.PodDisruptionBudgetConfig{AllowMasterEviction: true}
+
+		Expect(*reconciler.createPodDisruptionBudget("test-cluster-pdb-master", "master", cluster).Spec.MaxUnavailable).To(Equal(intstr.FromInt32(1)))
+	})
+})
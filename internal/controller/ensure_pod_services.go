@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dbv1 "mysql-operator/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// statefulset控制器给每个pod打的标签，值为pod名字
+const podNameLabel = appsv1.StatefulSetPodNameLabel
+
+// 每个pod一个service，名字为<集群名>-svc-pod-<序号>
+func podServiceName(cluster *dbv1.MysqlCluster, ordinal int32) string {
+	return fmt.Sprintf("%s-svc-pod-%d", cluster.Name, ordinal)
+}
+
+// 为每个pod创建一个固定指向它的service，方便调试或从集群外使用pt-table-checksum等工具
+// 副本数以statefulset为准，序号超出副本数或者关闭了perPod时删除多余的service
+func (r *MysqlClusterReconciler) ensurePodServices(ctx context.Context, cluster *dbv1.MysqlCluster, sts *appsv1.StatefulSet) error {
+	logger := log.FromContext(ctx)
+
+	var config *dbv1.ServiceConfig
+	if cluster.Spec.Services != nil {
+		config = cluster.Spec.Services.PerPod
+	}
+
+	replicas := int32(0)
+	if config != nil && sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+
+	if err := validateServiceConfig(config); err != nil {
+		return fmt.Errorf("4.1每个pod的service配置不合法：%w", err)
+	}
+
+	for ordinal := int32(0); ordinal < replicas; ordinal++ {
+		if err := r.createOrUpdatePodService(ctx, cluster, sts, ordinal, config); err != nil {
+			return err
+		}
+	}
+
+	// 清理多余的service
+	serviceList := &corev1.ServiceList{}
+	if err := r.List(ctx, serviceList, client.InNamespace(cluster.Namespace), client.MatchingLabels{"app": cluster.Name, "role": "svc-pod"}); err != nil {
+		return fmt.Errorf("4.1获取每个pod的service列表失败：%w", err)
+	}
+
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+
+		ordinal, ok := podServiceOrdinal(cluster, service.Name)
+		if ok && ordinal < replicas {
+			continue
+		}
+
+		if err := r.Delete(ctx, service); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("4.1删除%s失败：%w", service.Name, err)
+		}
+		logger.Info("4.1已删除多余的pod service", "service", service.Name)
+	}
+
+	return nil
+}
+
+// 从service名字中解析pod序号
+func podServiceOrdinal(cluster *dbv1.MysqlCluster, serviceName string) (int32, bool) {
+	suffix, ok := strings.CutPrefix(serviceName, cluster.Name+"-svc-pod-")
+	if !ok {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return int32(ordinal), true
+}
+
+func (r *MysqlClusterReconciler) createOrUpdatePodService(ctx context.Context, cluster *dbv1.MysqlCluster, sts *appsv1.StatefulSet, ordinal int32, config *dbv1.ServiceConfig) error {
+
+	newService := createPodService(cluster, sts, ordinal, config)
+
+	existingService := &corev1.Service{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: newService.Name}, existingService)
+
+	if err == nil {
+		if syncServiceSpec(existingService, newService) {
+			if err := r.Update(ctx, existingService); err != nil {
+				return fmt.Errorf("4.1更新%s失败：%w", newService.Name, err)
+			}
+		}
+		return nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("4.1获取%s失败：%w", newService.Name, err)
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newService, r.Scheme); err != nil {
+		return fmt.Errorf("4.1设置%s的OwnerReference时失败：%w", newService.Name, err)
+	}
+
+	if err := r.Create(ctx, newService); err != nil {
+		return fmt.Errorf("4.1创建%s失败：%w", newService.Name, err)
+	}
+
+	return nil
+}
+
+// 按statefulset.kubernetes.io/pod-name选择pod，pod重建后依然指向同一个序号
+// 不需要等pod ready，publishNotReadyAddresses让从库追数据时也能连接
+func createPodService(cluster *dbv1.MysqlCluster, sts *appsv1.StatefulSet, ordinal int32, config *dbv1.ServiceConfig) *corev1.Service {
+	podName := fmt.Sprintf("%s-%d", sts.Name, ordinal)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podServiceName(cluster, ordinal),
+			Namespace: cluster.Namespace,
+			Labels: map[string]string{
+				"app":  cluster.Name,
+				"role": "svc-pod",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app":        cluster.Name,
+				podNameLabel: podName,
+			},
+			Ports: []corev1.ServicePort{
+				{
+					Port:       3306,
+					TargetPort: intstr.FromInt32(3306),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+			Type:                     corev1.ServiceTypeClusterIP,
+			PublishNotReadyAddresses: true,
+		},
+	}
+
+	applyServiceConfig(service, config)
+
+	if len(service.Spec.Ports) > 1 {
+		service.Spec.Ports[0].Name = "mysql"
+	}
+
+	return service
+}
@@ -0,0 +1,400 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	dbv1 "mysql-operator/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// ProxySQL的业务端口和管理端口
+	routerMysqlPort = 6033
+	routerAdminPort = 6032
+
+	// operator通过管理接口同步后端时使用的账号，ProxySQL的admin账号只允许本地登录，所以另起一个名字
+	routerAdminUser = "operator"
+
+	// 写主机组和读主机组
+	routerWriterHostgroup = 10
+	routerReaderHostgroup = 20
+)
+
+// 确保ProxySQL相关的资源：保存配置和管理密码的secret、deployment、service
+// 没有开启router时删除之前创建的资源
+func (r *MysqlClusterReconciler) ensureRouter(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) error {
+
+	if cluster.Spec.Router == nil {
+		return r.deleteRouter(ctx, cluster)
+	}
+
+	adminPassword, err := r.getOrCreateRouterAdminPassword(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	snapshot.RouterAdminPassword = adminPassword
+
+	users, err := r.routerUsers(ctx, cluster, snapshot.RootPassword)
+	if err != nil {
+		return err
+	}
+
+	config := renderProxySQLConfig(adminPassword, users)
+	if err := r.createOrUpdateRouterConfig(ctx, cluster, config); err != nil {
+		return err
+	}
+
+	if err := r.createOrUpdateRouterDeployment(ctx, cluster, config); err != nil {
+		return err
+	}
+
+	if _, err := r.getOrCreateService(ctx, "router", cluster); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func routerName(cluster *dbv1.MysqlCluster) string {
+	return fmt.Sprintf("%s-router", cluster.Name)
+}
+
+// ProxySQL pod的标签，不能带app=集群名，否则会被statefulset和无头服务选中
+func routerLabels(cluster *dbv1.MysqlCluster) map[string]string {
+	return map[string]string{
+		"app":  routerName(cluster),
+		"role": "router",
+	}
+}
+
+// 管理账号的密码保存在单独的secret中，只在第一次创建时生成
+func (r *MysqlClusterReconciler) getOrCreateRouterAdminPassword(ctx context.Context, cluster *dbv1.MysqlCluster) (string, error) {
+
+	existingSecret := &corev1.Secret{}
+	secretName := fmt.Sprintf("%s-admin-secret", routerName(cluster))
+
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: secretName}, existingSecret)
+	if err == nil {
+		password, ok := existingSecret.Data["password"]
+		if !ok || len(password) == 0 {
+			return "", fmt.Errorf("4.7%s中缺少password，删除它后operator会重新生成", secretName)
+		}
+		return string(password), nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return "", fmt.Errorf("4.7获取%s失败：%w", secretName, err)
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return "", fmt.Errorf("4.7生成ProxySQL管理密码失败：%w", err)
+	}
+
+	newSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: cluster.Namespace,
+			Labels:    routerLabels(cluster),
+		},
+		Data: map[string][]byte{
+			"password": []byte(password),
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newSecret, r.Scheme); err != nil {
+		return "", fmt.Errorf("4.7设置%s的OwnerReference时失败：%w", secretName, err)
+	}
+
+	if err := r.Create(ctx, newSecret); err != nil {
+		return "", fmt.Errorf("4.7创建%s失败：%w", secretName, err)
+	}
+
+	return password, nil
+}
+
+// 收集需要写入ProxySQL的账号，key为用户名，value为密码
+func (r *MysqlClusterReconciler) routerUsers(ctx context.Context, cluster *dbv1.MysqlCluster, rootPassword string) (map[string]string, error) {
+	users := map[string]string{"root": rootPassword}
+
+	for _, user := range cluster.Spec.Router.Users {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: user.PasswordSecret.Name}, secret); err != nil {
+			return nil, fmt.Errorf("4.7获取账号%s的secret %s失败：%w", user.Name, user.PasswordSecret.Name, err)
+		}
+
+		password, ok := secret.Data[user.PasswordSecret.Key]
+		if !ok {
+			return nil, fmt.Errorf("4.7secret %s中缺少键'%s'", user.PasswordSecret.Name, user.PasswordSecret.Key)
+		}
+		users[user.Name] = string(password)
+	}
+
+	return users, nil
+}
+
+// 生成proxysql.cnf，包含密码，所以放在secret里
+// 后端mysql_servers不写在这里，由operator通过管理接口同步，否则每次选主都要重启ProxySQL
+func renderProxySQLConfig(adminPassword string, users map[string]string) string {
+	var b strings.Builder
+
+	b.WriteString("datadir=\"/var/lib/proxysql\"\n\n")
+
+	b.WriteString("admin_variables=\n{\n")
+	fmt.Fprintf(&b, "    admin_credentials=\"%s:%s\"\n", routerAdminUser, escapeLibconfig(adminPassword))
+	fmt.Fprintf(&b, "    mysql_ifaces=\"0.0.0.0:%d\"\n", routerAdminPort)
+	b.WriteString("}\n\n")
+
+	// 后端的主从由operator决定，关闭ProxySQL自己的监控，也就不需要监控账号
+	b.WriteString("mysql_variables=\n{\n")
+	b.WriteString("    threads=4\n")
+	b.WriteString("    max_connections=2048\n")
+	fmt.Fprintf(&b, "    interfaces=\"0.0.0.0:%d\"\n", routerMysqlPort)
+	b.WriteString("    server_version=\"5.7.44\"\n")
+	b.WriteString("    monitor_enabled=false\n")
+	b.WriteString("    connect_timeout_server=3000\n")
+	b.WriteString("}\n\n")
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// transaction_persistent保证同一个事务内的语句都发往同一个主机组
+	b.WriteString("mysql_users=\n(\n")
+	for i, name := range names {
+		separator := ","
+		if i == len(names)-1 {
+			separator = ""
+		}
+		fmt.Fprintf(&b, "    { username=\"%s\", password=\"%s\", default_hostgroup=%d, transaction_persistent=1 }%s\n",
+			escapeLibconfig(name), escapeLibconfig(users[name]), routerWriterHostgroup, separator)
+	}
+	b.WriteString(")\n\n")
+
+	// 读写分离：SELECT ... FOR UPDATE发往主库，其他SELECT发往读主机组，剩下的走用户的默认主机组（主库）
+	b.WriteString("mysql_query_rules=\n(\n")
+	fmt.Fprintf(&b, "    { rule_id=1, active=1, match_digest=\"^SELECT.*FOR UPDATE\", destination_hostgroup=%d, apply=1 },\n", routerWriterHostgroup)
+	fmt.Fprintf(&b, "    { rule_id=2, active=1, match_digest=\"^SELECT\", destination_hostgroup=%d, apply=1 }\n", routerReaderHostgroup)
+	b.WriteString(")\n")
+
+	return b.String()
+}
+
+// libconfig字符串中的反斜杠和双引号需要转义
+func escapeLibconfig(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func (r *MysqlClusterReconciler) createOrUpdateRouterConfig(ctx context.Context, cluster *dbv1.MysqlCluster, config string) error {
+
+	existingSecret := &corev1.Secret{}
+	secretName := fmt.Sprintf("%s-config", routerName(cluster))
+
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: secretName}, existingSecret)
+	if err == nil {
+		if string(existingSecret.Data["proxysql.cnf"]) == config {
+			return nil
+		}
+		existingSecret.Data = map[string][]byte{"proxysql.cnf": []byte(config)}
+		if err := r.Update(ctx, existingSecret); err != nil {
+			return fmt.Errorf("4.7更新%s失败：%w", secretName, err)
+		}
+		return nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("4.7获取%s失败：%w", secretName, err)
+	}
+
+	newSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: cluster.Namespace,
+			Labels:    routerLabels(cluster),
+		},
+		Data: map[string][]byte{
+			"proxysql.cnf": []byte(config),
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newSecret, r.Scheme); err != nil {
+		return fmt.Errorf("4.7设置%s的OwnerReference时失败：%w", secretName, err)
+	}
+
+	if err := r.Create(ctx, newSecret); err != nil {
+		return fmt.Errorf("4.7创建%s失败：%w", secretName, err)
+	}
+
+	return nil
+}
+
+// ProxySQL没有持久化的数据，用deployment部署，配置变化时通过注解中的哈希触发滚动更新
+func (r *MysqlClusterReconciler) createOrUpdateRouterDeployment(ctx context.Context, cluster *dbv1.MysqlCluster, config string) error {
+	logger := log.FromContext(ctx)
+
+	newDeploy := createRouterDeployment(cluster, config)
+
+	existingDeploy := &appsv1.Deployment{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: newDeploy.Name}, existingDeploy)
+
+	if err == nil {
+		if existingDeploy.Spec.Template.Annotations["checksum/router"] == newDeploy.Spec.Template.Annotations["checksum/router"] &&
+			*existingDeploy.Spec.Replicas == *newDeploy.Spec.Replicas {
+			return nil
+		}
+
+		logger.Info("ProxySQL配置发生变化，更新Deployment", "name", newDeploy.Name)
+		existingDeploy.Spec.Replicas = newDeploy.Spec.Replicas
+		existingDeploy.Spec.Template = newDeploy.Spec.Template
+		if err := r.Update(ctx, existingDeploy); err != nil {
+			return fmt.Errorf("4.7更新%s失败：%w", newDeploy.Name, err)
+		}
+		return nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("4.7获取%s失败：%w", newDeploy.Name, err)
+	}
+
+	if err := controllerutil.SetControllerReference(cluster, newDeploy, r.Scheme); err != nil {
+		return fmt.Errorf("4.7设置%s的OwnerReference时失败：%w", newDeploy.Name, err)
+	}
+
+	if err := r.Create(ctx, newDeploy); err != nil {
+		return fmt.Errorf("4.7创建%s失败：%w", newDeploy.Name, err)
+	}
+
+	return nil
+}
+
+func createRouterDeployment(cluster *dbv1.MysqlCluster, config string) *appsv1.Deployment {
+	router := cluster.Spec.Router
+
+	replicas := int32(2)
+	if router.Replicas != nil {
+		replicas = *router.Replicas
+	}
+
+	image := router.Image
+	if image == "" {
+		image = dbv1.DefaultRouterImage
+	}
+
+	labels := routerLabels(cluster)
+
+	container := corev1.Container{
+		Name:            "proxysql",
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Resources:       router.Resources,
+
+		// datadir是emptyDir，pod重建时按配置文件初始化；容器重启时沿用datadir中保存的后端，不等operator同步
+		// 配置文件变化时checksum注解会触发pod重建
+		Args: []string{"-f", "-c", "/etc/proxysql/proxysql.cnf"},
+
+		Ports: []corev1.ContainerPort{
+			{Name: "mysql", ContainerPort: routerMysqlPort},
+			{Name: "admin", ContainerPort: routerAdminPort},
+		},
+
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "config", MountPath: "/etc/proxysql", ReadOnly: true},
+			{Name: "data", MountPath: "/var/lib/proxysql"},
+		},
+
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(routerMysqlPort)},
+			},
+			PeriodSeconds: 5,
+		},
+		LivenessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(routerAdminPort)},
+			},
+			InitialDelaySeconds: 10,
+			PeriodSeconds:       10,
+		},
+	}
+
+	// 哈希包含配置文件和容器定义，任何一个变化都需要重启ProxySQL
+	hash := sha256.New()
+	hash.Write([]byte(config))
+	hash.Write([]byte(container.String()))
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      routerName(cluster),
+			Namespace: cluster.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: routerLabels(cluster),
+					Annotations: map[string]string{
+						"checksum/router": hex.EncodeToString(hash.Sum(nil)),
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{container},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: fmt.Sprintf("%s-config", routerName(cluster)),
+								},
+							},
+						},
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// 关闭router后删除deployment、service和secret
+func (r *MysqlClusterReconciler) deleteRouter(ctx context.Context, cluster *dbv1.MysqlCluster) error {
+	name := routerName(cluster)
+
+	objects := []client.Object{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cluster.Namespace}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-svc-router", cluster.Name), Namespace: cluster.Namespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-config", name), Namespace: cluster.Namespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-admin-secret", name), Namespace: cluster.Namespace}},
+	}
+
+	for _, object := range objects {
+		if err := r.Delete(ctx, object); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("4.7删除%s失败：%w", object.GetName(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("ProxySQL", func() {
+
+	var cluster *dbv1.MysqlCluster
+
+	BeforeEach(func() {
+		cluster = &dbv1.MysqlCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"},
+			Spec:       dbv1.MysqlClusterSpec{Router: &dbv1.RouterConfig{}},
+		}
+	})
+
+	It("配置文件包含管理账号、业务账号和读写分离规则", func() {
+		config := renderProxySQLConfig("admin-pwd", map[string]string{
+			"root": "root-pwd",
+			"app":  `p"w\d`,
+		})
+
+		Expect(config).To(ContainSubstring(`admin_credentials="operator:admin-pwd"`))
+		Expect(config).To(ContainSubstring(`{ username="app", password="p\"w\\d", default_hostgroup=10, transaction_persistent=1 },`))
+		Expect(config).To(ContainSubstring(`{ username="root", password="root-pwd", default_hostgroup=10, transaction_persistent=1 }` + "\n"))
+		Expect(config).To(ContainSubstring(`match_digest="^SELECT.*FOR UPDATE", destination_hostgroup=10`))
+		Expect(config).To(ContainSubstring(`match_digest="^SELECT", destination_hostgroup=20`))
+	})
+
+	It("配置变化时deployment的哈希随之变化", func() {
+		a := createRouterDeployment(cluster, renderProxySQLConfig("pwd", map[string]string{"root": "a"}))
+		b := createRouterDeployment(cluster, renderProxySQLConfig("pwd", map[string]string{"root": "b"}))
+
+		Expect(a.Spec.Template.Annotations["checksum/router"]).NotTo(Equal(b.Spec.Template.Annotations["checksum/router"]))
+		Expect(a.Spec.Selector.MatchLabels).NotTo(HaveKeyWithValue("app", "test-cluster"))
+		Expect(*a.Spec.Replicas).To(Equal(int32(2)))
+	})
+
+	It("写主机组是主库，读主机组和读服务一致", func() {
+		masterHost := "test-cluster-0.test-cluster-svc-headless.default"
+		node := func(name, role string, lag *int64) *PodInfo {
+			pod := &PodInfo{
+				Pod:           &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}},
+				Role:          role,
+				IsReady:       true,
+				IsConnectable: true,
+			}
+			if role == "slave" {
+				pod.Replication = &ReplicationStatus{MasterHost: masterHost, IORunning: "Yes", SQLRunning: "Yes", SecondsBehindMaster: lag}
+			}
+			return pod
+		}
+
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			node("test-cluster-2", "slave", ptr.To(int64(0))),
+			node("test-cluster-0", "master", nil),
+			node("test-cluster-1", "slave", ptr.To(int64(600))),
+		}}
+
+		Expect(desiredRouterBackends(cluster, snapshot)).To(Equal([]routerBackend{
+			{Hostgroup: routerWriterHostgroup, Hostname: masterHost},
+			{Hostgroup: routerReaderHostgroup, Hostname: "test-cluster-2.test-cluster-svc-headless.default"},
+		}))
+
+		// 关闭fallbackToMaster且没有可读的从库时，读主机组仍然放入主库，避免SELECT超时
+		cluster.Spec.ReadService = &dbv1.ReadServiceConfig{FallbackToMaster: ptr.To(false)}
+		snapshot.Pods[0].Replication.SecondsBehindMaster = ptr.To(int64(600))
+		Expect(desiredRouterBackends(cluster, snapshot)).To(Equal([]routerBackend{
+			{Hostgroup: routerWriterHostgroup, Hostname: masterHost},
+			{Hostgroup: routerReaderHostgroup, Hostname: masterHost},
+		}))
+	})
+})
@@ -3,9 +3,13 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+
 	dbv1 "mysql-operator/api/v1"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -18,9 +22,21 @@ func (r *MysqlClusterReconciler) getOrCreateService(ctx context.Context, role st
 	existingService := &corev1.Service{}
 	serviceName := fmt.Sprintf("%s-svc-%s", cluster.Name, role)
 
+	if err := validateServiceConfig(serviceConfig(role, cluster)); err != nil {
+		return nil, fmt.Errorf("4.1%s的配置不合法：%w", serviceName, err)
+	}
+
 	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: serviceName}, existingService)
 
+	newService := r.createService(serviceName, role, cluster)
+
 	if err == nil {
+		// 类型、端口、注解随spec变化，需要同步；selector由reconcileReadEndpoints维护
+		if syncServiceSpec(existingService, newService) {
+			if err := r.Update(ctx, existingService); err != nil {
+				return nil, fmt.Errorf("4.1更新%s失败：%w", serviceName, err)
+			}
+		}
 		return existingService, nil
 	}
 
@@ -28,8 +44,6 @@ func (r *MysqlClusterReconciler) getOrCreateService(ctx context.Context, role st
 		return nil, fmt.Errorf("4.1获取%s失败：%w", serviceName, err)
 	}
 
-	newService := r.createService(serviceName, role, cluster)
-
 	// 不需要手动设置OwnerReference，controllerutil.SetControllerReference会帮我们处理
 	if err := controllerutil.SetControllerReference(cluster, newService, r.Scheme); err != nil {
 		return nil, fmt.Errorf("4.1设置%s的OwnerReference时失败：%w", serviceName, err)
@@ -44,21 +58,43 @@ func (r *MysqlClusterReconciler) getOrCreateService(ctx context.Context, role st
 }
 
 func (r *MysqlClusterReconciler) createService(serviceName, role string, cluster *dbv1.MysqlCluster) *corev1.Service {
-	// 为headless单独设置标签和ClusterIP
+	// 为headless单独设置ClusterIP
 	var clusterIP string
-	var selector = map[string]string{
-		"app": cluster.Name,
-	}
-
 	if role == "headless" {
 		clusterIP = "None"
 	}
+	selector := serviceSelector(role, cluster)
 
-	if role != "headless" {
-		selector["role"] = role
+	ports := []corev1.ServicePort{
+		{
+			Port: 3306,
+			TargetPort: intstr.IntOrString{
+				Type:   intstr.Int,
+				IntVal: 3306,
+			},
+			Protocol: corev1.ProtocolTCP,
+		},
+	}
+
+	// 统一入口的3306端口转发到ProxySQL的业务端口
+	if role == "router" {
+		ports[0].TargetPort = intstr.FromInt32(routerMysqlPort)
+	}
+
+	// 开启监控时无头服务增加exporter的端口，ServiceMonitor通过它发现所有pod
+	if role == "headless" && cluster.Spec.Monitoring != nil {
+		ports = append(ports, corev1.ServicePort{
+			Name: exporterPortName,
+			Port: exporterPort,
+			TargetPort: intstr.IntOrString{
+				Type:   intstr.Int,
+				IntVal: exporterPort,
+			},
+			Protocol: corev1.ProtocolTCP,
+		})
 	}
 
-	return &corev1.Service{
+	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      serviceName,
 			Namespace: cluster.Namespace,
@@ -68,19 +104,191 @@ func (r *MysqlClusterReconciler) createService(serviceName, role string, cluster
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Selector: selector,
-			Ports: []corev1.ServicePort{
-				{
-					Port: 3306,
-					TargetPort: intstr.IntOrString{
-						Type:   intstr.Int,
-						IntVal: 3306,
-					},
-					Protocol: corev1.ProtocolTCP,
-				},
-			},
+			Selector:  selector,
+			Ports:     ports,
 			Type:      corev1.ServiceTypeClusterIP,
 			ClusterIP: clusterIP,
 		},
 	}
+
+	applyServiceConfig(service, serviceConfig(role, cluster))
+
+	// 多个端口时必须命名
+	if len(service.Spec.Ports) > 1 {
+		service.Spec.Ports[0].Name = "mysql"
+	}
+
+	return service
+}
+
+// 用户在spec.services中为该角色设置的配置，无头服务不允许修改
+func serviceConfig(role string, cluster *dbv1.MysqlCluster) *dbv1.ServiceConfig {
+	services := cluster.Spec.Services
+	if services == nil {
+		return nil
+	}
+
+	switch role {
+	case "master":
+		return services.Master
+	case "slave":
+		return services.Slave
+	case "router":
+		return services.Router
+	}
+	return nil
+}
+
+// 额外端口不能和mysql端口冲突，多端口的service要求每个端口都有名字
+func validateServiceConfig(config *dbv1.ServiceConfig) error {
+	if config == nil {
+		return nil
+	}
+
+	names := map[string]bool{"mysql": true}
+	for _, port := range config.ExtraPorts {
+		if port.Name == "" {
+			return fmt.Errorf("额外端口%d缺少name", port.Port)
+		}
+		if names[port.Name] {
+			return fmt.Errorf("额外端口的name %s重复或与mysql端口冲突", port.Name)
+		}
+		if port.Port == 3306 {
+			return fmt.Errorf("额外端口%s不能使用3306", port.Name)
+		}
+		names[port.Name] = true
+	}
+
+	return nil
+}
+
+// 把spec.services中的配置应用到service上
+func applyServiceConfig(service *corev1.Service, config *dbv1.ServiceConfig) {
+	if config == nil {
+		return
+	}
+
+	if config.Type != "" {
+		service.Spec.Type = config.Type
+	}
+
+	// 只有NodePort和LoadBalancer才能设置externalTrafficPolicy，apiserver的默认值是Cluster
+	if service.Spec.Type != corev1.ServiceTypeClusterIP {
+		service.Spec.ExternalTrafficPolicy = config.ExternalTrafficPolicy
+		if service.Spec.ExternalTrafficPolicy == "" {
+			service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+		}
+	}
+
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = config.LoadBalancerSourceRanges
+	}
+
+	// 补齐apiserver会填充的默认值，避免每次比较都认为有变化
+	for _, port := range config.ExtraPorts {
+		if port.Protocol == "" {
+			port.Protocol = corev1.ProtocolTCP
+		}
+		if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+			port.TargetPort = intstr.FromInt32(port.Port)
+		}
+		if service.Spec.Type == corev1.ServiceTypeClusterIP {
+			port.NodePort = 0
+		}
+		service.Spec.Ports = append(service.Spec.Ports, port)
+	}
+
+	if len(config.Annotations) > 0 {
+		service.Annotations = make(map[string]string, len(config.Annotations)+1)
+		keys := make([]string, 0, len(config.Annotations))
+		for key, value := range config.Annotations {
+			service.Annotations[key] = value
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		service.Annotations[managedAnnotationsKey] = strings.Join(keys, ",")
+	}
+}
+
+// 记录operator写入的注解，用户从spec中删除注解时据此从service上删除
+// 云厂商的控制器也会给service加注解，不在这个列表里的注解不会被改动
+const managedAnnotationsKey = "apps.rumraisin.me/managed-annotations"
+
+// 把期望的类型、端口和注解同步到已有的service上，返回值表示是否有变化
+func syncServiceSpec(existing, desired *corev1.Service) bool {
+	changed := false
+
+	// apiserver分配的nodePort保留下来，否则每次更新都会重新分配
+	if desired.Spec.Type != corev1.ServiceTypeClusterIP {
+		for i := range desired.Spec.Ports {
+			if desired.Spec.Ports[i].NodePort != 0 {
+				continue
+			}
+			for _, port := range existing.Spec.Ports {
+				if port.Port == desired.Spec.Ports[i].Port && port.Protocol == desired.Spec.Ports[i].Protocol {
+					desired.Spec.Ports[i].NodePort = port.NodePort
+				}
+			}
+		}
+	}
+
+	if existing.Spec.Type != desired.Spec.Type ||
+		existing.Spec.ExternalTrafficPolicy != desired.Spec.ExternalTrafficPolicy ||
+		!equality.Semantic.DeepEqual(existing.Spec.LoadBalancerSourceRanges, desired.Spec.LoadBalancerSourceRanges) ||
+		!equality.Semantic.DeepEqual(existing.Spec.Ports, desired.Spec.Ports) {
+
+		existing.Spec.Type = desired.Spec.Type
+		existing.Spec.ExternalTrafficPolicy = desired.Spec.ExternalTrafficPolicy
+		existing.Spec.LoadBalancerSourceRanges = desired.Spec.LoadBalancerSourceRanges
+		existing.Spec.Ports = desired.Spec.Ports
+		changed = true
+	}
+
+	// 删除之前由operator写入、现在spec中已经没有的注解
+	if managed, ok := existing.Annotations[managedAnnotationsKey]; ok {
+		for _, key := range strings.Split(managed, ",") {
+			if _, keep := desired.Annotations[key]; !keep {
+				delete(existing.Annotations, key)
+				changed = true
+			}
+		}
+		if _, keep := desired.Annotations[managedAnnotationsKey]; !keep {
+			delete(existing.Annotations, managedAnnotationsKey)
+		}
+	}
+
+	for key, value := range desired.Annotations {
+		if existing.Annotations[key] == value {
+			continue
+		}
+		if existing.Annotations == nil {
+			existing.Annotations = map[string]string{}
+		}
+		existing.Annotations[key] = value
+		changed = true
+	}
+
+	return changed
+}
+
+// service的选择器
+// 读服务只选择operator判断为可读的pod（复制正常且延迟在阈值以内的从库，必要时包括主库），见reconcileReadEndpoints
+// 统一入口选择ProxySQL的pod
+func serviceSelector(role string, cluster *dbv1.MysqlCluster) map[string]string {
+	if role == "router" {
+		return routerLabels(cluster)
+	}
+
+	selector := map[string]string{
+		"app": cluster.Name,
+	}
+
+	switch role {
+	case "master":
+		selector["role"] = role
+	case "slave":
+		selector[readableLabel] = "true"
+	}
+
+	return selector
 }
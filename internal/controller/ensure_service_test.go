@@ -0,0 +1,104 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("service配置", func() {
+
+	var (
+		cluster    *dbv1.MysqlCluster
+		reconciler *MysqlClusterReconciler
+	)
+
+	BeforeEach(func() {
+		cluster = &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+		reconciler = &MysqlClusterReconciler{}
+	})
+
+	It("不设置时使用ClusterIP和单个3306端口", func() {
+		svc := reconciler.createService("test-cluster-svc-master", "master", cluster)
+
+		Expect(svc.Spec.Type).To(Equal(corev1.ServiceTypeClusterIP))
+		Expect(svc.Spec.Ports).To(HaveLen(1))
+		Expect(svc.Spec.ExternalTrafficPolicy).To(BeEmpty())
+		Expect(svc.Annotations).To(BeEmpty())
+	})
+
+	It("按角色应用类型、注解和额外端口", func() {
+		cluster.Spec.Services = &dbv1.ServicesConfig{Master: &dbv1.ServiceConfig{
+			Type:                     corev1.ServiceTypeLoadBalancer,
+			Annotations:              map[string]string{"lb/internal": "true"},
+			LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+			ExtraPorts:               []corev1.ServicePort{{Name: "admin", Port: 33062}},
+		}}
+
+		svc := reconciler.createService("test-cluster-svc-master", "master", cluster)
+
+		Expect(svc.Spec.Type).To(Equal(corev1.ServiceTypeLoadBalancer))
+		Expect(svc.Spec.ExternalTrafficPolicy).To(Equal(corev1.ServiceExternalTrafficPolicyCluster))
+		Expect(svc.Spec.LoadBalancerSourceRanges).To(ConsistOf("10.0.0.0/8"))
+		Expect(svc.Spec.Ports).To(HaveLen(2))
+		Expect(svc.Spec.Ports[0].Name).To(Equal("mysql"))
+		Expect(svc.Spec.Ports[1].Protocol).To(Equal(corev1.ProtocolTCP))
+		Expect(svc.Spec.Ports[1].TargetPort.IntVal).To(Equal(int32(33062)))
+		Expect(svc.Annotations).To(HaveKeyWithValue("lb/internal", "true"))
+
+		// 读服务没有配置，不受影响
+		Expect(reconciler.createService("test-cluster-svc-slave", "slave", cluster).Spec.Type).To(Equal(corev1.ServiceTypeClusterIP))
+	})
+
+	It("额外端口不能和mysql端口冲突", func() {
+		Expect(validateServiceConfig(&dbv1.ServiceConfig{ExtraPorts: []corev1.ServicePort{{Name: "mysql", Port: 1}}})).NotTo(Succeed())
+		Expect(validateServiceConfig(&dbv1.ServiceConfig{ExtraPorts: []corev1.ServicePort{{Name: "x", Port: 3306}}})).NotTo(Succeed())
+		Expect(validateServiceConfig(&dbv1.ServiceConfig{ExtraPorts: []corev1.ServicePort{{Port: 1}}})).NotTo(Succeed())
+	})
+
+	It("同步时保留已分配的nodePort和不归operator管理的注解", func() {
+		cluster.Spec.Services = &dbv1.ServicesConfig{Master: &dbv1.ServiceConfig{
+			Type:        corev1.ServiceTypeNodePort,
+			Annotations: map[string]string{"a": "1"},
+		}}
+		existing := reconciler.createService("test-cluster-svc-master", "master", cluster)
+		existing.Spec.Ports[0].NodePort = 30306
+		existing.Annotations["cloud/added"] = "x"
+
+		// 没有变化时不需要更新
+		Expect(syncServiceSpec(existing, reconciler.createService("test-cluster-svc-master", "master", cluster))).To(BeFalse())
+
+		// 删除注解a
+		cluster.Spec.Services.Master.Annotations = nil
+		Expect(syncServiceSpec(existing, reconciler.createService("test-cluster-svc-master", "master", cluster))).To(BeTrue())
+		Expect(existing.Annotations).To(Equal(map[string]string{"cloud/added": "x"}))
+		Expect(existing.Spec.Ports[0].NodePort).To(Equal(int32(30306)))
+
+		// 改回ClusterIP时清除nodePort
+		cluster.Spec.Services = nil
+		Expect(syncServiceSpec(existing, reconciler.createService("test-cluster-svc-master", "master", cluster))).To(BeTrue())
+		Expect(existing.Spec.Type).To(Equal(corev1.ServiceTypeClusterIP))
+		Expect(existing.Spec.Ports[0].NodePort).To(BeZero())
+		Expect(existing.Spec.ExternalTrafficPolicy).To(BeEmpty())
+	})
+
+	It("每个pod的service按pod名字选择pod", func() {
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster-statefulset"}}
+		svc := createPodService(cluster, sts, 2, &dbv1.ServiceConfig{Type: corev1.ServiceTypeNodePort})
+
+		Expect(svc.Name).To(Equal("test-cluster-svc-pod-2"))
+		Expect(svc.Spec.Selector).To(HaveKeyWithValue("statefulset.kubernetes.io/pod-name", "test-cluster-statefulset-2"))
+		Expect(svc.Spec.Type).To(Equal(corev1.ServiceTypeNodePort))
+
+		ordinal, ok := podServiceOrdinal(cluster, svc.Name)
+		Expect(ok).To(BeTrue())
+		Expect(ordinal).To(Equal(int32(2)))
+
+		_, ok = podServiceOrdinal(cluster, "test-cluster-svc-master")
+		Expect(ok).To(BeFalse())
+	})
+})
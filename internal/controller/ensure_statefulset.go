@@ -7,7 +7,9 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -19,11 +21,29 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 	logger := log.FromContext(ctx)
 	existingSts := &appsv1.StatefulSet{}
 	err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: statefulSetName}, existingSts)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("4.3获取%s失败:%w", statefulSetName, err)
+	}
+
+	// 先生成期望的statefulSet，podTemplate不合法时直接报错
+	newSts, buildErr := r.createStatefulSet(statefulSetName, configHash, cluster)
+	if buildErr != nil {
+		return nil, fmt.Errorf("4.3生成%s失败:%w", statefulSetName, buildErr)
+	}
 
 	if err == nil {
 		// 定义一个标志位，记录是否发生了变化
 		needsUpdate := false
 
+		// 检查podTemplate，变化时整体替换pod模板，其他字段随之更新
+		currentTemplateHash := existingSts.Spec.Template.Annotations["checksum/pod-template"]
+		desiredTemplateHash := newSts.Spec.Template.Annotations["checksum/pod-template"]
+		if currentTemplateHash != desiredTemplateHash {
+			logger.Info("podTemplate发生变化，重新生成pod模板", "old", currentTemplateHash, "new", desiredTemplateHash)
+			existingSts.Spec.Template = newSts.Spec.Template
+			needsUpdate = true
+		}
+
 		// 检查configMap Hash
 		currentHash := existingSts.Spec.Template.Annotations["checksum/config"]
 		if currentHash != configHash {
@@ -35,6 +55,29 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 			needsUpdate = true
 		}
 
+		// 检查资源限制，自动调优的参数依赖它，必须和pod的实际limits保持一致
+		for i := range existingSts.Spec.Template.Spec.Containers {
+			container := &existingSts.Spec.Template.Spec.Containers[i]
+			if container.Name != "mysql" {
+				continue
+			}
+			if !equality.Semantic.DeepEqual(container.Resources, cluster.Spec.Resources) {
+				logger.Info("资源限制发生变化，更新StatefulSet", "old", container.Resources, "new", cluster.Spec.Resources)
+				container.Resources = cluster.Spec.Resources
+				needsUpdate = true
+			}
+		}
+
+		// 检查调度相关的配置
+		podSpec := &existingSts.Spec.Template.Spec
+		desiredPodSpec := podSpec.DeepCopy()
+		applyScheduling(desiredPodSpec, cluster)
+		if !equality.Semantic.DeepEqual(podSpec, desiredPodSpec) {
+			logger.Info("调度配置发生变化，更新StatefulSet")
+			existingSts.Spec.Template.Spec = *desiredPodSpec
+			needsUpdate = true
+		}
+
 		currentReplicas := *existingSts.Spec.Replicas
 		desiredReplicas := *cluster.Spec.Replicas
 
@@ -42,6 +85,7 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 		if desiredReplicas > currentReplicas {
 
 			logger.Info("触发扩容操作", "current", currentReplicas, "target", desiredReplicas)
+			r.recordNormal(cluster, EventReasonScaledOut, "副本数从%d扩容到%d", currentReplicas, desiredReplicas)
 
 			// 创建一个新的int32变量取地址
 			val := desiredReplicas
@@ -53,6 +97,12 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 			logger.Info("4.3警告：检测到缩容请求，但当前策略禁止自动缩容。忽略该请求。",
 				"desired", desiredReplicas,
 				"current", currentReplicas)
+			// 每次调谐都会走到这里，只在忽略的副本数变化时记录事件，ScalingBlocked condition中保存了上一次的内容
+			message := scaleInIgnoredMessage(currentReplicas, desiredReplicas)
+			condition := meta.FindStatusCondition(cluster.Status.Conditions, ConditionScalingBlocked)
+			if condition == nil || condition.Status != metav1.ConditionTrue || condition.Message != message {
+				r.recordWarning(cluster, EventReasonScaleInIgnored, "%s", message)
+			}
 
 		}
 
@@ -67,12 +117,6 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 		return existingSts, nil
 	}
 
-	if !errors.IsNotFound(err) {
-		return nil, fmt.Errorf("4.3获取%s失败:%w", statefulSetName, err)
-	}
-
-	newSts := r.createStatefulSet(statefulSetName, configHash, cluster)
-
 	//设置OwnerReference
 	if err := controllerutil.SetControllerReference(cluster, newSts, r.Scheme); err != nil {
 		return nil, fmt.Errorf("4.3设置%s的OwnerReference时失败:%w", statefulSetName, err)
@@ -85,7 +129,12 @@ func (r *MysqlClusterReconciler) getOrCreateStatefulSet(ctx context.Context, sta
 	return newSts, nil
 }
 
-func (r *MysqlClusterReconciler) createStatefulSet(statefulSetName, configHash string, cluster *dbv1.MysqlCluster) *appsv1.StatefulSet {
+// 忽略缩容时的事件和ScalingBlocked condition的内容
+func scaleInIgnoredMessage(currentReplicas, desiredReplicas int32) string {
+	return fmt.Sprintf("不支持自动缩容，忽略副本数从%d到%d的修改", currentReplicas, desiredReplicas)
+}
+
+func (r *MysqlClusterReconciler) createStatefulSet(statefulSetName, configHash string, cluster *dbv1.MysqlCluster) (*appsv1.StatefulSet, error) {
 
 	replicas := int32(3) // 默认值
 	if cluster.Spec.Replicas != nil {
@@ -97,8 +146,13 @@ func (r *MysqlClusterReconciler) createStatefulSet(statefulSetName, configHash s
 		"app": cluster.Name,
 	}
 
+	templateHash, err := computePodTemplateHash(cluster)
+	if err != nil {
+		return nil, err
+	}
+
 	// 2. 构建 StatefulSet 对象
-	return &appsv1.StatefulSet{
+	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      statefulSetName,
 			Namespace: cluster.Namespace,
@@ -117,11 +171,15 @@ func (r *MysqlClusterReconciler) createStatefulSet(statefulSetName, configHash s
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
+					// 拷贝一份，用户的podTemplate会往模板标签里追加内容，不能影响selector
+					Labels: map[string]string{
+						"app": cluster.Name,
+					},
 					// 将configMap的Hash注入 Annotation
 
 					Annotations: map[string]string{
-						"checksum/config": configHash,
+						"checksum/config":       configHash,
+						"checksum/pod-template": templateHash,
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -251,4 +309,76 @@ func (r *MysqlClusterReconciler) createStatefulSet(statefulSetName, configHash s
 		},
 	}
 
+	applyScheduling(&sts.Spec.Template.Spec, cluster)
+
+	if cluster.Spec.Heartbeat != nil {
+		sts.Spec.Template.Spec.Containers = append(sts.Spec.Template.Spec.Containers, heartbeatContainer(cluster))
+		sts.Spec.Template.Spec.Volumes = append(sts.Spec.Template.Spec.Volumes, podInfoVolume())
+	}
+	if cluster.Spec.Monitoring != nil {
+		sts.Spec.Template.Spec.Containers = append(sts.Spec.Template.Spec.Containers, mysqldExporterContainer(cluster))
+	}
+
+	if err := applyPodTemplateOverrides(&sts.Spec.Template, cluster); err != nil {
+		return nil, err
+	}
+
+	return sts, nil
+}
+
+// 把spec中的调度配置应用到pod模板，没有设置affinity时使用默认的反亲和
+// 已有的statefulset也会同步，修改调度配置、以及从旧版本升级时加上默认值都会触发滚动重启，见README的升级说明
+func applyScheduling(podSpec *corev1.PodSpec, cluster *dbv1.MysqlCluster) {
+	podSpec.NodeSelector = cluster.Spec.NodeSelector
+	podSpec.Tolerations = cluster.Spec.Tolerations
+	podSpec.PriorityClassName = cluster.Spec.PriorityClassName
+
+	podSpec.TopologySpreadConstraints = cluster.Spec.TopologySpreadConstraints
+	if len(podSpec.TopologySpreadConstraints) == 0 {
+		podSpec.TopologySpreadConstraints = defaultTopologySpreadConstraints(cluster)
+	}
+
+	podSpec.Affinity = cluster.Spec.Affinity
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = defaultAffinity(cluster)
+	}
+}
+
+// 默认的反亲和：同一个集群的pod尽量不在同一个节点上
+// 使用preferred而不是required，节点数量不够时也能调度成功
+func defaultAffinity(cluster *dbv1.MysqlCluster) *corev1.Affinity {
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{
+								"app": cluster.Name,
+							},
+						},
+						TopologyKey: corev1.LabelHostname,
+					},
+				},
+			},
+		},
+	}
+}
+
+// 默认的可用区打散：尽量让每个可用区的pod数量相差不超过1
+// 使用ScheduleAnyway，单可用区或节点没有zone标签的集群也能正常调度
+func defaultTopologySpreadConstraints(cluster *dbv1.MysqlCluster) []corev1.TopologySpreadConstraint {
+	return []corev1.TopologySpreadConstraint{
+		{
+			MaxSkew:           1,
+			TopologyKey:       corev1.LabelTopologyZone,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": cluster.Name,
+				},
+			},
+		},
+	}
 }
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("调度配置", func() {
+
+	var cluster *dbv1.MysqlCluster
+
+	BeforeEach(func() {
+		cluster = &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+	})
+
+	It("没有设置时默认按主机名反亲和、按可用区打散", func() {
+		sts, err := (&MysqlClusterReconciler{}).createStatefulSet("test-cluster-statefulset", "hash", cluster)
+		Expect(err).NotTo(HaveOccurred())
+		podSpec := sts.Spec.Template.Spec
+
+		terms := podSpec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+		Expect(terms).To(HaveLen(1))
+		Expect(terms[0].PodAffinityTerm.TopologyKey).To(Equal(corev1.LabelHostname))
+		Expect(terms[0].PodAffinityTerm.LabelSelector.MatchLabels).To(Equal(map[string]string{"app": "test-cluster"}))
+		Expect(podSpec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution).To(BeEmpty())
+
+		Expect(podSpec.TopologySpreadConstraints).To(HaveLen(1))
+		spread := podSpec.TopologySpreadConstraints[0]
+		Expect(spread.TopologyKey).To(Equal(corev1.LabelTopologyZone))
+		Expect(spread.WhenUnsatisfiable).To(Equal(corev1.ScheduleAnyway))
+		Expect(spread.MaxSkew).To(Equal(int32(1)))
+		Expect(spread.LabelSelector.MatchLabels).To(Equal(map[string]string{"app": "test-cluster"}))
+
+		Expect(podSpec.NodeSelector).To(BeNil())
+		Expect(podSpec.Tolerations).To(BeNil())
+		Expect(podSpec.PriorityClassName).To(BeEmpty())
+	})
+
+	It("用户的配置替换默认值", func() {
+		affinity := &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: "disktype", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd"}},
+						},
+					}},
+				},
+			},
+		}
+		spread := []corev1.TopologySpreadConstraint{{
+			MaxSkew:           2,
+			TopologyKey:       "rack",
+			WhenUnsatisfiable: corev1.DoNotSchedule,
+		}}
+		cluster.Spec.Affinity = affinity
+		cluster.Spec.TopologySpreadConstraints = spread
+		cluster.Spec.NodeSelector = map[string]string{"pool": "db"}
+		cluster.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "db", Effect: corev1.TaintEffectNoSchedule}}
+		cluster.Spec.PriorityClassName = "high-priority"
+
+		sts, err := (&MysqlClusterReconciler{}).createStatefulSet("test-cluster-statefulset", "hash", cluster)
+		Expect(err).NotTo(HaveOccurred())
+		podSpec := sts.Spec.Template.Spec
+
+		// 设置了affinity就不再追加默认的反亲和
+		Expect(podSpec.Affinity).To(Equal(affinity))
+		Expect(podSpec.TopologySpreadConstraints).To(Equal(spread))
+		Expect(podSpec.NodeSelector).To(Equal(map[string]string{"pool": "db"}))
+		Expect(podSpec.Tolerations).To(Equal(cluster.Spec.Tolerations))
+		Expect(podSpec.PriorityClassName).To(Equal("high-priority"))
+	})
+
+	It("修改或删除用户的配置时同步到已有的pod模板", func() {
+		cluster.Spec.NodeSelector = map[string]string{"pool": "db"}
+		cluster.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{MaxSkew: 2, TopologyKey: "rack"}}
+		podSpec := &corev1.PodSpec{}
+		applyScheduling(podSpec, cluster)
+		Expect(podSpec.TopologySpreadConstraints[0].TopologyKey).To(Equal("rack"))
+
+		cluster.Spec.NodeSelector = nil
+		cluster.Spec.TopologySpreadConstraints = nil
+		applyScheduling(podSpec, cluster)
+		Expect(podSpec.NodeSelector).To(BeNil())
+		Expect(podSpec.TopologySpreadConstraints).To(Equal(defaultTopologySpreadConstraints(cluster)))
+		Expect(podSpec.Affinity).To(Equal(defaultAffinity(cluster)))
+	})
+})
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	dbv1 "mysql-operator/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// 事件的reason，告警规则会按reason匹配，已有的值不要修改
+const (
+	EventReasonPhaseChanged          = "PhaseChanged"
+	EventReasonMasterElected         = "MasterElected"
+	EventReasonSplitBrainDetected    = "SplitBrainDetected"
+	EventReasonSwitchoverCompleted   = "SwitchoverCompleted"
+	EventReasonSwitchoverFailed      = "SwitchoverFailed"
+	EventReasonRoleLabelPatched      = "RoleLabelPatched"
+	EventReasonReplicationConfigured = "ReplicationConfigured"
+	EventReasonSecretInvalid         = "SecretInvalid"
+	EventReasonScaledOut             = "ScaledOut"
+	EventReasonScaleInIgnored        = "ScaleInIgnored"
+)
+
+// 事件的来源，kubectl describe中显示为From
+const eventSource = "mysqlcluster-controller"
+
+// 在MysqlCluster上记录一个Normal事件
+func (r *MysqlClusterReconciler) recordNormal(cluster *dbv1.MysqlCluster, reason, messageFmt string, args ...interface{}) {
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// 在MysqlCluster上记录一个Warning事件
+func (r *MysqlClusterReconciler) recordWarning(cluster *dbv1.MysqlCluster, reason, messageFmt string, args ...interface{}) {
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	dbv1 "mysql-operator/api/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// status中最多保留的切换记录数量
+const maxFailoverHistory = 10
+
+// 主库的gtid一直在变，status中记下的值最多这么久更新一次
+// 否则每次调谐都要写status，写status又会触发新的调谐
+const masterObservationInterval = 30 * time.Second
+
+// 最近一次观察到的健康主库，来自status.lastMaster
+type knownMaster struct {
+	Name string
+	GTID string
+}
+
+func lastKnownMaster(cluster *dbv1.MysqlCluster) *knownMaster {
+	observation := cluster.Status.LastMaster
+	if observation == nil {
+		return nil
+	}
+	return &knownMaster{Name: observation.Name, GTID: observation.GTID}
+}
+
+// 记下健康的主库，主库变化时立即更新，否则按masterObservationInterval更新gtid
+func rememberMaster(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot, master *PodInfo) {
+	if master.GTID == "" {
+		return
+	}
+
+	previous := cluster.Status.LastMaster
+	if previous != nil && previous.Name == master.Pod.Name &&
+		(previous.GTID == master.GTID || time.Since(previous.ObservedTime.Time) < masterObservationInterval) {
+		return
+	}
+
+	snapshot.LastMaster = &dbv1.MasterObservation{
+		Name:         master.Pod.Name,
+		GTID:         master.GTID,
+		ObservedTime: metav1.Now(),
+	}
+}
+
+// 生成一条切换记录
+// 旧主库可连接时使用快照中的gtid，否则使用之前记下的gtid，记下的值可能比旧主最终的gtid小，所以丢失的事务数量是一个下限
+func buildFailoverRecord(reason string, oldMasters []*PodInfo, lastKnown *knownMaster, newMaster *PodInfo, start time.Time) *dbv1.FailoverRecord {
+	record := &dbv1.FailoverRecord{
+		Time:                 metav1.Now(),
+		NewMaster:            newMaster.Pod.Name,
+		Reason:               reason,
+		NewMasterGTID:        newMaster.GTID,
+		DurationMilliseconds: time.Since(start).Milliseconds(),
+	}
+
+	var (
+		names     []string
+		oldGTIDs  []string
+		gtidKnown = true
+	)
+	for _, master := range oldMasters {
+		if master == newMaster {
+			continue
+		}
+		names = append(names, master.Pod.Name)
+
+		switch {
+		case master.GTID != "":
+			oldGTIDs = append(oldGTIDs, master.GTID)
+		case lastKnown != nil && lastKnown.Name == master.Pod.Name:
+			oldGTIDs = append(oldGTIDs, lastKnown.GTID)
+		default:
+			gtidKnown = false
+		}
+	}
+
+	// 主库pod被删除重建后没有role标签，只能靠之前记下的主库
+	if len(oldMasters) == 0 && lastKnown != nil && lastKnown.Name != newMaster.Pod.Name {
+		names = append(names, lastKnown.Name)
+		oldGTIDs = append(oldGTIDs, lastKnown.GTID)
+	}
+
+	record.OldMaster = strings.Join(names, ",")
+	if len(oldGTIDs) == 0 || !gtidKnown {
+		return record
+	}
+
+	oldSet := make(gtidSet)
+	for _, gtid := range oldGTIDs {
+		set, err := parseGTIDSet(gtid)
+		if err != nil {
+			return record
+		}
+		oldSet = oldSet.union(set)
+	}
+	record.OldMasterGTID = oldSet.String()
+
+	newSet, err := parseGTIDSet(newMaster.GTID)
+	if err != nil {
+		return record
+	}
+
+	lost := oldSet.subtract(newSet).count()
+	record.LostTransactions = &lost
+	return record
+}
+
+// 追加一条记录，只保留最近的maxFailoverHistory条
+func appendFailoverHistory(history []dbv1.FailoverRecord, record *dbv1.FailoverRecord) []dbv1.FailoverRecord {
+	if record == nil {
+		return history
+	}
+
+	history = append(append([]dbv1.FailoverRecord{}, history...), *record)
+	if len(history) > maxFailoverHistory {
+		history = history[len(history)-maxFailoverHistory:]
+	}
+	return history
+}
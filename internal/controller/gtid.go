@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gtid集合，key为server_uuid，value为按起点排序且互不重叠的区间
+// 用于比较新旧主库的gtid，估算切换时丢失的事务数量
+type gtidSet map[string][]gtidInterval
+
+// 闭区间[Start, End]
+type gtidInterval struct {
+	Start int64
+	End   int64
+}
+
+// 解析@@global.gtid_executed的格式：uuid:1-5:7-9,uuid2:1-3
+// mysql返回的结果在逗号后面会换行，空字符串表示空集合
+func parseGTIDSet(s string) (gtidSet, error) {
+	set := make(gtidSet)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Split(part, ":")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("gtid格式错误: %q", part)
+		}
+		uuid := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		for _, field := range fields[1:] {
+			startStr, endStr, isRange := strings.Cut(field, "-")
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("gtid格式错误: %q", part)
+			}
+			end := start
+			if isRange {
+				if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+					return nil, fmt.Errorf("gtid格式错误: %q", part)
+				}
+			}
+			set[uuid] = append(set[uuid], gtidInterval{Start: start, End: end})
+		}
+		set[uuid] = normalizeIntervals(set[uuid])
+	}
+
+	return set, nil
+}
+
+// 排序并合并重叠或相邻的区间
+func normalizeIntervals(intervals []gtidInterval) []gtidInterval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start < intervals[j].Start })
+
+	var merged []gtidInterval
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && interval.Start <= merged[n-1].End+1 {
+			if interval.End > merged[n-1].End {
+				merged[n-1].End = interval.End
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// 并集
+func (s gtidSet) union(other gtidSet) gtidSet {
+	result := make(gtidSet, len(s))
+	for uuid, intervals := range s {
+		result[uuid] = append([]gtidInterval{}, intervals...)
+	}
+	for uuid, intervals := range other {
+		result[uuid] = normalizeIntervals(append(result[uuid], intervals...))
+	}
+	return result
+}
+
+// 差集：在s中但不在other中的事务
+func (s gtidSet) subtract(other gtidSet) gtidSet {
+	result := make(gtidSet)
+
+	for uuid, intervals := range s {
+		remaining := append([]gtidInterval{}, intervals...)
+
+		for _, cut := range other[uuid] {
+			var next []gtidInterval
+			for _, interval := range remaining {
+				// 不相交，原样保留
+				if cut.End < interval.Start || cut.Start > interval.End {
+					next = append(next, interval)
+					continue
+				}
+				// 相交，保留两侧剩下的部分
+				if interval.Start < cut.Start {
+					next = append(next, gtidInterval{Start: interval.Start, End: cut.Start - 1})
+				}
+				if interval.End > cut.End {
+					next = append(next, gtidInterval{Start: cut.End + 1, End: interval.End})
+				}
+			}
+			remaining = next
+		}
+
+		if len(remaining) > 0 {
+			result[uuid] = remaining
+		}
+	}
+
+	return result
+}
+
+// 事务数量
+func (s gtidSet) count() int64 {
+	var total int64
+	for _, intervals := range s {
+		for _, interval := range intervals {
+			total += interval.End - interval.Start + 1
+		}
+	}
+	return total
+}
+
+// 格式化成mysql的写法，uuid按字典序排列
+func (s gtidSet) String() string {
+	uuids := make([]string, 0, len(s))
+	for uuid := range s {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	parts := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		var b strings.Builder
+		b.WriteString(uuid)
+		for _, interval := range s[uuid] {
+			if interval.Start == interval.End {
+				fmt.Fprintf(&b, ":%d", interval.Start)
+			} else {
+				fmt.Fprintf(&b, ":%d-%d", interval.Start, interval.End)
+			}
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, ",")
+}
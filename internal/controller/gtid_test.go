@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+const (
+	uuidA = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuidB = "4f22fb58-82db-22f2-af44-d91bb0530673"
+)
+
+var _ = Describe("gtid集合", func() {
+
+	It("解析mysql返回的格式并合并区间", func() {
+		set, err := parseGTIDSet(uuidA + ":1-5:6-9:12,\n" + uuidB + ":1-3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(set.String()).To(Equal(uuidA + ":1-9:12," + uuidB + ":1-3"))
+		Expect(set.count()).To(Equal(int64(13)))
+
+		empty, err := parseGTIDSet("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(empty.count()).To(BeZero())
+
+		_, err = parseGTIDSet(uuidA + ":5-1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("计算差集和并集", func() {
+		oldSet, _ := parseGTIDSet(uuidA + ":1-100," + uuidB + ":1-3")
+		newSet, _ := parseGTIDSet(uuidA + ":1-90:95")
+
+		lost := oldSet.subtract(newSet)
+		Expect(lost.String()).To(Equal(uuidA + ":91-94:96-100," + uuidB + ":1-3"))
+		Expect(lost.count()).To(Equal(int64(12)))
+
+		Expect(newSet.subtract(oldSet).count()).To(BeZero())
+		Expect(newSet.union(oldSet).String()).To(Equal(oldSet.String()))
+	})
+})
+
+var _ = Describe("切换记录", func() {
+
+	pod := func(name, gtid string) *PodInfo {
+		return &PodInfo{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}, GTID: gtid}
+	}
+
+	It("旧主库不可连接时用之前记下的gtid估算丢失的事务", func() {
+		oldMaster := pod("test-cluster-0", "")
+		newMaster := pod("test-cluster-1", uuidA+":1-98")
+		lastKnown := &knownMaster{Name: "test-cluster-0", GTID: uuidA + ":1-100"}
+
+		record := buildFailoverRecord("master_unhealthy", []*PodInfo{oldMaster}, lastKnown, newMaster, time.Now())
+		Expect(record.OldMaster).To(Equal("test-cluster-0"))
+		Expect(record.NewMaster).To(Equal("test-cluster-1"))
+		Expect(record.OldMasterGTID).To(Equal(uuidA + ":1-100"))
+		Expect(record.LostTransactions).NotTo(BeNil())
+		Expect(*record.LostTransactions).To(Equal(int64(2)))
+	})
+
+	It("主库pod重建后没有标签时使用记下的主库", func() {
+		record := buildFailoverRecord("no_master", nil, &knownMaster{Name: "test-cluster-0", GTID: uuidA + ":1-10"}, pod("test-cluster-2", uuidA+":1-10"), time.Now())
+		Expect(record.OldMaster).To(Equal("test-cluster-0"))
+		Expect(*record.LostTransactions).To(BeZero())
+	})
+
+	It("主库变化时立即记下，gtid按间隔更新", func() {
+		cluster := &dbv1.MysqlCluster{}
+		snapshot := &ClusterSnapshot{}
+
+		rememberMaster(cluster, snapshot, pod("test-cluster-0", ""))
+		Expect(snapshot.LastMaster).To(BeNil())
+
+		rememberMaster(cluster, snapshot, pod("test-cluster-0", uuidA+":1-10"))
+		Expect(snapshot.LastMaster.GTID).To(Equal(uuidA + ":1-10"))
+		cluster.Status.LastMaster = snapshot.LastMaster
+		Expect(lastKnownMaster(cluster)).To(Equal(&knownMaster{Name: "test-cluster-0", GTID: uuidA + ":1-10"}))
+
+		// 间隔内不更新gtid，避免每次调谐都写status
+		snapshot = &ClusterSnapshot{}
+		rememberMaster(cluster, snapshot, pod("test-cluster-0", uuidA+":1-12"))
+		Expect(snapshot.LastMaster).To(BeNil())
+
+		cluster.Status.LastMaster.ObservedTime = metav1.NewTime(time.Now().Add(-masterObservationInterval))
+		rememberMaster(cluster, snapshot, pod("test-cluster-0", uuidA+":1-12"))
+		Expect(snapshot.LastMaster.GTID).To(Equal(uuidA + ":1-12"))
+
+		snapshot = &ClusterSnapshot{}
+		rememberMaster(cluster, snapshot, pod("test-cluster-1", uuidA+":1-10"))
+		Expect(snapshot.LastMaster.Name).To(Equal("test-cluster-1"))
+	})
+
+	It("不知道旧主库的gtid时不估算", func() {
+		record := buildFailoverRecord("master_unhealthy", []*PodInfo{pod("test-cluster-0", "")}, nil, pod("test-cluster-1", uuidA+":1-10"), time.Now())
+		Expect(record.LostTransactions).To(BeNil())
+	})
+
+	It("只保留最近的记录", func() {
+		var history []dbv1.FailoverRecord
+		for i := 0; i < maxFailoverHistory+3; i++ {
+			history = appendFailoverHistory(history, &dbv1.FailoverRecord{DurationMilliseconds: int64(i)})
+		}
+		Expect(history).To(HaveLen(maxFailoverHistory))
+		Expect(history[0].DurationMilliseconds).To(Equal(int64(3)))
+		Expect(appendFailoverHistory(history, nil)).To(HaveLen(maxFailoverHistory))
+	})
+})
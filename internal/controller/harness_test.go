@@ -0,0 +1,383 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+// 在envtest中运行reconciler的测试工具
+// envtest只有api-server，没有statefulset控制器和kubelet，pod由syncPods按statefulset模拟创建，ready状态由测试控制
+// 数据库使用内存中的FakeMysqlClient，节点以pod名字区分，pod重建后数据依然保留，相当于pvc
+type clusterHarness struct {
+	ctx        context.Context
+	namespace  string
+	name       string
+	mysql      *FakeMysqlClient
+	recorder   *record.FakeRecorder
+	reconciler *MysqlClusterReconciler
+
+	// 按序号分配pod ip，连接真实mysql时替换为本地监听的地址
+	podIP func(ordinal int) string
+
+	// 收到的事件，格式为"类型 原因 内容"
+	events []string
+}
+
+func newClusterHarness(ctx context.Context) *clusterHarness {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "mysqlcluster-"}}
+	Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+	fake := NewFakeMysqlClient()
+	recorder := record.NewFakeRecorder(1000)
+
+	return &clusterHarness{
+		ctx:       ctx,
+		namespace: ns.Name,
+		name:      "test-cluster",
+		mysql:     fake,
+		recorder:  recorder,
+		podIP:     func(ordinal int) string { return fmt.Sprintf("10.0.0.%d", ordinal+10) },
+		reconciler: &MysqlClusterReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: recorder,
+			Mysql:    fake,
+		},
+	}
+}
+
+func (h *clusterHarness) key() types.NamespacedName {
+	return types.NamespacedName{Namespace: h.namespace, Name: h.name}
+}
+
+// 创建secret和集群
+func (h *clusterHarness) createCluster(replicas int32, mutate func(cluster *dbv1.MysqlCluster)) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: h.name + "-secret", Namespace: h.namespace},
+		Data: map[string][]byte{
+			"root-password": []byte("root"),
+			"repl-password": []byte("repl"),
+		},
+	}
+	Expect(k8sClient.Create(h.ctx, secret)).To(Succeed())
+
+	cluster := &dbv1.MysqlCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: h.name, Namespace: h.namespace},
+		Spec: dbv1.MysqlClusterSpec{
+			Image:      "mysql:5.7",
+			Replicas:   ptr.To(replicas),
+			Storage:    dbv1.StorageConfig{Size: resource.MustParse("1Gi")},
+			SecretName: corev1.LocalObjectReference{Name: secret.Name},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			},
+		},
+	}
+	if mutate != nil {
+		mutate(cluster)
+	}
+	Expect(k8sClient.Create(h.ctx, cluster)).To(Succeed())
+}
+
+func (h *clusterHarness) cluster() *dbv1.MysqlCluster {
+	cluster := &dbv1.MysqlCluster{}
+	Expect(k8sClient.Get(h.ctx, h.key(), cluster)).To(Succeed())
+	return cluster
+}
+
+// 修改spec，冲突时重试
+func (h *clusterHarness) updateSpec(mutate func(spec *dbv1.MysqlClusterSpec)) {
+	Eventually(func() error {
+		cluster := h.cluster()
+		mutate(&cluster.Spec)
+		return k8sClient.Update(h.ctx, cluster)
+	}).Should(Succeed())
+}
+
+// 执行一次调谐，并收集期间产生的事件
+func (h *clusterHarness) reconcile() (reconcile.Result, error) {
+	result, err := h.reconciler.Reconcile(h.ctx, reconcile.Request{NamespacedName: h.key()})
+	h.drainEvents()
+	return result, err
+}
+
+// 反复调谐并同步pod，直到集群稳定，最后一次调谐必须成功
+func (h *clusterHarness) settle() {
+	var err error
+	for i := 0; i < 10; i++ {
+		h.syncPods()
+		_, err = h.reconcile()
+	}
+	Expect(err).NotTo(HaveOccurred())
+}
+
+func (h *clusterHarness) drainEvents() {
+	for {
+		select {
+		case event := <-h.recorder.Events:
+			h.events = append(h.events, event)
+		default:
+			return
+		}
+	}
+}
+
+// 是否收到过指定原因的事件
+func (h *clusterHarness) hasEvent(reason string) bool {
+	for _, event := range h.events {
+		if strings.Contains(event, " "+reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// 收到的指定原因的事件数
+func (h *clusterHarness) countEvents(reason string) int {
+	count := 0
+	for _, event := range h.events {
+		if strings.Contains(event, " "+reason+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+func (h *clusterHarness) statefulSet() *appsv1.StatefulSet {
+	sts := &appsv1.StatefulSet{}
+	Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: h.name + "-statefulset"}, sts)).To(Succeed())
+	return sts
+}
+
+func (h *clusterHarness) podName(ordinal int) string {
+	return fmt.Sprintf("%s-statefulset-%d", h.name, ordinal)
+}
+
+// 模拟statefulset控制器：按副本数创建缺少的pod并设置为ready，删除多余的pod
+// 还没有创建statefulset时什么都不做
+func (h *clusterHarness) syncPods() {
+	sts := &appsv1.StatefulSet{}
+	err := k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: h.name + "-statefulset"}, sts)
+	if errors.IsNotFound(err) {
+		return
+	}
+	Expect(err).NotTo(HaveOccurred())
+
+	existing := map[string]*corev1.Pod{}
+	for _, pod := range h.pods() {
+		existing[pod.Name] = pod
+	}
+
+	replicas := int(*sts.Spec.Replicas)
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		if _, ok := existing[h.podName(ordinal)]; ok {
+			continue
+		}
+		h.createPod(sts, ordinal)
+	}
+
+	for name, pod := range existing {
+		ordinal, _ := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+		if ordinal >= replicas {
+			Expect(k8sClient.Delete(h.ctx, pod, client.GracePeriodSeconds(0))).To(Succeed())
+		}
+	}
+}
+
+// 按statefulset的模板创建pod，只保留标签和注解，容器只是为了通过校验
+func (h *clusterHarness) createPod(sts *appsv1.StatefulSet, ordinal int) {
+	labels := map[string]string{appsv1.StatefulSetPodNameLabel: h.podName(ordinal)}
+	for key, value := range sts.Spec.Template.Labels {
+		labels[key] = value
+	}
+	annotations := map[string]string{}
+	for key, value := range sts.Spec.Template.Annotations {
+		annotations[key] = value
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        h.podName(ordinal),
+			Namespace:   h.namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			// 每个pod在单独的节点上，节点对象只在需要时由cordonNode创建，不存在时按没有节点信息处理
+			NodeName:   h.nodeName(ordinal),
+			Containers: []corev1.Container{{Name: "mysql", Image: sts.Spec.Template.Spec.Containers[0].Image}},
+		},
+	}
+	Expect(k8sClient.Create(h.ctx, pod)).To(Succeed())
+
+	h.setPodReady(pod.Name, true)
+}
+
+// 节点是集群级别的资源，名字带上namespace，避免和其他用例冲突
+func (h *clusterHarness) nodeName(ordinal int) string {
+	return fmt.Sprintf("%s-node-%d", h.namespace, ordinal)
+}
+
+// 把pod所在的节点标记为不可调度，相当于kubectl cordon
+func (h *clusterHarness) cordonNode(podName string) {
+	pod := &corev1.Pod{}
+	Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: podName}, pod)).To(Succeed())
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: pod.Spec.NodeName}}
+	err := k8sClient.Get(h.ctx, client.ObjectKeyFromObject(node), node)
+	if errors.IsNotFound(err) {
+		node.Spec.Unschedulable = true
+		Expect(k8sClient.Create(h.ctx, node)).To(Succeed())
+		return
+	}
+	Expect(err).NotTo(HaveOccurred())
+	node.Spec.Unschedulable = true
+	Expect(k8sClient.Update(h.ctx, node)).To(Succeed())
+}
+
+// 设置pod的ready状态
+func (h *clusterHarness) setPodReady(name string, ready bool) {
+	pod := &corev1.Pod{}
+	Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: name}, pod)).To(Succeed())
+
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+
+	ordinal, _ := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.PodIP = h.podIP(ordinal)
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+	Expect(k8sClient.Status().Update(h.ctx, pod)).To(Succeed())
+}
+
+// 模拟deployment控制器创建一个ProxySQL pod，只需要标签和ip，后端由fake记录
+func (h *clusterHarness) createRouterPod(name, ip string) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.namespace,
+			Labels:    routerLabels(h.cluster()),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "proxysql", Image: "proxysql"}},
+		},
+	}
+	Expect(k8sClient.Create(h.ctx, pod)).To(Succeed())
+
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.PodIP = ip
+	Expect(k8sClient.Status().Update(h.ctx, pod)).To(Succeed())
+}
+
+// 模拟滚动更新：删除配置哈希和模板不一致的pod，下一次syncPods时按新模板重建
+// 和真实的statefulset一样，重建后的pod没有role标签
+func (h *clusterHarness) rolloutPods() {
+	sts := h.statefulSet()
+	for _, pod := range h.pods() {
+		if pod.Annotations["checksum/config"] != sts.Spec.Template.Annotations["checksum/config"] {
+			Expect(k8sClient.Delete(h.ctx, pod, client.GracePeriodSeconds(0))).To(Succeed())
+		}
+	}
+	h.syncPods()
+}
+
+// 集群的所有pod，按名字排序
+func (h *clusterHarness) pods() []*corev1.Pod {
+	podList := &corev1.PodList{}
+	Expect(k8sClient.List(h.ctx, podList, client.InNamespace(h.namespace), client.MatchingLabels{"app": h.name})).To(Succeed())
+
+	var pods []*corev1.Pod
+	for i := range podList.Items {
+		pods = append(pods, &podList.Items[i])
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods
+}
+
+// 带role=master标签的pod名字
+func (h *clusterHarness) masters() []string {
+	var masters []string
+	for _, pod := range h.pods() {
+		if pod.Labels["role"] == "master" {
+			masters = append(masters, pod.Name)
+		}
+	}
+	return masters
+}
+
+// 直接修改pod的role标签，用于制造脑裂
+func (h *clusterHarness) setRole(name, role string) {
+	pod := &corev1.Pod{}
+	Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: name}, pod)).To(Succeed())
+
+	patch := client.MergeFrom(pod.DeepCopy())
+	pod.Labels["role"] = role
+	Expect(k8sClient.Patch(h.ctx, pod, patch)).To(Succeed())
+}
+
+// 从库复制的主库地址
+func (h *clusterHarness) masterHost(master string) string {
+	return fmt.Sprintf("%s.%s-svc-headless.%s", master, h.name, h.namespace)
+}
+
+// 断言集群只有一个主库，其余节点都只读并且从它复制，数据一致且没有errant gtid
+func (h *clusterHarness) expectConverged(master string) {
+	Expect(h.masters()).To(Equal([]string{master}))
+
+	masterNode := h.mysql.Node(master)
+	Expect(masterNode.ReadOnly).To(BeFalse())
+	Expect(masterNode.MasterHost).To(BeEmpty())
+
+	for _, pod := range h.pods() {
+		if pod.Name == master {
+			continue
+		}
+		node := h.mysql.Node(pod.Name)
+		Expect(node.ReadOnly).To(BeTrue(), "从库%s应该是只读的", pod.Name)
+		Expect(node.MasterHost).To(Equal(h.masterHost(master)), "从库%s应该复制%s", pod.Name, master)
+		Expect(node.SlaveActive).To(BeTrue())
+		Expect(node.Executed.subtract(masterNode.Executed).count()).To(BeZero(), "从库%s有errant gtid", pod.Name)
+		Expect(node.Executed.String()).To(Equal(masterNode.Executed.String()))
+	}
+
+	cluster := h.cluster()
+	Expect(cluster.Status.CurrentMaster).To(Equal(master))
+}
+
+// status写入总是失败的client，用于模拟更新status时的冲突
+type failingStatusClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingStatusClient) Status() client.SubResourceWriter {
+	return &failingStatusWriter{SubResourceWriter: c.Client.Status(), err: c.err}
+}
+
+type failingStatusWriter struct {
+	client.SubResourceWriter
+	err error
+}
+
+func (w *failingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+	return w.err
+}
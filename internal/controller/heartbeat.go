@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	dbv1 "mysql-operator/api/v1"
+
+	"github.com/go-sql-driver/mysql"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// 类似pt-heartbeat：主库上的sidecar定期把当前时间写入心跳表，写操作记binlog，随复制同步到从库
+// 从库上心跳表里最新的时间戳落后主库多少，就是真实的复制延迟
+// Seconds_Behind_Master在io线程卡住时显示为0，遇到大事务时又会跳变，不够可靠
+const (
+	heartbeatDatabase = "mysql_operator"
+	heartbeatTable    = "heartbeat"
+
+	// 心跳sidecar的容器名
+	heartbeatContainerName = "heartbeat"
+
+	// 通过downward API把pod的标签挂载给心跳sidecar，只有带role=master标签的pod才写入
+	podInfoVolumeName = "podinfo"
+	podInfoMountPath  = "/etc/podinfo"
+)
+
+// 心跳表中的信息
+type HeartbeatInfo struct {
+	// 心跳表中最新的时间戳，由写入时的主库生成
+	Latest time.Time
+	// 节点自己的当前时间与Latest的差，在主库上用于判断心跳是否还在写入
+	Age time.Duration
+}
+
+// 心跳写入间隔，没有设置时为1秒
+func heartbeatInterval(cluster *dbv1.MysqlCluster) time.Duration {
+	if cluster.Spec.Heartbeat == nil || cluster.Spec.Heartbeat.IntervalSeconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(cluster.Spec.Heartbeat.IntervalSeconds) * time.Second
+}
+
+// 生成心跳sidecar，使用集群的mysql镜像，里面自带mysql客户端
+// 在不是主库的节点上写入会产生游离的gtid，影响选主时的gtid比较，所以写入前要同时满足：
+//  1. pod带有role=master标签，即operator选出的主库。标签文件由kubelet定期刷新，切换后最多延迟一分钟左右，这段时间新主上没有心跳，延迟回退到Seconds_Behind_Master
+//  2. read_only=0，my.cnf中默认read_only=on，重启的节点在operator确认之前不会写入
+//  3. 没有配置复制，从库即使被手动关闭了只读也不会写入
+func heartbeatContainer(cluster *dbv1.MysqlCluster) corev1.Container {
+	interval := int64(heartbeatInterval(cluster) / time.Second)
+
+	insert := fmt.Sprintf("INSERT INTO %s.%s (server_id, ts) SELECT @@server_id, NOW(6) FROM DUAL "+
+		"WHERE @@global.read_only = 0 AND NOT EXISTS (SELECT 1 FROM performance_schema.replication_connection_configuration) "+
+		"ON DUPLICATE KEY UPDATE ts = VALUES(ts)", heartbeatDatabase, heartbeatTable)
+
+	return corev1.Container{
+		Name:            heartbeatContainerName,
+		Image:           cluster.Spec.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+
+		// mysqld没启动或心跳表还没建好时写入失败，忽略即可，下一轮再试
+		Command: []string{
+			"/bin/sh",
+			"-c",
+			fmt.Sprintf("while true; do if grep -qx 'role=\"master\"' %s/labels; then mysql -h127.0.0.1 -uroot -e \"%s\" >/dev/null 2>&1; fi; sleep %d; done",
+				podInfoMountPath, insert, interval),
+		},
+
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: podInfoVolumeName, MountPath: podInfoMountPath, ReadOnly: true},
+		},
+
+		// mysql客户端会读取MYSQL_PWD，避免密码出现在进程参数里
+		Env: []corev1.EnvVar{
+			{
+				Name: "MYSQL_PWD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: cluster.Spec.SecretName,
+						Key:                  "root-password",
+					},
+				},
+			},
+		},
+
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+	}
+}
+
+// 心跳sidecar读取的pod标签
+func podInfoVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: podInfoVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+				},
+			},
+		},
+	}
+}
+
+// 在主库上创建心跳库和心跳表，记binlog，从库通过复制得到同样的表
+func ensureHeartbeatTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", heartbeatDatabase)); err != nil {
+		return fmt.Errorf("创建心跳库失败: %w", err)
+	}
+
+	createTable := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s ("+
+		"server_id INT UNSIGNED NOT NULL PRIMARY KEY, "+
+		"ts DATETIME(6) NOT NULL"+
+		") ENGINE=InnoDB", heartbeatDatabase, heartbeatTable)
+	if _, err := db.ExecContext(ctx, createTable); err != nil {
+		return fmt.Errorf("创建心跳表失败: %w", err)
+	}
+
+	return nil
+}
+
+// 查询节点上的心跳表，表不存在或者还没有数据时返回nil
+// 切换主库后旧主库的行仍然保留，取最大的时间戳就是最新的心跳
+func queryHeartbeat(ctx context.Context, db *sql.DB) (*HeartbeatInfo, error) {
+	var (
+		latest sql.NullTime
+		age    sql.NullInt64
+	)
+
+	query := fmt.Sprintf("SELECT MAX(ts), TIMESTAMPDIFF(MICROSECOND, MAX(ts), NOW(6)) FROM %s.%s", heartbeatDatabase, heartbeatTable)
+	if err := db.QueryRowContext(ctx, query).Scan(&latest, &age); err != nil {
+		// 1049：库不存在，1146：表不存在
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1049 || mysqlErr.Number == 1146) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !latest.Valid || !age.Valid {
+		return nil, nil
+	}
+
+	return &HeartbeatInfo{
+		Latest: latest.Time,
+		Age:    time.Duration(age.Int64) * time.Microsecond,
+	}, nil
+}
+
+// 开启心跳时用心跳表计算从库的真实延迟，写入快照中的复制状态
+// 在第7步查询完所有节点后计算，后面的读服务、ProxySQL后端和status都使用这个结果
+func updateHeartbeatLag(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) {
+	if cluster.Spec.Heartbeat == nil {
+		return
+	}
+
+	var master *PodInfo
+	for _, pod := range snapshot.Pods {
+		if pod.IsConnectable && pod.Role == "master" {
+			master = pod
+		}
+	}
+	if master == nil {
+		return
+	}
+
+	interval := heartbeatInterval(cluster)
+	for _, pod := range snapshot.Pods {
+		if pod.Role == "slave" && pod.Replication != nil {
+			pod.Replication.HeartbeatLag = heartbeatLag(master, pod, interval)
+		}
+	}
+}
+
+// 根据心跳表计算从库的复制延迟，无法计算时返回nil，由调用方回退到Seconds_Behind_Master
+// 用主库和从库上最新的时间戳相减，两个时间戳都是主库写入的，不受节点间时钟偏差的影响，精度为一个写入间隔
+// 主库上的心跳已经停止写入时（sidecar异常），差值会被低估，此时不使用心跳
+func heartbeatLag(master, slave *PodInfo, interval time.Duration) *time.Duration {
+	if master.Heartbeat == nil || slave.Heartbeat == nil {
+		return nil
+	}
+
+	// 允许错过两次写入，再加上查询本身的耗时
+	if master.Heartbeat.Age > 3*interval+time.Second {
+		return nil
+	}
+
+	lag := master.Heartbeat.Latest.Sub(slave.Heartbeat.Latest)
+	if lag < 0 {
+		lag = 0
+	}
+	return &lag
+}
@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+// 自定义指标，注册到controller-runtime的registry，和内置指标一起通过manager的metrics端点暴露
+var (
+	failoversTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql_operator_failovers_total",
+			Help: "选主（故障切换或计划内切换）的次数",
+		},
+		[]string{"namespace", "cluster", "reason"},
+	)
+
+	electionDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mysql_operator_election_duration_seconds",
+			Help:    "从决定选主到新的角色标签打完所用的时间",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"namespace", "cluster"},
+	)
+
+	clusterPhase = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_cluster_phase",
+			Help: "集群当前的phase，当前phase为1，其他为0",
+		},
+		[]string{"namespace", "cluster", "phase"},
+	)
+
+	nodeReady = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_node_ready",
+			Help: "pod在k8s层面是否ready",
+		},
+		[]string{"namespace", "cluster", "pod", "role"},
+	)
+
+	nodeConnectable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_node_connectable",
+			Help: "operator能否连接到pod上的数据库",
+		},
+		[]string{"namespace", "cluster", "pod", "role"},
+	)
+
+	reconcileStepDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mysql_operator_reconcile_step_duration_seconds",
+			Help:    "Reconcile中每个步骤的耗时",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"step"},
+	)
+
+	replicationLagSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_replication_lag_seconds",
+			Help: "从库的复制延迟，开启心跳时使用心跳表计算，否则为Seconds_Behind_Master，sql线程没有运行时没有数据",
+		},
+		[]string{"namespace", "cluster", "pod"},
+	)
+
+	replicationIORunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_replication_io_running",
+			Help: "从库的io线程是否在运行",
+		},
+		[]string{"namespace", "cluster", "pod"},
+	)
+
+	replicationSQLRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mysql_operator_replication_sql_running",
+			Help: "从库的sql线程是否在运行",
+		},
+		[]string{"namespace", "cluster", "pod"},
+	)
+
+	dbConnectionErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql_operator_db_connection_errors_total",
+			Help: "连接pod上的数据库失败的次数",
+		},
+		[]string{"namespace", "cluster", "pod"},
+	)
+)
+
+// 所有可能的phase，用于把非当前phase置0，方便用 == 1 过滤
+var allPhases = []dbv1.MysqlClusterPhase{
+	dbv1.MysqlClusterPhaseInitializing,
+	dbv1.MysqlClusterPhasePending,
+	dbv1.MysqlClusterPhaseRunning,
+	dbv1.MysqlClusterPhaseDegraded,
+	dbv1.MysqlClusterPhaseFailed,
+	dbv1.MysqlClusterPhaseTerminating,
+}
+
+func init() {
+	metrics.Registry.MustRegister(
+		failoversTotal,
+		electionDurationSeconds,
+		clusterPhase,
+		nodeReady,
+		nodeConnectable,
+		reconcileStepDurationSeconds,
+		replicationLagSeconds,
+		replicationIORunning,
+		replicationSQLRunning,
+		dbConnectionErrorsTotal,
+	)
+}
+
+// 记录Reconcile中一个步骤的耗时
+func observeReconcileStep(step string, start time.Time) {
+	reconcileStepDurationSeconds.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+// 记录一次数据库连接失败
+func recordConnectionError(pod *PodInfo) {
+	dbConnectionErrorsTotal.WithLabelValues(pod.Pod.Namespace, pod.Pod.Labels["app"], pod.Pod.Name).Inc()
+}
+
+// 根据快照刷新集群和节点的指标
+// 先删掉这个集群的旧数据，避免缩容或pod改名后留下过期的时间序列
+func updateClusterMetrics(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot, phase dbv1.MysqlClusterPhase) {
+	for _, p := range allPhases {
+		value := 0.0
+		if p == phase {
+			value = 1
+		}
+		clusterPhase.WithLabelValues(cluster.Namespace, cluster.Name, string(p)).Set(value)
+	}
+
+	labels := prometheus.Labels{"namespace": cluster.Namespace, "cluster": cluster.Name}
+	nodeReady.DeletePartialMatch(labels)
+	nodeConnectable.DeletePartialMatch(labels)
+	replicationLagSeconds.DeletePartialMatch(labels)
+	replicationIORunning.DeletePartialMatch(labels)
+	replicationSQLRunning.DeletePartialMatch(labels)
+
+	for _, pod := range snapshot.Pods {
+		nodeReady.WithLabelValues(cluster.Namespace, cluster.Name, pod.Pod.Name, pod.Role).Set(boolToFloat(pod.IsReady))
+		nodeConnectable.WithLabelValues(cluster.Namespace, cluster.Name, pod.Pod.Name, pod.Role).Set(boolToFloat(pod.IsConnectable))
+
+		// 只有从库有复制状态
+		if pod.Role != "slave" || pod.Replication == nil {
+			continue
+		}
+		replicationIORunning.WithLabelValues(cluster.Namespace, cluster.Name, pod.Pod.Name).Set(boolToFloat(strings.EqualFold(pod.Replication.IORunning, "Yes")))
+		replicationSQLRunning.WithLabelValues(cluster.Namespace, cluster.Name, pod.Pod.Name).Set(boolToFloat(strings.EqualFold(pod.Replication.SQLRunning, "Yes")))
+		if lag, ok := pod.Replication.Lag(); ok {
+			replicationLagSeconds.WithLabelValues(cluster.Namespace, cluster.Name, pod.Pod.Name).Set(lag.Seconds())
+		}
+	}
+}
+
+// 集群被删除后清理它的指标
+func deleteClusterMetrics(namespace, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "cluster": name}
+	failoversTotal.DeletePartialMatch(labels)
+	electionDurationSeconds.DeletePartialMatch(labels)
+	clusterPhase.DeletePartialMatch(labels)
+	nodeReady.DeletePartialMatch(labels)
+	nodeConnectable.DeletePartialMatch(labels)
+	replicationLagSeconds.DeletePartialMatch(labels)
+	replicationIORunning.DeletePartialMatch(labels)
+	replicationSQLRunning.DeletePartialMatch(labels)
+	dbConnectionErrorsTotal.DeletePartialMatch(labels)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	mebibyte = int64(1 << 20)
+	gibibyte = int64(1 << 30)
+
+	// 估算的单个连接占用的内存，包括sort/join/read等会话级缓冲区
+	perConnectionMemory = 2 * mebibyte
+)
+
+// 根据容器的资源限制计算innodb和连接相关的参数
+// 优先使用limits，没有设置时退回requests，都没有设置时不做调优
+func autoTuneMysqlConfig(resources corev1.ResourceRequirements) map[string]string {
+	config := make(map[string]string)
+
+	memory := resourceValue(resources, corev1.ResourceMemory)
+	if memory <= 0 {
+		return config
+	}
+
+	// 内存越大，留给连接和操作系统的比例越小
+	var bufferPool int64
+	switch {
+	case memory < gibibyte:
+		bufferPool = memory / 2
+	case memory < 4*gibibyte:
+		bufferPool = memory * 6 / 10
+	default:
+		bufferPool = memory * 3 / 4
+	}
+	// 按MiB取整，最少保留mysql5.7的默认值128M
+	bufferPool = max(bufferPool/mebibyte*mebibyte, 128*mebibyte)
+	config["innodb_buffer_pool_size"] = fmt.Sprintf("%dM", bufferPool/mebibyte)
+
+	// 每个实例至少1G才有意义，同时不超过cpu核数
+	instances := int64(1)
+	if bufferPool >= gibibyte {
+		instances = min(bufferPool/gibibyte, 8)
+		if cpu := resourceValue(resources, corev1.ResourceCPU); cpu > 0 {
+			instances = min(instances, cpu)
+		}
+	}
+	config["innodb_buffer_pool_instances"] = fmt.Sprintf("%d", instances)
+
+	// redo日志取buffer pool的四分之一，限制在默认值48M到2G之间
+	logFile := min(max(bufferPool/4/mebibyte, 48), 2048)
+	config["innodb_log_file_size"] = fmt.Sprintf("%dM", logFile)
+
+	// 剩余内存按每个连接的开销估算最大连接数
+	connections := min(max((memory-bufferPool)/perConnectionMemory, 100), 4000)
+	config["max_connections"] = fmt.Sprintf("%d", connections)
+
+	return config
+}
+
+// 读取资源数量，cpu向上取整到核
+func resourceValue(resources corev1.ResourceRequirements, name corev1.ResourceName) int64 {
+	var quantity resource.Quantity
+	var ok bool
+	if quantity, ok = resources.Limits[name]; !ok {
+		if quantity, ok = resources.Requests[name]; !ok {
+			return 0
+		}
+	}
+	return quantity.Value()
+}
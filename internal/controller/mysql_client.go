@@ -0,0 +1,388 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reconciler通过这个接口管理mysql节点，不直接拼dsn和执行sql
+// 默认使用NewMysqlClient连接真实的mysql（按pod复用连接），测试时可以替换为NewFakeMysqlClient，在内存中模拟gtid和复制
+type MysqlClient interface {
+	// 连接pod中的mysql，返回的连接用完后需要Close
+	Connect(ctx context.Context, pod *corev1.Pod, rootPassword string) (MysqlNode, error)
+	// 连接ProxySQL pod的管理接口，返回的连接用完后需要Close
+	ConnectRouter(ctx context.Context, pod *corev1.Pod, adminPassword string) (RouterNode, error)
+}
+
+// 对单个mysql节点的操作，接口保持在单条语句的粒度，判断和编排的逻辑留在reconciler中
+type MysqlNode interface {
+	Close() error
+
+	// @@global.gtid_executed
+	GTIDExecuted(ctx context.Context) (string, error)
+	// SHOW SLAVE STATUS的结果，没有配置过复制时返回nil
+	SlaveStatus(ctx context.Context) (map[string]string, error)
+
+	// SET GLOBAL read_only，关闭时会同时关闭super_read_only
+	SetReadOnly(ctx context.Context, readOnly bool) error
+	// SET GLOBAL super_read_only，开启时会同时开启read_only
+	SetSuperReadOnly(ctx context.Context, superReadOnly bool) error
+
+	StopSlave(ctx context.Context) error
+	ResetSlaveAll(ctx context.Context) error
+	// CHANGE MASTER TO，使用MASTER_AUTO_POSITION
+	ChangeMaster(ctx context.Context, host, user, password string) error
+	StartSlave(ctx context.Context) error
+	// 等待gtid集合执行完毕，超时返回false
+	WaitForGTID(ctx context.Context, gtid string, timeout time.Duration) (bool, error)
+
+	// 创建或更新账号，不记binlog，每个节点各自维护
+	EnsureUser(ctx context.Context, user MysqlUser) error
+	// 删除账号，不记binlog
+	DropUser(ctx context.Context, name string) error
+	FlushPrivileges(ctx context.Context) error
+
+	// SELECT @@GLOBAL.<name>，值为NULL时第二个返回值为false
+	GlobalVariable(ctx context.Context, name string) (string, bool, error)
+	SetGlobalVariable(ctx context.Context, name string, value interface{}) error
+	// SET GLOBAL <name> = DEFAULT
+	ResetGlobalVariable(ctx context.Context, name string) error
+
+	// 心跳表，见heartbeat.go
+	EnsureHeartbeatTable(ctx context.Context) error
+	Heartbeat(ctx context.Context) (*HeartbeatInfo, error)
+}
+
+// 对单个ProxySQL的操作，只涉及后端列表
+type RouterNode interface {
+	Close() error
+
+	// 正在生效的后端列表，即runtime_mysql_servers，按主机组和地址排序
+	Backends(ctx context.Context) ([]routerBackend, error)
+	// 用给定的列表替换mysql_servers，加载到runtime并持久化
+	ReplaceBackends(ctx context.Context, backends []routerBackend) error
+}
+
+// operator维护的数据库账号，host固定为%
+type MysqlUser struct {
+	Name     string
+	Password string
+	// 0表示不限制
+	MaxUserConnections int
+	// 例如"REPLICATION SLAVE ON *.*"
+	Grants []string
+}
+
+// 连接真实mysql时使用的单个节点，由mysqlConnectionPool创建，底层的sql.DB在多次调谐之间复用
+type sqlMysqlNode struct {
+	db *sql.DB
+	// 单条语句的超时时间，WAIT_FOR_EXECUTED_GTID_SET使用调用方传入的时间
+	queryTimeout time.Duration
+	// 归还连接，不会关闭底层的sql.DB
+	release func()
+}
+
+func (n *sqlMysqlNode) Close() error {
+	n.release()
+	return nil
+}
+
+func (n *sqlMysqlNode) exec(ctx context.Context, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	_, err := n.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (n *sqlMysqlNode) GTIDExecuted(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	var gtid string
+	err := n.db.QueryRowContext(ctx, "SELECT @@global.gtid_executed").Scan(&gtid)
+	return gtid, err
+}
+
+func (n *sqlMysqlNode) SlaveStatus(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	return showSlaveStatus(ctx, n.db)
+}
+
+func (n *sqlMysqlNode) SetReadOnly(ctx context.Context, readOnly bool) error {
+	return n.exec(ctx, fmt.Sprintf("SET GLOBAL read_only=%d", boolToInt(readOnly)))
+}
+
+func (n *sqlMysqlNode) SetSuperReadOnly(ctx context.Context, superReadOnly bool) error {
+	return n.exec(ctx, fmt.Sprintf("SET GLOBAL super_read_only=%d", boolToInt(superReadOnly)))
+}
+
+func (n *sqlMysqlNode) StopSlave(ctx context.Context) error {
+	return n.exec(ctx, "STOP SLAVE")
+}
+
+func (n *sqlMysqlNode) ResetSlaveAll(ctx context.Context) error {
+	return n.exec(ctx, "RESET SLAVE ALL")
+}
+
+func (n *sqlMysqlNode) ChangeMaster(ctx context.Context, host, user, password string) error {
+	changeMasterSQL := fmt.Sprintf(`
+		CHANGE MASTER TO
+		MASTER_HOST='%s',
+		MASTER_USER='%s',
+		MASTER_PASSWORD='%s',
+		MASTER_PORT=3306,
+		MASTER_CONNECT_RETRY=10,
+		MASTER_AUTO_POSITION=1;
+	`, host, user, password)
+
+	return n.exec(ctx, changeMasterSQL)
+}
+
+func (n *sqlMysqlNode) StartSlave(ctx context.Context) error {
+	return n.exec(ctx, "START SLAVE")
+}
+
+func (n *sqlMysqlNode) WaitForGTID(ctx context.Context, gtid string, timeout time.Duration) (bool, error) {
+	// 返回0表示追平，1表示超时
+	var result sql.NullInt64
+	err := n.db.QueryRowContext(ctx, "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)", gtid, int(timeout.Seconds())).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Valid && result.Int64 == 0, nil
+}
+
+// 账号相关的语句在同一个连接上执行，保证sql_log_bin=0对它们都生效
+func (n *sqlMysqlNode) withoutBinlog(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	conn, err := n.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 保险操作：关闭二进制日志，避免污染gtid
+	if _, err := conn.ExecContext(ctx, "SET SESSION sql_log_bin = 0"); err != nil {
+		return fmt.Errorf("设置sql_log_bin=0失败: %w", err)
+	}
+
+	// 连接会回到sql.DB的连接池，之后的写入（如建心跳表）也可能用到它，必须恢复sql_log_bin
+	// 恢复失败时返回ErrBadConn让sql.DB丢弃这个连接
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SET SESSION sql_log_bin = 1"); err != nil {
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return fn(conn)
+}
+
+func (n *sqlMysqlNode) EnsureUser(ctx context.Context, user MysqlUser) error {
+	return n.withoutBinlog(ctx, func(conn *sql.Conn) error {
+
+		// 关于sql语句，密码和where，value，set后的值使用?占位符
+		// 其他的标识符用fmt.Sprintf拼接，%需要写成%%来转义
+		limit := ""
+		if user.MaxUserConnections > 0 {
+			limit = fmt.Sprintf(" WITH MAX_USER_CONNECTIONS %d", user.MaxUserConnections)
+		}
+
+		// CREATE USER IF NOT EXISTS 不存在就会创建，存在也不会报错
+		createUserQuery := fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY ?%s", user.Name, limit)
+		if _, err := conn.ExecContext(ctx, createUserQuery, user.Password); err != nil {
+			return fmt.Errorf("创建/检查用户%s失败: %w", user.Name, err)
+		}
+
+		// 无论是新建的还是旧的，都强制刷新一次密码
+		alterUserQuery := fmt.Sprintf("ALTER USER '%s'@'%%' IDENTIFIED BY ?%s", user.Name, limit)
+		if _, err := conn.ExecContext(ctx, alterUserQuery, user.Password); err != nil {
+			return fmt.Errorf("更新用户%s密码失败: %w", user.Name, err)
+		}
+
+		// 授权也是幂等的，多执行几次没关系
+		for _, grant := range user.Grants {
+			grantQuery := fmt.Sprintf("GRANT %s TO '%s'@'%%'", grant, user.Name)
+			if _, err := conn.ExecContext(ctx, grantQuery); err != nil {
+				return fmt.Errorf("授权用户%s失败: %w", user.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (n *sqlMysqlNode) DropUser(ctx context.Context, name string) error {
+	return n.withoutBinlog(ctx, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%'", name))
+		return err
+	})
+}
+
+func (n *sqlMysqlNode) FlushPrivileges(ctx context.Context) error {
+	return n.exec(ctx, "FLUSH PRIVILEGES")
+}
+
+func (n *sqlMysqlNode) GlobalVariable(ctx context.Context, name string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	// 变量名来自白名单，可以直接拼接
+	var value sql.NullString
+	if err := n.db.QueryRowContext(ctx, fmt.Sprintf("SELECT @@GLOBAL.%s", name)).Scan(&value); err != nil {
+		return "", false, err
+	}
+	return value.String, value.Valid, nil
+}
+
+func (n *sqlMysqlNode) SetGlobalVariable(ctx context.Context, name string, value interface{}) error {
+	return n.exec(ctx, fmt.Sprintf("SET GLOBAL %s = ?", name), value)
+}
+
+func (n *sqlMysqlNode) ResetGlobalVariable(ctx context.Context, name string) error {
+	return n.exec(ctx, fmt.Sprintf("SET GLOBAL %s = DEFAULT", name))
+}
+
+func (n *sqlMysqlNode) EnsureHeartbeatTable(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	return ensureHeartbeatTable(ctx, n.db)
+}
+
+func (n *sqlMysqlNode) Heartbeat(ctx context.Context) (*HeartbeatInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	return queryHeartbeat(ctx, n.db)
+}
+
+// 连接ProxySQL管理接口时使用的单个节点，和sqlMysqlNode一样由mysqlConnectionPool创建
+type sqlRouterNode struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+	release      func()
+}
+
+func (n *sqlRouterNode) Close() error {
+	n.release()
+	return nil
+}
+
+func (n *sqlRouterNode) Backends(ctx context.Context) ([]routerBackend, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	rows, err := n.db.QueryContext(ctx, "SELECT hostgroup_id, hostname FROM runtime_mysql_servers")
+	if err != nil {
+		return nil, fmt.Errorf("查询runtime_mysql_servers失败: %w", err)
+	}
+	defer rows.Close()
+
+	var backends []routerBackend
+	for rows.Next() {
+		var backend routerBackend
+		if err := rows.Scan(&backend.Hostgroup, &backend.Hostname); err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortRouterBackends(backends)
+	return backends, nil
+}
+
+func (n *sqlRouterNode) ReplaceBackends(ctx context.Context, backends []routerBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, n.queryTimeout)
+	defer cancel()
+
+	// 管理接口的修改只作用于内存层，LOAD之后才会生效
+	// 使用同一个连接执行，中途失败时runtime层保持旧的配置
+	conn, err := n.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "DELETE FROM mysql_servers"); err != nil {
+		return fmt.Errorf("清空mysql_servers失败: %w", err)
+	}
+
+	for _, backend := range backends {
+		if _, err := conn.ExecContext(ctx, "INSERT INTO mysql_servers (hostgroup_id, hostname, port) VALUES (?, ?, 3306)", backend.Hostgroup, backend.Hostname); err != nil {
+			return fmt.Errorf("写入后端%s失败: %w", backend.Hostname, err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "LOAD MYSQL SERVERS TO RUNTIME"); err != nil {
+		return fmt.Errorf("加载mysql_servers失败: %w", err)
+	}
+
+	// 持久化只是为了ProxySQL自己重启时不丢配置，失败不影响已经生效的配置
+	_, _ = conn.ExecContext(ctx, "SAVE MYSQL SERVERS TO DISK")
+
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 执行SHOW SLAVE STATUS并把结果解析为map，没有配置过复制时返回nil
+func showSlaveStatus(ctx context.Context, db *sql.DB) (map[string]string, error) {
+
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	// 获取列名，以便扫描，因为不同列的顺序可能会变
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建一个 map 来存储列值
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	if err := rows.Scan(scanArgs...); err != nil {
+		return nil, err
+	}
+
+	// 将结果解析为 Map 方便查找
+	statusMap := make(map[string]string)
+	for i, colName := range columns {
+		val := values[i]
+		if b, ok := val.([]byte); ok {
+			statusMap[colName] = string(b)
+		} else {
+			statusMap[colName] = ""
+		}
+	}
+
+	return statusMap, nil
+}
@@ -0,0 +1,462 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// 内存中的mysql，用于测试选主和复制配置
+// 每个pod名字对应一个节点，第一次连接时自动创建；从库在任何一次访问时立刻追平主库，
+// 可以通过PauseReplication模拟延迟，通过SetDown模拟节点不可连接，通过Write模拟业务写入
+// ProxySQL pod同样按名字在第一次连接时创建，通过SetRouterDown模拟管理接口不可连接
+type FakeMysqlClient struct {
+	mu      sync.Mutex
+	nodes   map[string]*FakeMysqlNode
+	routers map[string]*FakeRouterNode
+}
+
+// 单个节点的状态，字段只在持有FakeMysqlClient.mu时读写
+type FakeMysqlNode struct {
+	Name string
+	// 节点的server_uuid，由名字生成，同名节点重建后保持不变
+	UUID     string
+	Executed gtidSet
+
+	Down          bool
+	ReadOnly      bool
+	SuperReadOnly bool
+
+	// 复制配置，MasterHost为空表示没有配置过复制
+	MasterHost  string
+	MasterUser  string
+	SlaveActive bool
+	// 暂停复制，从库不再追主库，线程状态仍显示正常，用于模拟延迟
+	// 此时Seconds_Behind_Master为落后的事务数，即每个事务按1秒计算
+	ReplicationPaused bool
+
+	Users          map[string]MysqlUser
+	Variables      map[string]string
+	HeartbeatTable bool
+}
+
+// 单个ProxySQL的状态，字段只在持有FakeMysqlClient.mu时读写
+type FakeRouterNode struct {
+	Name string
+	Down bool
+	// runtime层的后端列表
+	Backends []routerBackend
+	// 执行LOAD MYSQL SERVERS TO RUNTIME的次数
+	Loads int
+}
+
+func NewFakeMysqlClient() *FakeMysqlClient {
+	return &FakeMysqlClient{nodes: map[string]*FakeMysqlNode{}, routers: map[string]*FakeRouterNode{}}
+}
+
+func (c *FakeMysqlClient) Connect(ctx context.Context, pod *corev1.Pod, rootPassword string) (MysqlNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.nodeLocked(pod.Name)
+	if node.Down {
+		return nil, fmt.Errorf("节点%s无法连接: connection refused", pod.Name)
+	}
+
+	return &fakeMysqlConn{client: c, name: pod.Name}, nil
+}
+
+// 获取节点，不存在时创建一个空的节点
+func (c *FakeMysqlClient) nodeLocked(name string) *FakeMysqlNode {
+	node, ok := c.nodes[name]
+	if !ok {
+		sum := sha256.Sum256([]byte(name))
+		hex := fmt.Sprintf("%x", sum[:16])
+		node = &FakeMysqlNode{
+			Name:      name,
+			UUID:      fmt.Sprintf("%s-%s-%s-%s-%s", hex[0:8], hex[8:12], hex[12:16], hex[16:20], hex[20:32]),
+			Executed:  gtidSet{},
+			Users:     map[string]MysqlUser{},
+			Variables: map[string]string{},
+		}
+		c.nodes[name] = node
+	}
+	return node
+}
+
+// 查看节点的状态，返回的是副本
+func (c *FakeMysqlClient) Node(name string) FakeMysqlNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replicateLocked()
+	node := *c.nodeLocked(name)
+	node.Executed = gtidSet{}.union(node.Executed)
+	node.Users = make(map[string]MysqlUser, len(node.Users))
+	for key, value := range c.nodes[name].Users {
+		node.Users[key] = value
+	}
+	node.Variables = make(map[string]string, len(node.Variables))
+	for key, value := range c.nodes[name].Variables {
+		node.Variables[key] = value
+	}
+	return node
+}
+
+// 模拟节点宕机或恢复
+func (c *FakeMysqlClient) SetDown(name string, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodeLocked(name).Down = down
+}
+
+// 暂停或恢复从库的复制
+func (c *FakeMysqlClient) PauseReplication(name string, paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodeLocked(name).ReplicationPaused = paused
+}
+
+// 模拟在节点上提交n个事务，只读的节点会拒绝写入
+// 对从库使用force可以制造errant gtid
+func (c *FakeMysqlClient) Write(name string, n int, force bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replicateLocked()
+
+	node := c.nodeLocked(name)
+	if node.Down {
+		return fmt.Errorf("节点%s无法连接", name)
+	}
+	if (node.ReadOnly || node.SuperReadOnly) && !force {
+		return fmt.Errorf("节点%s是只读的", name)
+	}
+
+	var next int64 = 1
+	if intervals := node.Executed[node.UUID]; len(intervals) > 0 {
+		next = intervals[len(intervals)-1].End + 1
+	}
+	node.Executed = node.Executed.union(gtidSet{node.UUID: {{Start: next, End: next + int64(n) - 1}}})
+
+	c.replicateLocked()
+	return nil
+}
+
+// 所有正在复制的从库追平各自的主库，级联复制需要多轮
+func (c *FakeMysqlClient) replicateLocked() {
+	for range c.nodes {
+		changed := false
+		for _, node := range c.nodes {
+			master := c.masterOfLocked(node)
+			if master == nil || node.ReplicationPaused {
+				continue
+			}
+			missing := master.Executed.subtract(node.Executed)
+			if missing.count() > 0 {
+				node.Executed = node.Executed.union(missing)
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+}
+
+// 从库正在复制的主库，没有在复制、主库不存在或宕机时返回nil
+func (c *FakeMysqlClient) masterOfLocked(node *FakeMysqlNode) *FakeMysqlNode {
+	if node.Down || !node.SlaveActive || node.MasterHost == "" {
+		return nil
+	}
+	// Master_Host是无头服务下的域名，第一段就是pod名字
+	name, _, _ := strings.Cut(node.MasterHost, ".")
+	master, ok := c.nodes[name]
+	if !ok || master.Down || master == node {
+		return nil
+	}
+	return master
+}
+
+func (c *FakeMysqlClient) ConnectRouter(ctx context.Context, pod *corev1.Pod, adminPassword string) (RouterNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.routerLocked(pod.Name).Down {
+		return nil, fmt.Errorf("ProxySQL节点%s无法连接: connection refused", pod.Name)
+	}
+
+	return &fakeRouterConn{client: c, name: pod.Name}, nil
+}
+
+func (c *FakeMysqlClient) routerLocked(name string) *FakeRouterNode {
+	router, ok := c.routers[name]
+	if !ok {
+		router = &FakeRouterNode{Name: name}
+		c.routers[name] = router
+	}
+	return router
+}
+
+// 查看ProxySQL的状态，返回的是副本
+func (c *FakeMysqlClient) Router(name string) FakeRouterNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	router := *c.routerLocked(name)
+	router.Backends = append([]routerBackend(nil), router.Backends...)
+	return router
+}
+
+// 模拟ProxySQL宕机或恢复
+func (c *FakeMysqlClient) SetRouterDown(name string, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.routerLocked(name).Down = down
+}
+
+// 一次连接，所有操作都通过client的锁访问节点
+type fakeMysqlConn struct {
+	client *FakeMysqlClient
+	name   string
+}
+
+// 在锁内执行操作，执行前先模拟一次复制，节点宕机时返回错误
+func (f *fakeMysqlConn) do(fn func(node *FakeMysqlNode) error) error {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+
+	f.client.replicateLocked()
+
+	node := f.client.nodeLocked(f.name)
+	if node.Down {
+		return fmt.Errorf("节点%s连接已断开", f.name)
+	}
+	return fn(node)
+}
+
+func (f *fakeMysqlConn) Close() error {
+	return nil
+}
+
+func (f *fakeMysqlConn) GTIDExecuted(ctx context.Context) (string, error) {
+	var gtid string
+	err := f.do(func(node *FakeMysqlNode) error {
+		gtid = node.Executed.String()
+		return nil
+	})
+	return gtid, err
+}
+
+func (f *fakeMysqlConn) SlaveStatus(ctx context.Context) (map[string]string, error) {
+	var status map[string]string
+	err := f.do(func(node *FakeMysqlNode) error {
+		if node.MasterHost == "" {
+			return nil
+		}
+
+		status = map[string]string{
+			"Master_Host":           node.MasterHost,
+			"Master_User":           node.MasterUser,
+			"Slave_IO_Running":      "No",
+			"Slave_SQL_Running":     "No",
+			"Seconds_Behind_Master": "",
+			"Last_IO_Error":         "",
+			"Last_SQL_Error":        "",
+		}
+		if !node.SlaveActive {
+			return nil
+		}
+
+		status["Slave_SQL_Running"] = "Yes"
+		if f.client.masterOfLocked(node) == nil {
+			status["Slave_IO_Running"] = "Connecting"
+			status["Last_IO_Error"] = fmt.Sprintf("error connecting to master '%s@%s:3306'", node.MasterUser, node.MasterHost)
+			return nil
+		}
+
+		status["Slave_IO_Running"] = "Yes"
+		missing := f.client.masterOfLocked(node).Executed.subtract(node.Executed)
+		status["Seconds_Behind_Master"] = fmt.Sprint(missing.count())
+		return nil
+	})
+	return status, err
+}
+
+func (f *fakeMysqlConn) SetReadOnly(ctx context.Context, readOnly bool) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.ReadOnly = readOnly
+		if !readOnly {
+			node.SuperReadOnly = false
+		}
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) SetSuperReadOnly(ctx context.Context, superReadOnly bool) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.SuperReadOnly = superReadOnly
+		if superReadOnly {
+			node.ReadOnly = true
+		}
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) StopSlave(ctx context.Context) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.SlaveActive = false
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) ResetSlaveAll(ctx context.Context) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		if node.SlaveActive {
+			return fmt.Errorf("This operation cannot be performed with a running slave; run STOP SLAVE first")
+		}
+		node.MasterHost = ""
+		node.MasterUser = ""
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) ChangeMaster(ctx context.Context, host, user, password string) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		if node.SlaveActive {
+			return fmt.Errorf("This operation cannot be performed with a running slave; run STOP SLAVE first")
+		}
+		node.MasterHost = host
+		node.MasterUser = user
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) StartSlave(ctx context.Context) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		if node.MasterHost == "" {
+			return fmt.Errorf("The server is not configured as slave")
+		}
+		node.SlaveActive = true
+		return nil
+	})
+}
+
+// 复制是同步模拟的，要么已经追平，要么因为暂停或主库宕机永远追不上，不需要真的等待
+func (f *fakeMysqlConn) WaitForGTID(ctx context.Context, gtid string, timeout time.Duration) (bool, error) {
+	want, err := parseGTIDSet(gtid)
+	if err != nil {
+		return false, err
+	}
+
+	var caughtUp bool
+	err = f.do(func(node *FakeMysqlNode) error {
+		caughtUp = want.subtract(node.Executed).count() == 0
+		return nil
+	})
+	return caughtUp, err
+}
+
+func (f *fakeMysqlConn) EnsureUser(ctx context.Context, user MysqlUser) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.Users[user.Name] = user
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) DropUser(ctx context.Context, name string) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		delete(node.Users, name)
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) FlushPrivileges(ctx context.Context) error {
+	return f.do(func(node *FakeMysqlNode) error { return nil })
+}
+
+func (f *fakeMysqlConn) GlobalVariable(ctx context.Context, name string) (string, bool, error) {
+	var (
+		value string
+		valid bool
+	)
+	err := f.do(func(node *FakeMysqlNode) error {
+		value, valid = node.Variables[name]
+		return nil
+	})
+	return value, valid, err
+}
+
+func (f *fakeMysqlConn) SetGlobalVariable(ctx context.Context, name string, value interface{}) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.Variables[name] = fmt.Sprint(value)
+		return nil
+	})
+}
+
+// 内存实现中没有设置过的变量就是默认值
+func (f *fakeMysqlConn) ResetGlobalVariable(ctx context.Context, name string) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		delete(node.Variables, name)
+		return nil
+	})
+}
+
+func (f *fakeMysqlConn) EnsureHeartbeatTable(ctx context.Context) error {
+	return f.do(func(node *FakeMysqlNode) error {
+		node.HeartbeatTable = true
+		return nil
+	})
+}
+
+// 内存实现没有心跳sidecar，延迟按Seconds_Behind_Master计算
+func (f *fakeMysqlConn) Heartbeat(ctx context.Context) (*HeartbeatInfo, error) {
+	return nil, f.do(func(node *FakeMysqlNode) error { return nil })
+}
+
+// 一次ProxySQL管理接口的连接
+type fakeRouterConn struct {
+	client *FakeMysqlClient
+	name   string
+}
+
+func (f *fakeRouterConn) do(fn func(router *FakeRouterNode) error) error {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+
+	router := f.client.routerLocked(f.name)
+	if router.Down {
+		return fmt.Errorf("ProxySQL节点%s连接已断开", f.name)
+	}
+	return fn(router)
+}
+
+func (f *fakeRouterConn) Close() error {
+	return nil
+}
+
+func (f *fakeRouterConn) Backends(ctx context.Context) ([]routerBackend, error) {
+	var backends []routerBackend
+	err := f.do(func(router *FakeRouterNode) error {
+		backends = append(backends, router.Backends...)
+		return nil
+	})
+	sortRouterBackends(backends)
+	return backends, err
+}
+
+func (f *fakeRouterConn) ReplaceBackends(ctx context.Context, backends []routerBackend) error {
+	return f.do(func(router *FakeRouterNode) error {
+		router.Backends = append([]routerBackend(nil), backends...)
+		router.Loads++
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("内存mysql", func() {
+
+	var (
+		ctx        context.Context
+		fake       *FakeMysqlClient
+		reconciler *MysqlClusterReconciler
+		cluster    *dbv1.MysqlCluster
+		pods       []*PodInfo
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		fake = NewFakeMysqlClient()
+		reconciler = &MysqlClusterReconciler{Mysql: fake}
+		cluster = &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+
+		pods = nil
+		for _, name := range []string{"test-cluster-0", "test-cluster-1", "test-cluster-2"} {
+			pods = append(pods, &PodInfo{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}, IsReady: true})
+		}
+	})
+
+	// 0号为主库，其他为从库
+	setup := func() {
+		node, err := fake.Connect(ctx, pods[0].Pod, "root")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciler.configureMaster(ctx, node, pods[0].Pod.Name)).To(Succeed())
+
+		for _, pod := range pods[1:] {
+			node, err := fake.Connect(ctx, pod.Pod, "root")
+			Expect(err).NotTo(HaveOccurred())
+			reconfigured, err := reconciler.configureSlave(ctx, node, pod.Pod.Name, replicationMasterHost(cluster, pods[0].Pod.Name), "repl")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reconfigured).To(BeTrue())
+		}
+	}
+
+	It("从库复制主库的写入，重复配置是幂等的", func() {
+		setup()
+		Expect(fake.Write("test-cluster-0", 5, false)).To(Succeed())
+		Expect(fake.Write("test-cluster-1", 1, false)).NotTo(Succeed())
+
+		master := fake.Node("test-cluster-0")
+		Expect(fake.Node("test-cluster-2").Executed.String()).To(Equal(master.Executed.String()))
+
+		node, _ := fake.Connect(ctx, pods[1].Pod, "root")
+		reconfigured, err := reconciler.configureSlave(ctx, node, pods[1].Pod.Name, replicationMasterHost(cluster, pods[0].Pod.Name), "repl")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconfigured).To(BeFalse())
+
+		gtid, replication, _, err := reconciler.queryPodState(ctx, pods[1], "root", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gtid).To(Equal(master.Executed.String()))
+		Expect(replication.Running()).To(BeTrue())
+	})
+
+	It("暂停复制时显示延迟，主库宕机时io线程断开", func() {
+		setup()
+		fake.PauseReplication("test-cluster-1", true)
+		Expect(fake.Write("test-cluster-0", 3, false)).To(Succeed())
+
+		_, replication, _, err := reconciler.queryPodState(ctx, pods[1], "root", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*replication.SecondsBehindMaster).To(Equal(int64(3)))
+
+		fake.SetDown("test-cluster-0", true)
+		_, _, _, err = reconciler.queryPodState(ctx, pods[0], "root", false)
+		Expect(err).To(HaveOccurred())
+
+		_, replication, _, err = reconciler.queryPodState(ctx, pods[2], "root", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replication.Running()).To(BeFalse())
+		Expect(replication.LastError).NotTo(BeEmpty())
+	})
+
+	It("计划内切换等待新主追平，追不上时恢复旧主的写入", func() {
+		setup()
+		Expect(fake.Write("test-cluster-0", 2, false)).To(Succeed())
+
+		fake.PauseReplication("test-cluster-1", true)
+		Expect(fake.Write("test-cluster-0", 1, false)).To(Succeed())
+		_, err := reconciler.switchoverMaster(ctx, pods[0], pods[1], "root")
+		Expect(err).To(HaveOccurred())
+		Expect(fake.Node("test-cluster-0").ReadOnly).To(BeFalse())
+
+		gtid, err := reconciler.switchoverMaster(ctx, pods[0], pods[2], "root")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gtid).To(Equal(fake.Node("test-cluster-2").Executed.String()))
+		Expect(fake.Node("test-cluster-0").ReadOnly).To(BeTrue())
+		Expect(fake.Node("test-cluster-0").SuperReadOnly).To(BeFalse())
+	})
+
+	It("账号和动态参数", func() {
+		node, err := fake.Connect(ctx, pods[0].Pod, "root")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciler.reconcileUserForPod(ctx, pods[0], "root", "repl", "exporter")).To(Succeed())
+		Expect(fake.Node("test-cluster-0").Users).To(HaveKey(ExporterUser))
+
+		Expect(reconciler.reconcileUserForPod(ctx, pods[0], "root", "repl", "")).To(Succeed())
+		Expect(fake.Node("test-cluster-0").Users).To(HaveKey(ReplUser))
+		Expect(fake.Node("test-cluster-0").Users).NotTo(HaveKey(ExporterUser))
+
+		Expect(reconciler.applyDynamicVariables(ctx, node, "test-cluster-0", map[string]string{"max_connections": "500"})).To(Succeed())
+		Expect(fake.Node("test-cluster-0").Variables).To(HaveKeyWithValue("max_connections", "500"))
+	})
+})
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mysql客户端", func() {
+
+	var (
+		ctx       context.Context
+		connector *sessionConnector
+		node      *sqlMysqlNode
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		connector = &sessionConnector{failures: map[string]error{}}
+
+		// 只保留一个连接，EnsureUser用过的连接一定会被之后的语句复用
+		db := sql.OpenDB(connector)
+		db.SetMaxOpenConns(1)
+		DeferCleanup(db.Close)
+
+		node = &sqlMysqlNode{db: db, queryTimeout: time.Second, release: func() {}}
+	})
+
+	It("账号操作结束后恢复连接的sql_log_bin", func() {
+		Expect(node.EnsureUser(ctx, MysqlUser{Name: "repl", Password: "pwd", Grants: []string{"REPLICATION SLAVE ON *.*"}})).To(Succeed())
+		Expect(node.EnsureHeartbeatTable(ctx)).To(Succeed())
+		Expect(connector.opened()).To(HaveLen(1))
+
+		conn := connector.opened()[0]
+		Expect(conn.logBin).To(Equal("1"))
+		Expect(conn.executed).To(ContainElement(ContainSubstring("CREATE USER IF NOT EXISTS 'repl'")))
+
+		// 执行失败时同样恢复
+		connector.failures["GRANT"] = errors.New("grant failed")
+		Expect(node.EnsureUser(ctx, MysqlUser{Name: "repl", Password: "pwd", Grants: []string{"REPLICATION SLAVE ON *.*"}})).NotTo(Succeed())
+		Expect(connector.opened()).To(HaveLen(1))
+		Expect(conn.logBin).To(Equal("1"))
+	})
+
+	It("恢复sql_log_bin失败时丢弃连接", func() {
+		connector.failures["SET SESSION sql_log_bin = 1"] = errors.New("connection lost")
+		Expect(node.DropUser(ctx, "exporter")).To(Succeed())
+
+		conn := connector.opened()[0]
+		Expect(conn.logBin).To(Equal("0"))
+		Expect(conn.closed).To(BeTrue())
+
+		// 之后的语句使用新的连接
+		delete(connector.failures, "SET SESSION sql_log_bin = 1")
+		Expect(node.FlushPrivileges(ctx)).To(Succeed())
+		Expect(connector.opened()).To(HaveLen(2))
+		Expect(connector.opened()[1].logBin).To(Equal("1"))
+	})
+})
+
+// 在内存中记录会话级sql_log_bin的驱动，只支持不带结果集的语句
+type sessionConnector struct {
+	mu    sync.Mutex
+	conns []*sessionConn
+	// 以key开头的语句返回对应的错误
+	failures map[string]error
+}
+
+func (c *sessionConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn := &sessionConn{connector: c, logBin: "1"}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+func (c *sessionConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *sessionConnector) opened() []*sessionConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*sessionConn(nil), c.conns...)
+}
+
+type sessionConn struct {
+	connector *sessionConnector
+	logBin    string
+	executed  []string
+	closed    bool
+}
+
+func (c *sessionConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	for prefix, err := range c.connector.failures {
+		if strings.HasPrefix(query, prefix) {
+			return nil, err
+		}
+	}
+
+	c.executed = append(c.executed, query)
+	if value, ok := strings.CutPrefix(query, "SET SESSION sql_log_bin = "); ok {
+		c.logBin = value
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *sessionConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("不支持预处理语句")
+}
+
+func (c *sessionConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("不支持事务")
+}
+
+func (c *sessionConn) Close() error {
+	c.closed = true
+	return nil
+}
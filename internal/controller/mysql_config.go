@@ -0,0 +1,370 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+// operator强制写入的主从复制参数，用户不能覆盖
+// 顺序和写法保持与最初的my.cnf一致，保证没有自定义参数时生成的内容不变，避免升级operator时触发滚动重启
+var mandatoryMysqlConfig = []struct {
+	Key   string
+	Value string
+}{
+	{"binlog_format", "row"},
+	{"log-bin", "mysql-bin"},
+	{"gtid-mode", "on"},
+	{"enforce-gtid-consistency", "true"},
+	{"log-slave-updates", "1"},
+	{"relay_log_purge", "0"},
+}
+
+// 除了mandatoryMysqlConfig以外，由operator在运行时管理的变量，同样不允许用户设置
+// server_id由init.sh根据序号生成，read_only由选主结果决定
+var operatorManagedVariables = map[string]bool{
+	"server_id":       true,
+	"read_only":       true,
+	"super_read_only": true,
+}
+
+// 已知的mysqld变量，value表示该变量是否可以在运行时通过SET GLOBAL动态修改
+// 只收录常用的变量，不在列表里的一律拒绝，防止拼写错误导致mysqld起不来
+var knownMysqlVariables = map[string]bool{
+	// 连接相关
+	"max_connections":      true,
+	"max_connect_errors":   true,
+	"max_user_connections": true,
+	"wait_timeout":         true,
+	"interactive_timeout":  true,
+	"connect_timeout":      true,
+	"net_read_timeout":     true,
+	"net_write_timeout":    true,
+	"max_allowed_packet":   true,
+	"thread_cache_size":    true,
+	"back_log":             false,
+	"skip_name_resolve":    false,
+	"thread_stack":         false,
+	"open_files_limit":     false,
+	"init_connect":         true,
+	"lock_wait_timeout":    true,
+
+	// 日志相关
+	"slow_query_log":                true,
+	"slow_query_log_file":           true,
+	"long_query_time":               true,
+	"log_queries_not_using_indexes": true,
+	"log_output":                    true,
+	"general_log":                   true,
+	"general_log_file":              true,
+	"log_error_verbosity":           true,
+	"log_timestamps":                true,
+
+	// 缓存和缓冲区
+	"table_open_cache":           true,
+	"table_definition_cache":     true,
+	"tmp_table_size":             true,
+	"max_heap_table_size":        true,
+	"sort_buffer_size":           true,
+	"join_buffer_size":           true,
+	"read_buffer_size":           true,
+	"read_rnd_buffer_size":       true,
+	"bulk_insert_buffer_size":    true,
+	"key_buffer_size":            true,
+	"query_cache_type":           true,
+	"query_cache_size":           true,
+	"max_prepared_stmt_count":    true,
+	"group_concat_max_len":       true,
+	"table_open_cache_instances": false,
+
+	// innodb
+	"innodb_buffer_pool_size":        true,
+	"innodb_buffer_pool_instances":   false,
+	"innodb_log_file_size":           false,
+	"innodb_log_files_in_group":      false,
+	"innodb_log_buffer_size":         false,
+	"innodb_flush_log_at_trx_commit": true,
+	"innodb_flush_method":            false,
+	"innodb_flush_neighbors":         true,
+	"innodb_file_per_table":          true,
+	"innodb_io_capacity":             true,
+	"innodb_io_capacity_max":         true,
+	"innodb_read_io_threads":         false,
+	"innodb_write_io_threads":        false,
+	"innodb_purge_threads":           false,
+	"innodb_thread_concurrency":      true,
+	"innodb_lock_wait_timeout":       true,
+	"innodb_print_all_deadlocks":     true,
+	"innodb_max_dirty_pages_pct":     true,
+	"innodb_adaptive_hash_index":     true,
+	"innodb_stats_on_metadata":       true,
+	"innodb_strict_mode":             true,
+	"innodb_old_blocks_time":         true,
+	"innodb_open_files":              false,
+	"innodb_doublewrite":             false,
+	"innodb_autoinc_lock_mode":       false,
+	"innodb_page_size":               false,
+	"innodb_data_file_path":          false,
+
+	// binlog和复制
+	"sync_binlog":                 true,
+	"binlog_cache_size":           true,
+	"binlog_row_image":            true,
+	"max_binlog_size":             true,
+	"expire_logs_days":            true,
+	"slave_net_timeout":           true,
+	"slave_parallel_workers":      true,
+	"slave_parallel_type":         true,
+	"slave_preserve_commit_order": true,
+	"relay_log_recovery":          false,
+	"slave_skip_errors":           false,
+
+	// 字符集、时区、sql行为
+	"character_set_server":            false,
+	"collation_server":                false,
+	"default_time_zone":               false,
+	"time_zone":                       true,
+	"sql_mode":                        true,
+	"transaction_isolation":           true,
+	"autocommit":                      true,
+	"event_scheduler":                 true,
+	"explicit_defaults_for_timestamp": false,
+	"lower_case_table_names":          false,
+	"performance_schema":              false,
+	"default_authentication_plugin":   false,
+}
+
+// SET GLOBAL的变量名和mysqld启动参数名不一致的变量，写入my.cnf时使用启动参数名
+// 例如my.cnf中写time_zone=会导致mysqld启动失败（unknown variable），需要写成default-time-zone
+var mysqlStartupOptions = map[string]string{
+	"time_zone": "default-time-zone",
+}
+
+// my.cnf中的名字对应的变量名，启动参数名和变量名不一致时通过mysqlStartupOptions反查
+func mysqlVariableForOption(option string) string {
+	option = strings.TrimSpace(option)
+	for variable, startupOption := range mysqlStartupOptions {
+		if option == startupOption {
+			return variable
+		}
+	}
+	return normalizeMysqlVariable(option)
+}
+
+// 变量名规范化：mysqld里-和_等价，统一成小写下划线形式
+func normalizeMysqlVariable(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "-", "_"))
+}
+
+// 判断是否是operator保留的变量
+func isReservedMysqlVariable(name string) bool {
+	for _, item := range mandatoryMysqlConfig {
+		if normalizeMysqlVariable(item.Key) == name {
+			return true
+		}
+	}
+	return operatorManagedVariables[name]
+}
+
+// 校验用户的自定义参数，并返回规范化后的结果
+func validateMysqlConfig(config map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(config))
+
+	for key, value := range config {
+		name := normalizeMysqlVariable(key)
+
+		if isReservedMysqlVariable(name) {
+			return nil, fmt.Errorf("mysqlConfig中的'%s'由operator管理，不允许覆盖", key)
+		}
+		if _, ok := knownMysqlVariables[name]; !ok {
+			return nil, fmt.Errorf("mysqlConfig中的'%s'不是已知的mysqld变量", key)
+		}
+
+		// 值会原样写入my.cnf，禁止换行，防止注入额外的配置
+		value = strings.TrimSpace(value)
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("mysqlConfig中'%s'的值不合法: %q", key, value)
+		}
+
+		// max-connections和max_connections同时出现时无法判断以哪个为准
+		if _, dup := normalized[name]; dup {
+			return nil, fmt.Errorf("mysqlConfig中的'%s'重复设置", key)
+		}
+		normalized[name] = value
+	}
+
+	// time_zone和default_time_zone在my.cnf中是同一个启动参数
+	for variable, startupOption := range mysqlStartupOptions {
+		_, setVariable := normalized[variable]
+		_, setOption := normalized[normalizeMysqlVariable(startupOption)]
+		if setVariable && setOption {
+			return nil, fmt.Errorf("mysqlConfig中的'%s'和'%s'不能同时设置", variable, startupOption)
+		}
+	}
+
+	return normalized, nil
+}
+
+// 生成my.cnf，强制参数在前，用户参数按变量名排序追加在后，保证内容稳定，哈希不会抖动
+func renderMyCnf(userConfig map[string]string) string {
+	var b strings.Builder
+
+	b.WriteString("[mysqld]\n\n")
+	for _, item := range mandatoryMysqlConfig {
+		fmt.Fprintf(&b, "%s=%s\n", item.Key, item.Value)
+	}
+	b.WriteString("# other configurations")
+
+	keys := make([]string, 0, len(userConfig))
+	for key := range userConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		option := key
+		if startupOption, ok := mysqlStartupOptions[key]; ok {
+			option = startupOption
+		}
+		fmt.Fprintf(&b, "\n%s=%s", option, userConfig[key])
+	}
+
+	return b.String()
+}
+
+// 从自定义参数中挑出可以动态生效的变量
+func dynamicMysqlConfig(userConfig map[string]string) map[string]string {
+	dynamic := make(map[string]string)
+	for name, value := range userConfig {
+		if knownMysqlVariables[name] {
+			dynamic[name] = value
+		}
+	}
+	return dynamic
+}
+
+// 之前在线修改过、现在已经不在动态参数里的变量，需要恢复成my.cnf中的值（如自动调优的结果）
+// my.cnf中也没有时值为空，恢复成mysqld的默认值
+func revertedMysqlVariables(applied []string, config, dynamic map[string]string) map[string]string {
+	reverted := make(map[string]string)
+	for _, name := range applied {
+		if _, ok := dynamic[name]; ok {
+			continue
+		}
+		reverted[name] = config[name]
+	}
+	return reverted
+}
+
+// 在线修改过的变量名，排序后写入status，内容稳定才不会每次都更新status
+func appliedMysqlVariables(variableMaps ...map[string]string) []string {
+	var names []string
+	for _, variables := range variableMaps {
+		for name := range variables {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 去掉my.cnf中可以动态生效的变量，只保留需要重启才能生效的部分，用于计算checksum/config
+// 这样只修改动态变量时哈希不变，不会触发滚动重启，由operator通过SET GLOBAL在线生效
+func staticMyCnf(myCnf string) string {
+	lines := strings.Split(myCnf, "\n")
+	kept := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		key, _, found := strings.Cut(line, "=")
+		if found && knownMysqlVariables[mysqlVariableForOption(key)] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// 将my.cnf风格的值转换成SET GLOBAL能接受的形式
+// 整数和带K/M/G后缀的容量转换成数字，ON/OFF等布尔值和其他字符串保持原样，由调用方作为参数传入
+func mysqlVariableValue(value string) interface{} {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+
+	multipliers := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+	if len(value) > 1 {
+		unit := strings.ToUpper(value[len(value)-1:])
+		if m, ok := multipliers[unit]; ok {
+			if n, err := strconv.ParseInt(value[:len(value)-1], 10, 64); err == nil {
+				return n * m
+			}
+		}
+	}
+
+	return value
+}
+
+// 比较数据库中的当前值和期望值是否一致
+// SELECT @@GLOBAL返回的布尔值是0/1，浮点数带小数位，需要统一后再比较
+func mysqlVariableEqual(current, desired string) bool {
+	normalize := func(v string) string {
+		switch strings.ToUpper(v) {
+		case "ON", "TRUE":
+			return "1"
+		case "OFF", "FALSE":
+			return "0"
+		}
+		return v
+	}
+
+	current, desired = normalize(current), normalize(desired)
+	if strings.EqualFold(current, desired) {
+		return true
+	}
+
+	want := mysqlVariableValue(desired)
+	switch w := want.(type) {
+	case int64:
+		got, err := strconv.ParseFloat(current, 64)
+		return err == nil && got == float64(w)
+	case float64:
+		got, err := strconv.ParseFloat(current, 64)
+		return err == nil && got == w
+	}
+	return false
+}
+
+// 计算最终写入my.cnf的自定义参数，以及需要在线生效的动态参数
+// 优先级：强制参数 > 用户参数 > 自动调优
+// 自动调优的结果依赖容器的资源限制，只能随pod重启生效，在线调大buffer pool可能在新的limits生效前就OOM
+func desiredMysqlConfig(cluster *dbv1.MysqlCluster) (map[string]string, map[string]string, error) {
+	userConfig, err := validateMysqlConfig(cluster.Spec.MysqlConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := make(map[string]string, len(userConfig))
+	if cluster.Spec.AutoTune {
+		for name, value := range autoTuneMysqlConfig(cluster.Spec.Resources) {
+			config[name] = value
+		}
+	}
+	for name, value := range userConfig {
+		config[name] = value
+	}
+
+	// 开启心跳时节点启动时只读，重启的旧主库要等operator确认是主库后才打开写入，sidecar不会在它上面写出游离的gtid
+	// 不设置super_read_only，operator在从库上维护账号时（root，不记binlog）需要写入权限
+	if cluster.Spec.Heartbeat != nil {
+		config["read_only"] = "on"
+	}
+
+	return config, dynamicMysqlConfig(userConfig), nil
+}
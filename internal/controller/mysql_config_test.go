@@ -0,0 +1,176 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("mysqld配置生成", func() {
+
+	It("没有自定义参数时生成的my.cnf与旧版本一致", func() {
+		Expect(renderMyCnf(nil)).To(Equal(`[mysqld]
+
+binlog_format=row
+log-bin=mysql-bin
+gtid-mode=on
+enforce-gtid-consistency=true
+log-slave-updates=1
+relay_log_purge=0
+# other configurations`))
+	})
+
+	It("规范化变量名并按名字排序追加", func() {
+		config, err := validateMysqlConfig(map[string]string{
+			"max-connections": "500",
+			"Long_Query_Time": " 2 ",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(map[string]string{
+			"max_connections": "500",
+			"long_query_time": "2",
+		}))
+		Expect(renderMyCnf(config)).To(HaveSuffix("# other configurations\nlong_query_time=2\nmax_connections=500"))
+	})
+
+	It("拒绝覆盖复制相关的强制参数", func() {
+		_, err := validateMysqlConfig(map[string]string{"gtid_mode": "off"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = validateMysqlConfig(map[string]string{"server-id": "1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("拒绝未知变量、换行和重复设置", func() {
+		_, err := validateMysqlConfig(map[string]string{"max_conections": "500"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = validateMysqlConfig(map[string]string{"sql_mode": "STRICT_TRANS_TABLES\nskip-grant-tables"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = validateMysqlConfig(map[string]string{"max_connections": "500", "max-connections": "600"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("动态参数", func() {
+
+	It("计算哈希时忽略动态变量", func() {
+		config := map[string]string{
+			"max_connections":      "500",
+			"innodb_log_file_size": "256M",
+		}
+		Expect(dynamicMysqlConfig(config)).To(Equal(map[string]string{"max_connections": "500"}))
+
+		static := staticMyCnf(renderMyCnf(config))
+		Expect(static).To(ContainSubstring("innodb_log_file_size=256M"))
+		Expect(static).NotTo(ContainSubstring("max_connections"))
+		Expect(static).To(ContainSubstring("gtid-mode=on"))
+
+		// 只改动态变量时，去掉动态变量后的内容不变
+		config["max_connections"] = "800"
+		Expect(staticMyCnf(renderMyCnf(config))).To(Equal(static))
+	})
+
+	It("time_zone在my.cnf中写成default-time-zone，只修改它不触发重启", func() {
+		config, err := validateMysqlConfig(map[string]string{"time-zone": "+08:00"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dynamicMysqlConfig(config)).To(Equal(map[string]string{"time_zone": "+08:00"}))
+
+		myCnf := renderMyCnf(config)
+		Expect(myCnf).To(HaveSuffix("\ndefault-time-zone=+08:00"))
+		Expect(myCnf).NotTo(ContainSubstring("\ntime_zone="))
+
+		static := staticMyCnf(myCnf)
+		Expect(static).NotTo(ContainSubstring("time-zone"))
+		Expect(staticMyCnf(renderMyCnf(map[string]string{"time_zone": "+00:00"}))).To(Equal(static))
+
+		// 直接设置default_time_zone是静态参数，需要重启
+		Expect(staticMyCnf(renderMyCnf(map[string]string{"default_time_zone": "+08:00"}))).To(ContainSubstring("default_time_zone=+08:00"))
+
+		_, err = validateMysqlConfig(map[string]string{"time_zone": "+08:00", "default-time-zone": "+00:00"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("把my.cnf风格的值转换成SET GLOBAL的参数", func() {
+		Expect(mysqlVariableValue("500")).To(Equal(int64(500)))
+		Expect(mysqlVariableValue("0.5")).To(Equal(0.5))
+		Expect(mysqlVariableValue("64M")).To(Equal(int64(64 << 20)))
+		Expect(mysqlVariableValue("1g")).To(Equal(int64(1 << 30)))
+		Expect(mysqlVariableValue("ON")).To(Equal("ON"))
+	})
+
+	It("比较数据库返回值和期望值", func() {
+		Expect(mysqlVariableEqual("1", "ON")).To(BeTrue())
+		Expect(mysqlVariableEqual("0", "off")).To(BeTrue())
+		Expect(mysqlVariableEqual("2.000000", "2")).To(BeTrue())
+		Expect(mysqlVariableEqual("67108864", "64M")).To(BeTrue())
+		Expect(mysqlVariableEqual("151", "500")).To(BeFalse())
+	})
+})
+
+var _ = Describe("自动调优", func() {
+
+	It("根据内存和cpu限制计算参数", func() {
+		config := autoTuneMysqlConfig(corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+			},
+		})
+		Expect(config).To(Equal(map[string]string{
+			"innodb_buffer_pool_size":      "256M",
+			"innodb_buffer_pool_instances": "1",
+			"innodb_log_file_size":         "64M",
+			"max_connections":              "128",
+		}))
+
+		config = autoTuneMysqlConfig(corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("8Gi"),
+				corev1.ResourceCPU:    resource.MustParse("4"),
+			},
+		})
+		Expect(config["innodb_buffer_pool_size"]).To(Equal("6144M"))
+		Expect(config["innodb_buffer_pool_instances"]).To(Equal("4"))
+		Expect(config["innodb_log_file_size"]).To(Equal("1536M"))
+		Expect(config["max_connections"]).To(Equal("1024"))
+	})
+
+	It("没有内存限制时不调优", func() {
+		Expect(autoTuneMysqlConfig(corev1.ResourceRequirements{})).To(BeEmpty())
+	})
+
+	It("用户参数优先，自动调优的参数不在线生效", func() {
+		cluster := &dbv1.MysqlCluster{
+			Spec: dbv1.MysqlClusterSpec{
+				AutoTune:    true,
+				MysqlConfig: map[string]string{"max-connections": "300"},
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+				},
+			},
+		}
+
+		config, dynamic, err := desiredMysqlConfig(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config["max_connections"]).To(Equal("300"))
+		Expect(config["innodb_buffer_pool_size"]).To(Equal("256M"))
+		Expect(dynamic).To(Equal(map[string]string{"max_connections": "300"}))
+	})
+
+	It("只有开启心跳时节点启动时只读", func() {
+		cluster := &dbv1.MysqlCluster{}
+		config, _, err := desiredMysqlConfig(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).NotTo(HaveKey("read_only"))
+
+		cluster.Spec.Heartbeat = &dbv1.HeartbeatConfig{}
+		config, _, err = desiredMysqlConfig(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(staticMyCnf(renderMyCnf(config))).To(HaveSuffix("\nread_only=on"))
+	})
+})
@@ -0,0 +1,407 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// 用本地启动的mysqld验证operator真正发出的sql
+// 每个pod对应一个mysqld进程，分别监听127.0.10.x:3306（linux上整个127/8都是本机地址），reconciler使用真实的连接池
+// 找不到mysqld时跳过，可以通过MYSQLD环境变量指定路径，只运行这些用例：make test-mysql
+var _ = Describe("本地mysql", Label("mysql"), func() {
+
+	var (
+		h      *clusterHarness
+		nodes  []*localMysqld
+		writer *ackedWriter
+	)
+
+	BeforeEach(func() {
+		if runtime.GOOS != "linux" {
+			Skip("需要linux的127/8回环地址")
+		}
+		bin := os.Getenv("MYSQLD")
+		if bin == "" {
+			bin, _ = exec.LookPath("mysqld")
+		}
+		if bin == "" {
+			Skip("没有找到mysqld，设置MYSQLD环境变量或者把mysqld加入PATH")
+		}
+
+		h = newClusterHarness(context.Background())
+		h.podIP = func(ordinal int) string { return fmt.Sprintf("127.0.10.%d", ordinal+1) }
+
+		dir, err := os.MkdirTemp("", "mysql-e2e-")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		// 并发初始化数据目录，每个大约需要几秒
+		nodes = nil
+		hosts := map[string]string{}
+		for i := 0; i < 3; i++ {
+			node := &localMysqld{
+				bin:      bin,
+				dir:      filepath.Join(dir, fmt.Sprint(i)),
+				ip:       h.podIP(i),
+				serverID: i + 1,
+			}
+			nodes = append(nodes, node)
+			hosts[h.masterHost(h.podName(i))] = node.ip
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(nodes))
+		for i, node := range nodes {
+			wg.Add(1)
+			go func(i int, node *localMysqld) {
+				defer wg.Done()
+				errs[i] = node.initialize()
+			}(i, node)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		for _, node := range nodes {
+			node.start()
+			DeferCleanup(node.kill)
+		}
+
+		h.reconciler.Mysql = &loopbackMysqlClient{
+			MysqlClient: NewMysqlClient(MysqlClientOptions{HealthCheckInterval: time.Millisecond}),
+			hosts:       hosts,
+		}
+		writer = &ackedWriter{}
+	})
+
+	It("建立复制，主库宕机后提升数据最新的从库，确认过的写入不丢失", func() {
+		h.createCluster(3, nil)
+		h.settle()
+		Expect(h.masters()).To(Equal([]string{h.podName(0)}))
+
+		By("从库复制主库")
+		for _, node := range nodes[1:] {
+			status := node.slaveStatus()
+			Expect(status["Master_Host"]).To(Equal(nodes[0].ip))
+			Expect(status["Slave_IO_Running"]).To(Equal("Yes"), status["Last_IO_Error"])
+			Expect(status["Slave_SQL_Running"]).To(Equal("Yes"), status["Last_SQL_Error"])
+			Expect(status["Auto_Position"]).To(Equal("1"))
+			// 从库只开启read_only，super_read_only会挡住operator不记binlog地维护账号
+			Expect(node.variable("read_only")).To(Equal("1"))
+		}
+		Expect(nodes[0].variable("read_only")).To(Equal("0"))
+
+		By("写入数据，1号停止复制后继续写入，2号保持最新")
+		writer.prepare(nodes[0])
+		Expect(writer.write(nodes[0], 10)).To(Equal(10))
+		nodes[1].waitFor(nodes[0].gtidExecuted())
+
+		nodes[1].exec("STOP SLAVE")
+		Expect(writer.write(nodes[0], 10)).To(Equal(10))
+		nodes[2].waitFor(nodes[0].gtidExecuted())
+
+		By("杀掉主库")
+		nodes[0].kill()
+		h.setPodReady(h.podName(0), false)
+		Expect(writer.write(nodes[0], 1)).To(BeZero())
+
+		for i := 0; i < 5; i++ {
+			_, _ = h.reconcile()
+		}
+		Expect(h.masters()).To(Equal([]string{h.podName(2)}))
+		Expect(nodes[2].variable("read_only")).To(Equal("0"))
+
+		By("新主可写，1号改为复制新主并追平")
+		Expect(writer.write(nodes[2], 5)).To(Equal(5))
+		h.settle()
+		status := nodes[1].slaveStatus()
+		Expect(status["Master_Host"]).To(Equal(nodes[2].ip))
+		nodes[1].waitFor(nodes[2].gtidExecuted())
+		writer.expectNoLoss(nodes[2])
+		writer.expectNoLoss(nodes[1])
+
+		By("旧主恢复后作为从库加入，没有errant gtid")
+		nodes[0].start()
+		h.setPodReady(h.podName(0), true)
+		h.settle()
+		Expect(h.masters()).To(Equal([]string{h.podName(2)}))
+		Expect(nodes[0].slaveStatus()["Master_Host"]).To(Equal(nodes[2].ip))
+		nodes[0].waitFor(nodes[2].gtidExecuted())
+		Expect(nodes[0].gtidSubset(nodes[2].gtidExecuted())).To(BeTrue())
+		writer.expectNoLoss(nodes[0])
+	})
+})
+
+// 一个本地的mysqld进程
+type localMysqld struct {
+	bin      string
+	dir      string
+	ip       string
+	serverID int
+
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func (m *localMysqld) socket() string {
+	return filepath.Join(m.dir, "mysql.sock")
+}
+
+// 公共参数，--no-defaults必须是第一个
+func (m *localMysqld) baseArgs() []string {
+	args := []string{
+		"--no-defaults",
+		"--datadir=" + filepath.Join(m.dir, "data"),
+		"--log-error=" + filepath.Join(m.dir, "error.log"),
+	}
+	if os.Geteuid() == 0 {
+		args = append(args, "--user=root")
+	}
+	return args
+}
+
+// 初始化数据目录，root@localhost没有密码
+func (m *localMysqld) initialize() error {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	args := append(m.baseArgs(), "--initialize-insecure")
+	if out, err := exec.Command(m.bin, args...).CombinedOutput(); err != nil {
+		log, _ := os.ReadFile(filepath.Join(m.dir, "error.log"))
+		return fmt.Errorf("初始化%s失败: %v\n%s\n%s", m.dir, err, out, log)
+	}
+	return nil
+}
+
+// 启动mysqld并等待可以连接，复制相关的参数和mysql_config.go中的强制参数一致
+// 第一次启动时创建root@'%'，和镜像的entrypoint一样不记binlog
+func (m *localMysqld) start() {
+	args := append(m.baseArgs(),
+		"--socket="+m.socket(),
+		"--pid-file="+filepath.Join(m.dir, "mysqld.pid"),
+		"--bind-address="+m.ip,
+		"--port=3306",
+		fmt.Sprintf("--server-id=%d", m.serverID),
+		"--log-bin=mysql-bin",
+		"--relay-log=relay-bin",
+		"--gtid-mode=ON",
+		"--enforce-gtid-consistency=ON",
+		"--log-slave-updates=ON",
+		"--skip-name-resolve",
+		"--loose-mysqlx=OFF",
+		"--loose-default-authentication-plugin=mysql_native_password",
+	)
+	m.cmd = exec.Command(m.bin, args...)
+	Expect(m.cmd.Start()).To(Succeed())
+
+	done := make(chan struct{})
+	m.done = done
+	go func() {
+		_ = m.cmd.Wait()
+		close(done)
+	}()
+
+	db, err := sql.Open("mysql", fmt.Sprintf("root@unix(%s)/mysql", m.socket()))
+	Expect(err).NotTo(HaveOccurred())
+	defer db.Close()
+
+	Eventually(func() error {
+		select {
+		case <-done:
+			log, _ := os.ReadFile(filepath.Join(m.dir, "error.log"))
+			StopTrying(fmt.Sprintf("mysqld退出了:\n%s", log)).Now()
+		default:
+		}
+		return db.Ping()
+	}).WithTimeout(time.Minute).WithPolling(200 * time.Millisecond).Should(Succeed())
+
+	conn, err := db.Conn(context.Background())
+	Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	for _, query := range []string{
+		"SET SESSION sql_log_bin = 0",
+		"CREATE USER IF NOT EXISTS 'root'@'%' IDENTIFIED BY 'root'",
+		"GRANT ALL PRIVILEGES ON *.* TO 'root'@'%' WITH GRANT OPTION",
+	} {
+		_, err := conn.ExecContext(context.Background(), query)
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+// 模拟宕机，直接SIGKILL
+func (m *localMysqld) kill() {
+	if m.cmd == nil || m.cmd.Process == nil {
+		return
+	}
+	_ = m.cmd.Process.Kill()
+	<-m.done
+	m.cmd = nil
+}
+
+// 通过tcp以root连接，和reconciler一样
+func (m *localMysqld) open(database string) *sql.DB {
+	db, err := sql.Open("mysql", fmt.Sprintf("root:root@tcp(%s:3306)/%s?timeout=1s&readTimeout=2s&writeTimeout=2s", m.ip, database))
+	Expect(err).NotTo(HaveOccurred())
+	return db
+}
+
+func (m *localMysqld) exec(query string, args ...interface{}) {
+	db := m.open("mysql")
+	defer db.Close()
+	_, err := db.Exec(query, args...)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+func (m *localMysqld) variable(name string) string {
+	db := m.open("mysql")
+	defer db.Close()
+	var value string
+	Expect(db.QueryRow(fmt.Sprintf("SELECT @@GLOBAL.%s", name)).Scan(&value)).To(Succeed())
+	return value
+}
+
+func (m *localMysqld) gtidExecuted() string {
+	return m.variable("gtid_executed")
+}
+
+func (m *localMysqld) gtidSubset(superset string) bool {
+	db := m.open("mysql")
+	defer db.Close()
+	var subset int
+	Expect(db.QueryRow("SELECT GTID_SUBSET(@@GLOBAL.gtid_executed, ?)", superset).Scan(&subset)).To(Succeed())
+	return subset == 1
+}
+
+func (m *localMysqld) slaveStatus() map[string]string {
+	db := m.open("mysql")
+	defer db.Close()
+	status, err := showSlaveStatus(context.Background(), db)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(status).NotTo(BeNil(), "%s没有配置复制", m.ip)
+	return status
+}
+
+// 等待执行完gtid集合
+func (m *localMysqld) waitFor(gtid string) {
+	db, err := sql.Open("mysql", fmt.Sprintf("root:root@tcp(%s:3306)/mysql?timeout=1s&readTimeout=35s", m.ip))
+	Expect(err).NotTo(HaveOccurred())
+	defer db.Close()
+
+	var result sql.NullInt64
+	Expect(db.QueryRow("SELECT WAIT_FOR_EXECUTED_GTID_SET(?, 30)", gtid).Scan(&result)).To(Succeed())
+	Expect(result.Int64).To(BeZero(), "%s没有在30秒内追上%s", m.ip, gtid)
+}
+
+// 和cmd/mysql-chaos-check一样按序号写入，只记录主库确认过的序号
+type ackedWriter struct {
+	seq   int
+	acked []int
+}
+
+func (w *ackedWriter) prepare(master *localMysqld) {
+	master.exec("CREATE DATABASE IF NOT EXISTS test_write")
+	master.exec(`CREATE TABLE IF NOT EXISTS test_write.heartbeat (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		seq_no INT NOT NULL,
+		write_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		pod_ip VARCHAR(64)
+	)`)
+}
+
+// 写入n条，返回确认的数量，失败的序号也会消耗掉
+func (w *ackedWriter) write(master *localMysqld, n int) int {
+	db := master.open("test_write")
+	defer db.Close()
+
+	acked := 0
+	for i := 0; i < n; i++ {
+		w.seq++
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := db.ExecContext(ctx, "INSERT INTO heartbeat (seq_no, pod_ip) VALUES (?, ?)", w.seq, master.ip)
+		cancel()
+		if err == nil {
+			w.acked = append(w.acked, w.seq)
+			acked++
+		}
+	}
+	return acked
+}
+
+// 所有确认过的序号都能在节点上读到
+func (w *ackedWriter) expectNoLoss(node *localMysqld) {
+	db := node.open("test_write")
+	defer db.Close()
+
+	rows, err := db.Query("SELECT seq_no FROM heartbeat")
+	Expect(err).NotTo(HaveOccurred())
+	defer rows.Close()
+
+	found := map[int]bool{}
+	for rows.Next() {
+		var seq int
+		Expect(rows.Scan(&seq)).To(Succeed())
+		found[seq] = true
+	}
+	Expect(rows.Err()).NotTo(HaveOccurred())
+
+	var lost []int
+	for _, seq := range w.acked {
+		if !found[seq] {
+			lost = append(lost, seq)
+		}
+	}
+	Expect(lost).To(BeEmpty(), "%s上丢失了确认过的写入", node.ip)
+}
+
+// 本地没有headless service的dns，CHANGE MASTER时把主库地址换成本地ip，查询复制状态时再换回来
+// 这样reconciler看到的和在集群中运行时完全一样
+type loopbackMysqlClient struct {
+	MysqlClient
+	// 主库地址到本地ip
+	hosts map[string]string
+}
+
+func (c *loopbackMysqlClient) Connect(ctx context.Context, pod *corev1.Pod, rootPassword string) (MysqlNode, error) {
+	node, err := c.MysqlClient.Connect(ctx, pod, rootPassword)
+	if err != nil {
+		return nil, err
+	}
+	return &loopbackMysqlNode{MysqlNode: node, hosts: c.hosts}, nil
+}
+
+type loopbackMysqlNode struct {
+	MysqlNode
+	hosts map[string]string
+}
+
+func (n *loopbackMysqlNode) ChangeMaster(ctx context.Context, host, user, password string) error {
+	if ip, ok := n.hosts[host]; ok {
+		host = ip
+	}
+	return n.MysqlNode.ChangeMaster(ctx, host, user, password)
+}
+
+func (n *loopbackMysqlNode) SlaveStatus(ctx context.Context) (map[string]string, error) {
+	status, err := n.MysqlNode.SlaveStatus(ctx)
+	if err != nil || status == nil {
+		return status, err
+	}
+	for host, ip := range n.hosts {
+		if status["Master_Host"] == ip {
+			status["Master_Host"] = host
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,298 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// 连接真实mysql时的超时和连接池配置，零值表示使用默认值
+type MysqlClientOptions struct {
+	// 建立tcp连接的超时，默认1秒
+	ConnectTimeout time.Duration
+	// 读取结果的超时，要比计划内切换时等待新主追平的时间长，默认15秒
+	ReadTimeout time.Duration
+	// 单条语句的超时，默认3秒
+	QueryTimeout time.Duration
+	// 一个pod的连接超过这个时间没有使用就关闭，默认5分钟
+	IdleTimeout time.Duration
+	// 复用连接前检查可用性的间隔，默认10秒
+	HealthCheckInterval time.Duration
+	// 每个pod最多打开的连接数，默认4
+	MaxOpenConnsPerPod int
+}
+
+func (o MysqlClientOptions) withDefaults() MysqlClientOptions {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = time.Second
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = (switchoverCatchUpTimeout + 5) * time.Second
+	}
+	if o.QueryTimeout <= 0 {
+		o.QueryTimeout = 3 * time.Second
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+	if o.HealthCheckInterval <= 0 {
+		o.HealthCheckInterval = 10 * time.Second
+	}
+	if o.MaxOpenConnsPerPod <= 0 {
+		o.MaxOpenConnsPerPod = 4
+	}
+	return o
+}
+
+// 连接真实的mysql，每个pod的sql.DB在多次调谐之间复用，避免每一步都重新建立连接
+func NewMysqlClient(options MysqlClientOptions) MysqlClient {
+	return newMysqlConnectionPool(options)
+}
+
+// 按pod管理的连接池，ProxySQL管理接口的连接也由它管理
+// pod重建（uid或ip变化）、mysql容器重启或者root密码变化时，旧的连接作废，用完后关闭
+type mysqlConnectionPool struct {
+	options MysqlClientOptions
+
+	mu      sync.Mutex
+	entries map[types.NamespacedName]*pooledDB
+
+	// 方便测试替换时间
+	now func() time.Time
+}
+
+// 一个pod的sql.DB
+type pooledDB struct {
+	key string
+	db  *sql.DB
+
+	// 正在使用的次数，作废的连接等到没人使用时再关闭
+	refs        int
+	stale       bool
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+func newMysqlConnectionPool(options MysqlClientOptions) *mysqlConnectionPool {
+	return &mysqlConnectionPool{
+		options: options.withDefaults(),
+		entries: map[types.NamespacedName]*pooledDB{},
+		now:     time.Now,
+	}
+}
+
+// 连接的标识，任何一项变化都需要重新建立连接
+// 密码只保存哈希值
+func mysqlPoolKey(pod *corev1.Pod, rootPassword string) string {
+	return poolKey(pod, "mysql", rootPassword)
+}
+
+// ProxySQL管理接口的连接标识，ProxySQL容器重启后内存中的配置会从磁盘重新加载，连接也需要重建
+func routerPoolKey(pod *corev1.Pod, adminPassword string) string {
+	return poolKey(pod, "proxysql", adminPassword)
+}
+
+func poolKey(pod *corev1.Pod, container, password string) string {
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container {
+			restarts = status.RestartCount
+		}
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	return fmt.Sprintf("%s/%s/%d/%x", pod.UID, pod.Status.PodIP, restarts, sum[:8])
+}
+
+func (p *mysqlConnectionPool) Connect(ctx context.Context, pod *corev1.Pod, rootPassword string) (MysqlNode, error) {
+
+	// interpolateParams=true表示在本地预编译sql语句
+	dsn := fmt.Sprintf("root:%s@tcp(%s:3306)/mysql?timeout=%s&readTimeout=%s&parseTime=true&interpolateParams=true",
+		rootPassword, pod.Status.PodIP, p.options.ConnectTimeout, p.options.ReadTimeout)
+
+	entry, err := p.connect(ctx, pod, mysqlPoolKey(pod, rootPassword), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlMysqlNode{
+		db:           entry.db,
+		queryTimeout: p.options.QueryTimeout,
+		release:      func() { p.release(entry) },
+	}, nil
+}
+
+// ProxySQL pod和mysql pod的名字不同，两者的连接放在同一个池中
+func (p *mysqlConnectionPool) ConnectRouter(ctx context.Context, pod *corev1.Pod, adminPassword string) (RouterNode, error) {
+
+	// ProxySQL的管理接口不支持预处理语句，必须开启interpolateParams
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/?timeout=%s&readTimeout=%s&interpolateParams=true",
+		routerAdminUser, adminPassword, pod.Status.PodIP, routerAdminPort, p.options.ConnectTimeout, p.options.ReadTimeout)
+
+	entry, err := p.connect(ctx, pod, routerPoolKey(pod, adminPassword), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlRouterNode{
+		db:           entry.db,
+		queryTimeout: p.options.QueryTimeout,
+		release:      func() { p.release(entry) },
+	}, nil
+}
+
+// 取出或新建pod的连接，返回的连接用完后需要release
+func (p *mysqlConnectionPool) connect(ctx context.Context, pod *corev1.Pod, key, dsn string) (*pooledDB, error) {
+	name := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	entry, needCheck := p.acquire(name, key)
+
+	if entry != nil && needCheck {
+		// 长时间没有检查过的连接先ping一次，mysql重启或网络中断后重新建立
+		pingCtx, cancel := context.WithTimeout(ctx, p.options.ConnectTimeout)
+		err := entry.db.PingContext(pingCtx)
+		cancel()
+
+		if err != nil {
+			p.invalidate(name, entry)
+			p.release(entry)
+			entry = nil
+		}
+	}
+
+	if entry == nil {
+		db, err := p.open(ctx, pod, dsn)
+		if err != nil {
+			return nil, err
+		}
+		entry = p.store(name, key, db)
+	}
+
+	return entry, nil
+}
+
+// 取出可以复用的连接，第二个返回值表示是否需要先做健康检查
+// 顺便关闭空闲太久的连接
+func (p *mysqlConnectionPool) acquire(name types.NamespacedName, key string) (*pooledDB, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.evictIdleLocked(now)
+
+	entry, ok := p.entries[name]
+	if !ok {
+		return nil, false
+	}
+
+	if entry.key != key {
+		p.invalidateLocked(name, entry)
+		return nil, false
+	}
+
+	entry.refs++
+	entry.lastUsed = now
+
+	needCheck := now.Sub(entry.lastChecked) >= p.options.HealthCheckInterval
+	if needCheck {
+		entry.lastChecked = now
+	}
+	return entry, needCheck
+}
+
+func (p *mysqlConnectionPool) open(ctx context.Context, pod *corev1.Pod, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("dsn格式错误或驱动未加载: %w", err)
+	}
+
+	db.SetMaxOpenConns(p.options.MaxOpenConnsPerPod)
+	db.SetMaxIdleConns(p.options.MaxOpenConnsPerPod)
+	db.SetConnMaxIdleTime(p.options.IdleTimeout)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("节点%s无法连接: %w", pod.Name, err)
+	}
+
+	return db, nil
+}
+
+// 保存新建的连接，并发时如果别人已经建好了就用别人的
+func (p *mysqlConnectionPool) store(name types.NamespacedName, key string, db *sql.DB) *pooledDB {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	if existing, ok := p.entries[name]; ok {
+		if existing.key == key {
+			db.Close()
+			existing.refs++
+			existing.lastUsed = now
+			return existing
+		}
+		p.invalidateLocked(name, existing)
+	}
+
+	entry := &pooledDB{key: key, db: db, refs: 1, lastUsed: now, lastChecked: now}
+	p.entries[name] = entry
+	return entry
+}
+
+func (p *mysqlConnectionPool) release(entry *pooledDB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry.refs--
+	entry.lastUsed = p.now()
+	if entry.stale && entry.refs == 0 {
+		entry.db.Close()
+	}
+}
+
+func (p *mysqlConnectionPool) invalidate(name types.NamespacedName, entry *pooledDB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.invalidateLocked(name, entry)
+}
+
+// 作废连接，没人使用时立即关闭
+func (p *mysqlConnectionPool) invalidateLocked(name types.NamespacedName, entry *pooledDB) {
+	if p.entries[name] == entry {
+		delete(p.entries, name)
+	}
+	if entry.stale {
+		return
+	}
+	entry.stale = true
+	if entry.refs == 0 {
+		entry.db.Close()
+	}
+}
+
+// 关闭空闲太久的连接，已经删除的pod和集群的连接也是这样回收的
+func (p *mysqlConnectionPool) evictIdleLocked(now time.Time) {
+	for name, entry := range p.entries {
+		if entry.refs == 0 && now.Sub(entry.lastUsed) >= p.options.IdleTimeout {
+			p.invalidateLocked(name, entry)
+		}
+	}
+}
+
+// 关闭所有连接
+func (p *mysqlConnectionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, entry := range p.entries {
+		p.invalidateLocked(name, entry)
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"database/sql"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("mysql连接池", func() {
+
+	var pod *corev1.Pod
+
+	BeforeEach(func() {
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-cluster-0", Namespace: "default", UID: "uid-1"},
+			Status: corev1.PodStatus{
+				PodIP:             "10.0.0.1",
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "mysql"}},
+			},
+		}
+	})
+
+	It("pod重建、mysql重启或密码变化时连接作废", func() {
+		key := mysqlPoolKey(pod, "root")
+		Expect(mysqlPoolKey(pod, "root")).To(Equal(key))
+		Expect(key).NotTo(ContainSubstring("root"))
+
+		Expect(mysqlPoolKey(pod, "new-password")).NotTo(Equal(key))
+
+		restarted := pod.DeepCopy()
+		restarted.Status.ContainerStatuses[0].RestartCount = 1
+		Expect(mysqlPoolKey(restarted, "root")).NotTo(Equal(key))
+
+		recreated := pod.DeepCopy()
+		recreated.UID = "uid-2"
+		Expect(mysqlPoolKey(recreated, "root")).NotTo(Equal(key))
+
+		moved := pod.DeepCopy()
+		moved.Status.PodIP = "10.0.0.2"
+		Expect(mysqlPoolKey(moved, "root")).NotTo(Equal(key))
+	})
+
+	It("ProxySQL的连接只随proxysql容器重启作废", func() {
+		router := pod.DeepCopy()
+		router.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "proxysql"}}
+		key := routerPoolKey(router, "admin")
+		Expect(key).NotTo(ContainSubstring("admin"))
+		Expect(routerPoolKey(router, "new-password")).NotTo(Equal(key))
+
+		restarted := router.DeepCopy()
+		restarted.Status.ContainerStatuses[0].RestartCount = 1
+		Expect(routerPoolKey(restarted, "admin")).NotTo(Equal(key))
+		Expect(mysqlPoolKey(restarted, "admin")).To(Equal(mysqlPoolKey(router, "admin")))
+	})
+
+	It("复用连接，空闲超时和标识变化时关闭", func() {
+		now := time.Now()
+		pool := newMysqlConnectionPool(MysqlClientOptions{IdleTimeout: time.Minute, HealthCheckInterval: time.Hour})
+		pool.now = func() time.Time { return now }
+
+		name := types.NamespacedName{Namespace: "default", Name: "test-cluster-0"}
+		key := mysqlPoolKey(pod, "root")
+
+		// sql.Open不会真正建立连接
+		db, err := sql.Open("mysql", "root:root@tcp(127.0.0.1:1)/mysql")
+		Expect(err).NotTo(HaveOccurred())
+		stored := pool.store(name, key, db)
+		pool.release(stored)
+
+		entry, needCheck := pool.acquire(name, key)
+		Expect(entry).To(BeIdenticalTo(stored))
+		Expect(needCheck).To(BeFalse())
+
+		// 使用中的连接不会因为空闲被关闭
+		now = now.Add(2 * time.Minute)
+		_, _ = pool.acquire(types.NamespacedName{Namespace: "default", Name: "other"}, "")
+		Expect(pool.entries).To(HaveKey(name))
+
+		pool.release(entry)
+		now = now.Add(2 * time.Minute)
+		entry, _ = pool.acquire(name, key)
+		Expect(entry).To(BeNil())
+		Expect(pool.entries).NotTo(HaveKey(name))
+		Expect(stored.stale).To(BeTrue())
+
+		// 密码变化，正在使用的旧连接在归还后关闭
+		db, _ = sql.Open("mysql", "root:root@tcp(127.0.0.1:1)/mysql")
+		stored = pool.store(name, key, db)
+		entry, _ = pool.acquire(name, mysqlPoolKey(pod, "new-password"))
+		Expect(entry).To(BeNil())
+		Expect(stored.stale).To(BeTrue())
+		Expect(stored.refs).To(Equal(1))
+		pool.release(stored)
+		Expect(stored.refs).To(BeZero())
+	})
+})
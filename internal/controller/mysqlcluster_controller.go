@@ -4,15 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -24,6 +29,10 @@ import (
 type MysqlClusterReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// 在MysqlCluster上记录事件，kubectl describe可以看到，没有设置时由SetupWithManager创建
+	Recorder record.EventRecorder
+	// 管理mysql节点，没有设置时由SetupWithManager创建连接真实数据库的实现，测试时可以注入NewFakeMysqlClient
+	Mysql MysqlClient
 }
 
 // +kubebuilder:rbac:groups=apps.rumraisin.me,resources=mysqlclusters,verbs=get;list;watch;create;update;patch;delete
@@ -31,8 +40,12 @@ type MysqlClusterReconciler struct {
 // +kubebuilder:rbac:groups=apps.rumraisin.me,resources=mysqlclusters/finalizers,verbs=update
 
 // 增加权限
-// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets;deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=pods;services;configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;podmonitors,verbs=get;list;watch;create;update;patch;delete
 
 type PodInfo struct {
 	Pod           *corev1.Pod
@@ -40,6 +53,48 @@ type PodInfo struct {
 	IsReady       bool
 	IsConnectable bool
 	GTID          string
+
+	// pod上的配置哈希与最新的不一致，说明有静态参数变更，等待滚动重启
+	PendingRestart bool
+	// 本轮调谐中通过SET GLOBAL修改动态参数失败的原因，成功时为空
+	ConfigApplyError string
+
+	// pod所在节点被cordon，通常意味着即将排水，主库需要提前切走
+	NodeUnschedulable bool
+	// pod所在节点的可用区，选主时用于同可用区优先
+	Zone string
+	// 复制状态，只有配置过复制的节点（从库）才有
+	Replication *ReplicationStatus
+	// 心跳表中的信息，没有开启心跳或者表里还没有数据时为nil
+	Heartbeat *HeartbeatInfo
+}
+
+// 从SHOW SLAVE STATUS中提取的复制状态
+type ReplicationStatus struct {
+	MasterHost          string
+	IORunning           string
+	SQLRunning          string
+	SecondsBehindMaster *int64 // sql线程没有运行时为nil
+	LastError           string
+
+	// 根据心跳表计算的延迟，无法计算时为nil
+	HeartbeatLag *time.Duration
+}
+
+// 复制延迟，优先使用心跳表计算的结果，否则使用Seconds_Behind_Master，都没有时返回false
+func (s *ReplicationStatus) Lag() (time.Duration, bool) {
+	if s.HeartbeatLag != nil {
+		return *s.HeartbeatLag, true
+	}
+	if s.SecondsBehindMaster != nil {
+		return time.Duration(*s.SecondsBehindMaster) * time.Second, true
+	}
+	return 0, false
+}
+
+// io和sql线程都在运行
+func (s *ReplicationStatus) Running() bool {
+	return strings.EqualFold(s.IORunning, "Yes") && strings.EqualFold(s.SQLRunning, "Yes")
 }
 
 // 快照结构体
@@ -48,6 +103,32 @@ type ClusterSnapshot struct {
 	ReplPassword string
 
 	Pods []*PodInfo // 建议用slice，如果用map，后面的数据库并发操作会很麻烦
+
+	// 最新的配置哈希，只包含需要重启才能生效的参数
+	ConfigHash string
+	// 可以通过SET GLOBAL在线生效的参数
+	DynamicConfig map[string]string
+	// 之前在线修改过、已经从spec中删除的参数，值为my.cnf中的值，为空表示恢复成mysqld的默认值
+	RevertConfig map[string]string
+	// 写入status.appliedDynamicVariables，第9步在所有节点上生效后才去掉已经恢复的参数
+	AppliedVariables []string
+
+	// 监控账号的密码，没有开启监控时为空
+	ExporterPassword string
+
+	// ProxySQL管理接口的密码，没有开启router时为空
+	RouterAdminPassword string
+
+	// spec.replicas小于当前副本数，缩容被忽略
+	ScaleInBlocked bool
+	// 忽略缩容的说明，写入ScalingBlocked condition，内容变化时才重新记录事件
+	ScaleInMessage string
+	// 本轮调谐中发生了选主并修改了角色标签，值为选主原因
+	FailoverReason string
+	// 本轮调谐中的切换记录，初始化集群时的选主不记录
+	FailoverRecord *dbv1.FailoverRecord
+	// 需要写入status.lastMaster的主库，为空时保留status中原来的值
+	LastMaster *dbv1.MasterObservation
 }
 
 func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -57,6 +138,10 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	// 1.获取cluster
 	var cluster dbv1.MysqlCluster
 	if err := r.Get(ctx, req.NamespacedName, &cluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			// 集群已被删除，清理它的指标
+			deleteClusterMetrics(req.Namespace, req.Name)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 	logger.Info("1.已获取MysqlCluster资源", "name", cluster.Name)
@@ -76,8 +161,14 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	// 3.获取密码，初始化快照结构体
 	secretName := cluster.Spec.SecretName.Name
 
+	stepStart := time.Now()
 	rootPassword, replPassword, err := r.checkSecret(ctx, secretName, &cluster)
+	observeReconcileStep("3.check_secret", stepStart)
 	if err != nil {
+		r.recordWarning(&cluster, EventReasonSecretInvalid, "%v", err)
+		if condErr := r.updateCondition(ctx, &cluster, ConditionSecretValid, false, "SecretInvalid", err.Error()); condErr != nil {
+			logger.Error(condErr, "更新status失败")
+		}
 
 		return ctrl.Result{}, err
 	}
@@ -90,25 +181,41 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	logger.Info("3.已获取密码并初始化快照结构体")
 
 	// 4.确保基础资源，service，configmap，statefulset
-	if err := r.ensureInfrastructure(ctx, &cluster); err != nil {
+	stepStart = time.Now()
+	err = r.ensureInfrastructure(ctx, &cluster, snapshot)
+	observeReconcileStep("4.ensure_infrastructure", stepStart)
+	if err != nil {
+		// 多数是mysqlConfig或podTemplate不合法，在condition中给出原因
+		if condErr := r.updateCondition(ctx, &cluster, ConditionConfigApplied, false, "ApplyFailed", err.Error()); condErr != nil {
+			logger.Error(condErr, "更新status失败")
+		}
 		return ctrl.Result{}, err
 	}
 	logger.Info("4.已确保基础资源")
 
 	// 5.更新快照，将pod信息存入
-	if err := r.updateSnapshotWithPod(ctx, &cluster, snapshot); err != nil {
+	stepStart = time.Now()
+	err = r.updateSnapshotWithPod(ctx, &cluster, snapshot)
+	observeReconcileStep("5.snapshot_pods", stepStart)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
 	logger.Info("5.已更新快照的Pod信息")
 
 	// 6.确保数据库能连接且有同步账号
-	if err = r.ensureDatabaseUsers(ctx, snapshot); err != nil {
+	stepStart = time.Now()
+	err = r.ensureDatabaseUsers(ctx, snapshot)
+	observeReconcileStep("6.ensure_database_users", stepStart)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
 	logger.Info("6.已确保数据库能连接且有同步账号")
 
 	// 7.更新快照，将gtid信息和数据库连接状态存入
-	if err := r.updateSnapshotWithGTID(ctx, snapshot); err != nil {
+	stepStart = time.Now()
+	err = r.updateSnapshotWithGTID(ctx, &cluster, snapshot)
+	observeReconcileStep("7.snapshot_gtid", stepStart)
+	if err != nil {
 		logger.Info("7.部分数据库无法连接", "err", err)
 
 		// 不返回错误，允许部分节点连接失败继续往下走
@@ -117,11 +224,24 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 
 	// 8.选主和打标签
 
-	changed, err := r.reconcileRoles(ctx, snapshot)
+	stepStart = time.Now()
+	changed, err := r.reconcileRoles(ctx, &cluster, snapshot)
+	observeReconcileStep("8.reconcile_roles", stepStart)
 
 	// 如果可用pod数量不足，则更新status并5秒后重试，如果返回err会导致RequeueAfter被忽略
 	if errors.Is(err, ErrHA) {
 
+		// 只剩主库时也要保证它可写
+		if err := r.ensureLoneMasterWritable(ctx, snapshot); err != nil {
+			logger.Error(err, "打开主库写入失败")
+		}
+		// 从库都不可用时读服务可能需要回退到主库
+		if err := r.reconcileReadEndpoints(ctx, &cluster, snapshot); err != nil {
+			logger.Error(err, "更新读服务失败")
+		}
+		if err := r.syncRouterBackends(ctx, &cluster, snapshot); err != nil {
+			logger.Error(err, "同步ProxySQL后端失败")
+		}
 		if err := r.updateStatus(ctx, &cluster, snapshot); err != nil {
 			logger.Error(err, "更新status失败")
 		}
@@ -147,14 +267,36 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	logger.Info("8.已完成选主和打标签")
 
 	// 9.数据库内部设置修正
-	if err := r.reconcileDatabaseSettings(ctx, snapshot, &cluster); err != nil {
+	stepStart = time.Now()
+	err = r.reconcileDatabaseSettings(ctx, snapshot, &cluster)
+	observeReconcileStep("9.database_settings", stepStart)
+	if err != nil {
 
 		return ctrl.Result{}, err
 	}
+
+	// 根据复制状态维护读服务的endpoint
+	stepStart = time.Now()
+	err = r.reconcileReadEndpoints(ctx, &cluster, snapshot)
+	observeReconcileStep("9.read_endpoints", stepStart)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ProxySQL的后端跟随角色和readable标签，失败只记录日志，不影响集群本身
+	stepStart = time.Now()
+	err = r.syncRouterBackends(ctx, &cluster, snapshot)
+	observeReconcileStep("9.router_backends", stepStart)
+	if err != nil {
+		logger.Error(err, "同步ProxySQL后端失败")
+	}
 	logger.Info("9.已完成数据库内部设置修正")
 
 	// 10.更新status
-	if err := r.updateStatus(ctx, &cluster, snapshot); err != nil {
+	stepStart = time.Now()
+	err = r.updateStatus(ctx, &cluster, snapshot)
+	observeReconcileStep("10.update_status", stepStart)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
 	logger.Info("10.已更新status")
@@ -164,13 +306,22 @@ func (r *MysqlClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 }
 
 func (r *MysqlClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor(eventSource)
+	}
+	if r.Mysql == nil {
+		r.Mysql = NewMysqlClient(MysqlClientOptions{})
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&dbv1.MysqlCluster{}).
 		// 监听MysqlCluster所属相关的资源变化
 		// 使用statefulset来控制pod就不需要监听endpoinrt，作为更高级的抽象，statefulset的改变通常比endpoint更慢，调谐发生时endpoint已经变更完毕
 		Owns(&appsv1.StatefulSet{}).
+		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.ConfigMap{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
 		// 监听Pod变化
 		// 保险措施：假如有人改了pod的标签，也能触发调谐，这种情况statefulset的状态不会变更
 		Watches(
@@ -178,6 +329,21 @@ func (r *MysqlClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			handler.EnqueueRequestsFromMapFunc(r.findObjectsForPod),
 			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
 		).
+		// 监听节点cordon，排水前先把主库切走
+		Watches(
+			&corev1.Node{},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForNode),
+			builder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(event.CreateEvent) bool { return false },
+				DeleteFunc:  func(event.DeleteEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+				UpdateFunc: func(e event.UpdateEvent) bool {
+					oldNode, okOld := e.ObjectOld.(*corev1.Node)
+					newNode, okNew := e.ObjectNew.(*corev1.Node)
+					return okOld && okNew && oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable
+				},
+			}),
+		).
 		Complete(r)
 }
 
@@ -199,3 +365,28 @@ func (r *MysqlClusterReconciler) findObjectsForPod(ctx context.Context, pod clie
 		}},
 	}
 }
+
+// 通过节点找到上面运行的MysqlCluster pod并发起调谐请求
+func (r *MysqlClusterReconciler) findObjectsForNode(ctx context.Context, node client.Object) []reconcile.Request {
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.HasLabels{"app"}); err != nil {
+		return []reconcile.Request{}
+	}
+
+	// 同一个集群可能有多个pod在这个节点上，去重
+	seen := make(map[types.NamespacedName]bool)
+	var requests []reconcile.Request
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName != node.GetName() {
+			continue
+		}
+		key := types.NamespacedName{Name: pod.Labels["app"], Namespace: pod.Namespace}
+		if !seen[key] {
+			seen[key] = true
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+
+	return requests
+}
@@ -21,64 +21,369 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/reconcile"
-
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 
-	appsv1 "mysql-operator/api/v1"
+	dbv1 "mysql-operator/api/v1"
 )
 
 var _ = Describe("MysqlCluster Controller", func() {
-	Context("When reconciling a resource", func() {
-		const resourceName = "test-resource"
-
-		ctx := context.Background()
-
-		typeNamespacedName := types.NamespacedName{
-			Name:      resourceName,
-			Namespace: "default", // TODO(user):Modify as needed
-		}
-		mysqlcluster := &appsv1.MysqlCluster{}
-
-		BeforeEach(func() {
-			By("creating the custom resource for the Kind MysqlCluster")
-			err := k8sClient.Get(ctx, typeNamespacedName, mysqlcluster)
-			if err != nil && errors.IsNotFound(err) {
-				resource := &appsv1.MysqlCluster{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      resourceName,
-						Namespace: "default",
-					},
-					// TODO(user): Specify other spec details if needed.
-				}
-				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
-			}
+
+	var h *clusterHarness
+
+	BeforeEach(func() {
+		h = newClusterHarness(context.Background())
+	})
+
+	// 创建3副本的集群并等待0号成为主库
+	bootstrap := func() {
+		h.createCluster(3, nil)
+		h.settle()
+		h.expectConverged(h.podName(0))
+	}
+
+	It("初始化集群：选出主库，配置复制和账号", func() {
+		h.createCluster(3, nil)
+
+		// 第一次调谐只设置phase
+		_, err := h.reconcile()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h.cluster().Status.Phase).To(Equal(dbv1.MysqlClusterPhaseInitializing))
+
+		h.settle()
+		h.expectConverged(h.podName(0))
+
+		for _, pod := range h.pods() {
+			Expect(h.mysql.Node(pod.Name).Users).To(HaveKey(ReplUser))
+		}
+
+		Expect(h.mysql.Write(h.podName(0), 3, false)).To(Succeed())
+		h.settle()
+		h.expectConverged(h.podName(0))
+
+		cluster := h.cluster()
+		Expect(cluster.Status.Phase).To(Equal(dbv1.MysqlClusterPhaseRunning))
+		Expect(cluster.Status.MasterReplicas).To(Equal(int32(1)))
+		Expect(cluster.Status.SlaveReplicas).To(Equal(int32(2)))
+		Expect(meta.IsStatusConditionTrue(cluster.Status.Conditions, ConditionReady)).To(BeTrue())
+		Expect(h.hasEvent(EventReasonMasterElected)).To(BeTrue())
+
+		for _, role := range []string{"master", "slave"} {
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: h.name + "-svc-" + role}, svc)).To(Succeed())
+		}
+	})
+
+	It("脑裂：两个pod都带master标签时只保留一个主库", func() {
+		bootstrap()
+		Expect(h.mysql.Write(h.podName(0), 5, false)).To(Succeed())
+
+		h.setRole(h.podName(1), "master")
+		Expect(h.masters()).To(HaveLen(2))
+
+		h.settle()
+		h.expectConverged(h.podName(0))
+		Expect(h.hasEvent(EventReasonSplitBrainDetected)).To(BeTrue())
+	})
+
+	It("主库宕机：提升数据最新的从库，旧主恢复后成为从库", func() {
+		bootstrap()
+		Expect(h.mysql.Write(h.podName(0), 3, false)).To(Succeed())
+
+		// 1号落后2个事务，2号是最新的
+		h.mysql.PauseReplication(h.podName(1), true)
+		Expect(h.mysql.Write(h.podName(0), 2, false)).To(Succeed())
+
+		h.mysql.SetDown(h.podName(0), true)
+		h.setPodReady(h.podName(0), false)
+
+		for i := 0; i < 5; i++ {
+			_, _ = h.reconcile()
+		}
+		Expect(h.masters()).To(Equal([]string{h.podName(2)}))
+		Expect(h.mysql.Node(h.podName(2)).ReadOnly).To(BeFalse())
+
+		cluster := h.cluster()
+		Expect(cluster.Status.FailoverHistory).NotTo(BeEmpty())
+		record := cluster.Status.FailoverHistory[len(cluster.Status.FailoverHistory)-1]
+		Expect(record.NewMaster).To(Equal(h.podName(2)))
+		Expect(record.OldMaster).To(Equal(h.podName(0)))
+		if record.LostTransactions != nil {
+			Expect(*record.LostTransactions).To(BeZero())
+		}
+
+		// 新主继续写入，1号恢复复制后追上新主，旧主恢复后不能有errant gtid
+		Expect(h.mysql.Write(h.podName(2), 1, false)).To(Succeed())
+		h.mysql.PauseReplication(h.podName(1), false)
+		h.mysql.SetDown(h.podName(0), false)
+		h.setPodReady(h.podName(0), true)
+
+		h.settle()
+		h.expectConverged(h.podName(2))
+	})
+
+	It("只剩主库：开启心跳时主库重启后只读，可用节点不足也要打开写入", func() {
+		h.createCluster(3, func(cluster *dbv1.MysqlCluster) {
+			cluster.Spec.Heartbeat = &dbv1.HeartbeatConfig{IntervalSeconds: 1}
 		})
+		h.settle()
+		h.expectConverged(h.podName(0))
+
+		for _, name := range []string{h.podName(1), h.podName(2)} {
+			h.mysql.SetDown(name, true)
+			h.setPodReady(name, false)
+		}
+
+		// 模拟主库按my.cnf中的read_only=on重启
+		master := h.pods()[0]
+		node, err := h.mysql.Connect(h.ctx, master, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(node.SetReadOnly(h.ctx, true)).To(Succeed())
+		Expect(node.Close()).To(Succeed())
+
+		result, err := h.reconcile()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).NotTo(BeZero())
+
+		Expect(h.masters()).To(Equal([]string{h.podName(0)}))
+		Expect(h.mysql.Node(h.podName(0)).ReadOnly).To(BeFalse())
+		Expect(h.mysql.Write(h.podName(0), 1, false)).To(Succeed())
+	})
+
+	It("operator重启后主库宕机：用status中记下的gtid估算丢失的事务", func() {
+		bootstrap()
+		Expect(h.mysql.Write(h.podName(0), 3, false)).To(Succeed())
+		h.settle()
+
+		lastMaster := h.cluster().Status.LastMaster
+		Expect(lastMaster).NotTo(BeNil())
+		Expect(lastMaster.Name).To(Equal(h.podName(0)))
+		Expect(lastMaster.GTID).To(Equal(h.mysql.Node(h.podName(0)).Executed.String()))
+
+		// 新的reconciler没有内存中的状态，相当于operator重启或切换了leader
+		h.reconciler = &MysqlClusterReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: h.recorder,
+			Mysql:    h.mysql,
+		}
+		h.mysql.SetDown(h.podName(0), true)
+		h.setPodReady(h.podName(0), false)
+		for i := 0; i < 5; i++ {
+			_, _ = h.reconcile()
+		}
+
+		history := h.cluster().Status.FailoverHistory
+		Expect(history).NotTo(BeEmpty())
+		record := history[len(history)-1]
+		Expect(record.OldMaster).To(Equal(h.podName(0)))
+		Expect(record.OldMasterGTID).To(Equal(lastMaster.GTID))
+		Expect(record.LostTransactions).NotTo(BeNil())
+		Expect(*record.LostTransactions).To(BeZero())
+		Expect(h.cluster().Status.LastMaster.Name).To(Equal(record.NewMaster))
+	})
+
+	It("主库所在节点被cordon：计划内切换到其他节点，不丢数据", func() {
+		bootstrap()
+		Expect(h.mysql.Write(h.podName(0), 3, false)).To(Succeed())
 
-		AfterEach(func() {
-			// TODO(user): Cleanup logic after each test, like removing the resource instance.
-			resource := &appsv1.MysqlCluster{}
-			err := k8sClient.Get(ctx, typeNamespacedName, resource)
-			Expect(err).NotTo(HaveOccurred())
+		// 主库的PDB不允许驱逐，只能靠operator先把主库切走
+		pdb := &policyv1.PodDisruptionBudget{}
+		Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: h.name + "-pdb-master"}, pdb)).To(Succeed())
+		Expect(pdb.Spec.MaxUnavailable.IntValue()).To(BeZero())
+		// 切换过程中暂时没有role标签的pod也在PDB的保护下
+		Expect(k8sClient.Get(h.ctx, types.NamespacedName{Namespace: h.namespace, Name: h.name + "-pdb-" + pdbRoleUnlabeled}, pdb)).To(Succeed())
 
-			By("Cleanup the specific resource instance MysqlCluster")
-			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+		h.cordonNode(h.podName(0))
+		h.settle()
+
+		masters := h.masters()
+		Expect(masters).To(HaveLen(1))
+		Expect(masters[0]).NotTo(Equal(h.podName(0)))
+		h.expectConverged(masters[0])
+		Expect(h.hasEvent(EventReasonSwitchoverCompleted)).To(BeTrue())
+
+		history := h.cluster().Status.FailoverHistory
+		Expect(history).NotTo(BeEmpty())
+		record := history[len(history)-1]
+		Expect(record.Reason).To(Equal("switchover"))
+		Expect(record.OldMaster).To(Equal(h.podName(0)))
+
+		// 旧主作为从库追上新主的写入
+		Expect(h.mysql.Write(masters[0], 2, false)).To(Succeed())
+		h.settle()
+		h.expectConverged(masters[0])
+	})
+
+	It("status写入失败时不记录phase变化的事件", func() {
+		bootstrap()
+		Expect(h.cluster().Status.Phase).To(Equal(dbv1.MysqlClusterPhaseRunning))
+		before := h.countEvents(EventReasonPhaseChanged)
+
+		h.mysql.SetDown(h.podName(2), true)
+		h.setPodReady(h.podName(2), false)
+
+		h.reconciler.Client = &failingStatusClient{Client: k8sClient, err: apierrors.NewConflict(dbv1.GroupVersion.WithResource("mysqlclusters").GroupResource(), h.name, nil)}
+		for i := 0; i < 3; i++ {
+			_, _ = h.reconcile()
+		}
+		Expect(h.countEvents(EventReasonPhaseChanged)).To(Equal(before))
+
+		h.reconciler.Client = k8sClient
+		for i := 0; i < 3; i++ {
+			_, _ = h.reconcile()
+		}
+		Expect(h.cluster().Status.Phase).To(Equal(dbv1.MysqlClusterPhaseDegraded))
+		Expect(h.countEvents(EventReasonPhaseChanged)).To(Equal(before + 1))
+	})
+
+	It("读写分离：ProxySQL的后端跟随主库切换，宕机的ProxySQL恢复后补上", func() {
+		h.createCluster(3, func(cluster *dbv1.MysqlCluster) {
+			cluster.Spec.Router = &dbv1.RouterConfig{}
 		})
-		It("should successfully reconcile the resource", func() {
-			By("Reconciling the created resource")
-			controllerReconciler := &MysqlClusterReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+		h.settle()
+		h.expectConverged(h.podName(0))
+
+		routers := []string{h.name + "-router-a", h.name + "-router-b"}
+		h.createRouterPod(routers[0], "10.0.1.1")
+		h.createRouterPod(routers[1], "10.0.1.2")
+		h.mysql.SetRouterDown(routers[1], true)
+		_, _ = h.reconcile()
+
+		backends := func(master string, readers ...string) []routerBackend {
+			expected := []routerBackend{{Hostgroup: routerWriterHostgroup, Hostname: h.masterHost(master)}}
+			for _, reader := range readers {
+				expected = append(expected, routerBackend{Hostgroup: routerReaderHostgroup, Hostname: h.masterHost(reader)})
+			}
+			return expected
+		}
+		Expect(h.mysql.Router(routers[0]).Backends).To(Equal(backends(h.podName(0), h.podName(1), h.podName(2))))
+		Expect(h.mysql.Router(routers[1]).Backends).To(BeEmpty())
+
+		By("后端没有变化时不重复写入")
+		_, _ = h.reconcile()
+		Expect(h.mysql.Router(routers[0]).Loads).To(Equal(1))
+
+		By("主库宕机后两个ProxySQL都指向新主")
+		h.mysql.SetRouterDown(routers[1], false)
+		h.mysql.SetDown(h.podName(0), true)
+		h.setPodReady(h.podName(0), false)
+		for i := 0; i < 5; i++ {
+			_, _ = h.reconcile()
+		}
+		master := h.masters()
+		Expect(master).To(HaveLen(1))
+		Expect(master[0]).NotTo(Equal(h.podName(0)))
+
+		for _, router := range routers {
+			Expect(h.mysql.Router(router).Backends).To(HaveExactElements(
+				routerBackend{Hostgroup: routerWriterHostgroup, Hostname: h.masterHost(master[0])},
+				HaveField("Hostgroup", routerReaderHostgroup),
+			))
+		}
+	})
+
+	It("扩容：新pod加入后作为从库复制主库", func() {
+		bootstrap()
+		Expect(h.mysql.Write(h.podName(0), 2, false)).To(Succeed())
+
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) { spec.Replicas = ptr.To(int32(4)) })
+		h.settle()
+
+		Expect(*h.statefulSet().Spec.Replicas).To(Equal(int32(4)))
+		Expect(h.pods()).To(HaveLen(4))
+		h.expectConverged(h.podName(0))
+		Expect(h.cluster().Status.SlaveReplicas).To(Equal(int32(3)))
+		Expect(h.hasEvent(EventReasonScaledOut)).To(BeTrue())
+	})
+
+	It("缩容：忽略缩容请求，只在副本数变化时记录一次事件", func() {
+		bootstrap()
+
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) { spec.Replicas = ptr.To(int32(2)) })
+		for i := 0; i < 5; i++ {
+			h.settle()
+		}
+
+		Expect(*h.statefulSet().Spec.Replicas).To(Equal(int32(3)))
+		Expect(h.countEvents(EventReasonScaleInIgnored)).To(Equal(1))
+		condition := meta.FindStatusCondition(h.cluster().Status.Conditions, ConditionScalingBlocked)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Message).To(ContainSubstring("从3到2"))
+
+		// 恢复副本数后condition解除，再次缩容时重新记录
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) { spec.Replicas = ptr.To(int32(3)) })
+		h.settle()
+		Expect(meta.IsStatusConditionFalse(h.cluster().Status.Conditions, ConditionScalingBlocked)).To(BeTrue())
+
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) { spec.Replicas = ptr.To(int32(2)) })
+		h.settle()
+		Expect(h.countEvents(EventReasonScaleInIgnored)).To(Equal(2))
+	})
+
+	It("修改配置：动态参数立即生效，静态参数在滚动重启后生效", func() {
+		bootstrap()
+		oldChecksum := h.statefulSet().Spec.Template.Annotations["checksum/config"]
+
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) {
+			spec.MysqlConfig = map[string]string{
+				"max_connections":      "500",
+				"innodb_log_file_size": "256M",
 			}
+		})
+		h.settle()
+
+		Expect(h.statefulSet().Spec.Template.Annotations["checksum/config"]).NotTo(Equal(oldChecksum))
+		for _, pod := range h.pods() {
+			Expect(h.mysql.Node(pod.Name).Variables).To(HaveKeyWithValue("max_connections", "500"))
+		}
+		condition := meta.FindStatusCondition(h.cluster().Status.Conditions, ConditionConfigApplied)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("PendingRestart"))
+
+		h.rolloutPods()
+		h.settle()
+
+		Expect(h.masters()).To(HaveLen(1))
+		h.expectConverged(h.masters()[0])
+		Expect(meta.IsStatusConditionTrue(h.cluster().Status.Conditions, ConditionConfigApplied)).To(BeTrue())
+	})
 
-			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
-				NamespacedName: typeNamespacedName,
-			})
-			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+	It("删除动态参数：恢复成my.cnf中的值，不需要重启", func() {
+		resources := corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+		}
+		h.createCluster(3, func(cluster *dbv1.MysqlCluster) {
+			cluster.Spec.AutoTune = true
+			cluster.Spec.Resources = resources
+			cluster.Spec.MysqlConfig = map[string]string{"max_connections": "300", "wait_timeout": "600"}
 		})
+		h.settle()
+		h.expectConverged(h.podName(0))
+		oldChecksum := h.statefulSet().Spec.Template.Annotations["checksum/config"]
+		Expect(h.cluster().Status.AppliedDynamicVariables).To(Equal([]string{"max_connections", "wait_timeout"}))
+
+		h.updateSpec(func(spec *dbv1.MysqlClusterSpec) { spec.MysqlConfig = nil })
+		h.settle()
+
+		// max_connections恢复成自动调优的值，wait_timeout在my.cnf中没有设置，恢复成默认值
+		autoTuned := autoTuneMysqlConfig(resources)["max_connections"]
+		Expect(autoTuned).NotTo(Equal("300"))
+		for _, pod := range h.pods() {
+			Expect(h.mysql.Node(pod.Name).Variables).To(HaveKeyWithValue("max_connections", autoTuned))
+			Expect(h.mysql.Node(pod.Name).Variables).NotTo(HaveKey("wait_timeout"))
+		}
+		Expect(h.statefulSet().Spec.Template.Annotations["checksum/config"]).To(Equal(oldChecksum))
+
+		cluster := h.cluster()
+		Expect(cluster.Status.AppliedDynamicVariables).To(BeEmpty())
+		Expect(meta.IsStatusConditionTrue(cluster.Status.Conditions, ConditionConfigApplied)).To(BeTrue())
 	})
 })
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	dbv1 "mysql-operator/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// operator管理的部分，用户的podTemplate不允许覆盖
+var (
+	reservedPodLabels      = map[string]bool{"app": true, "role": true, readableLabel: true}
+	reservedPodAnnotations = map[string]bool{"checksum/config": true, "checksum/pod-template": true}
+	reservedContainerNames = map[string]bool{"mysql": true, heartbeatContainerName: true, exporterContainerName: true}
+	reservedVolumeNames    = map[string]bool{"data": true, "config": true, podInfoVolumeName: true}
+	reservedMountPaths     = map[string]bool{"/var/lib/mysql": true, "/mnt/config": true}
+	reservedEnvNames       = map[string]bool{"MYSQL_ROOT_PASSWORD": true, "MYSQL_ROOT_HOST": true}
+)
+
+// 把用户的podTemplate合并到operator生成的模板中
+// 列表按name合并：同名的替换，新的追加在后面，保证operator生成的条目顺序不变
+func applyPodTemplateOverrides(template *corev1.PodTemplateSpec, cluster *dbv1.MysqlCluster) error {
+	overrides := cluster.Spec.PodTemplate
+	if overrides == nil {
+		return nil
+	}
+
+	for key, value := range overrides.Labels {
+		if reservedPodLabels[key] {
+			return fmt.Errorf("podTemplate中的标签'%s'由operator管理，不允许覆盖", key)
+		}
+		if template.Labels == nil {
+			template.Labels = make(map[string]string)
+		}
+		template.Labels[key] = value
+	}
+
+	for key, value := range overrides.Annotations {
+		if reservedPodAnnotations[key] {
+			return fmt.Errorf("podTemplate中的注解'%s'由operator管理，不允许覆盖", key)
+		}
+		if template.Annotations == nil {
+			template.Annotations = make(map[string]string)
+		}
+		template.Annotations[key] = value
+	}
+
+	podSpec := &template.Spec
+
+	for _, container := range append(append([]corev1.Container{}, overrides.InitContainers...), overrides.Containers...) {
+		if reservedContainerNames[container.Name] {
+			return fmt.Errorf("podTemplate中的容器名'%s'由operator使用，请换一个名字", container.Name)
+		}
+	}
+	podSpec.InitContainers = mergeByName(podSpec.InitContainers, overrides.InitContainers, func(c corev1.Container) string { return c.Name })
+	podSpec.Containers = mergeByName(podSpec.Containers, overrides.Containers, func(c corev1.Container) string { return c.Name })
+
+	for _, volume := range overrides.Volumes {
+		if reservedVolumeNames[volume.Name] {
+			return fmt.Errorf("podTemplate中的卷名'%s'由operator使用，请换一个名字", volume.Name)
+		}
+	}
+	podSpec.Volumes = mergeByName(podSpec.Volumes, overrides.Volumes, func(v corev1.Volume) string { return v.Name })
+
+	// 挂载点和环境变量只追加到mysql容器
+	for i := range podSpec.Containers {
+		mysql := &podSpec.Containers[i]
+		if mysql.Name != "mysql" {
+			continue
+		}
+
+		for _, mount := range overrides.VolumeMounts {
+			if reservedVolumeNames[mount.Name] || reservedMountPaths[mount.MountPath] {
+				return fmt.Errorf("podTemplate中的挂载'%s:%s'与operator的挂载冲突", mount.Name, mount.MountPath)
+			}
+		}
+		mysql.VolumeMounts = mergeByName(mysql.VolumeMounts, overrides.VolumeMounts, func(m corev1.VolumeMount) string { return m.MountPath })
+
+		for _, env := range overrides.Env {
+			if reservedEnvNames[env.Name] {
+				return fmt.Errorf("podTemplate中的环境变量'%s'由operator管理，不允许覆盖", env.Name)
+			}
+		}
+		mysql.Env = mergeByName(mysql.Env, overrides.Env, func(e corev1.EnvVar) string { return e.Name })
+	}
+
+	return nil
+}
+
+// 按key合并两个列表，overrides中同key的条目替换base中的，其余追加
+func mergeByName[T any](base, overrides []T, key func(T) string) []T {
+	if len(overrides) == 0 {
+		return base
+	}
+
+	merged := append([]T{}, base...)
+	index := make(map[string]int, len(merged))
+	for i, item := range merged {
+		index[key(item)] = i
+	}
+
+	for _, item := range overrides {
+		if i, ok := index[key(item)]; ok {
+			merged[i] = item
+			continue
+		}
+		index[key(item)] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// 计算podTemplate的哈希，记录在statefulset模板的注解上，变化时整体重新生成模板
+// 这样用户删掉sidecar或卷时也能同步，而不需要对比被api-server填充过默认值的模板
+// operator生成的可选sidecar也会改变模板，它们的配置一并计入，没有开启时不参与计算，开启或关闭sidecar不会影响其他集群的哈希
+// 注意旧版本创建的statefulset模板上没有这个注解，升级operator后第一次调谐会整体替换模板，触发一次滚动重启（见README的升级说明）
+func computePodTemplateHash(cluster *dbv1.MysqlCluster) (string, error) {
+	hash := sha256.New()
+
+	sources := []interface{}{cluster.Spec.PodTemplate}
+	// 计入心跳容器本身，修改sidecar的写入条件后已有的集群也会滚动更新
+	if cluster.Spec.Heartbeat != nil {
+		sources = append(sources, heartbeatContainer(cluster))
+	}
+	// 只计入exporter容器本身，修改serviceMonitor的配置不需要重启pod
+	if cluster.Spec.Monitoring != nil {
+		sources = append(sources, mysqldExporterContainer(cluster))
+	}
+
+	for _, source := range sources {
+		dataBytes, err := json.Marshal(source)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(dataBytes)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("podTemplate合并", func() {
+
+	newTemplate := func() *corev1.PodTemplateSpec {
+		return &corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "mysql",
+						Env:  []corev1.EnvVar{{Name: "MYSQL_ROOT_HOST", Value: "%"}},
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "data", MountPath: "/var/lib/mysql"},
+						},
+					},
+				},
+				Volumes: []corev1.Volume{{Name: "config"}},
+			},
+		}
+	}
+
+	It("追加sidecar、卷、挂载点和环境变量", func() {
+		template := newTemplate()
+		cluster := &dbv1.MysqlCluster{Spec: dbv1.MysqlClusterSpec{
+			PodTemplate: &dbv1.PodTemplateOverrides{
+				Labels:       map[string]string{"team": "db"},
+				Containers:   []corev1.Container{{Name: "fluent-bit", Image: "fluent/fluent-bit"}},
+				Volumes:      []corev1.Volume{{Name: "extra"}},
+				VolumeMounts: []corev1.VolumeMount{{Name: "extra", MountPath: "/etc/extra"}},
+				Env:          []corev1.EnvVar{{Name: "TZ", Value: "Asia/Shanghai"}},
+			},
+		}}
+
+		Expect(applyPodTemplateOverrides(template, cluster)).To(Succeed())
+		Expect(template.Labels).To(HaveKeyWithValue("team", "db"))
+		Expect(template.Spec.Containers).To(HaveLen(2))
+		Expect(template.Spec.Containers[0].Name).To(Equal("mysql"))
+		Expect(template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "TZ", Value: "Asia/Shanghai"}))
+		Expect(template.Spec.Containers[0].VolumeMounts).To(HaveLen(2))
+		Expect(template.Spec.Volumes).To(HaveLen(2))
+	})
+
+	It("同名的条目以用户为准", func() {
+		base := []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}}
+		merged := mergeByName(base, []corev1.EnvVar{{Name: "B", Value: "3"}, {Name: "C", Value: "4"}}, func(e corev1.EnvVar) string { return e.Name })
+		Expect(merged).To(Equal([]corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "3"}, {Name: "C", Value: "4"}}))
+		Expect(base[1].Value).To(Equal("2"))
+	})
+
+	DescribeTable("拒绝覆盖operator管理的部分",
+		func(overrides *dbv1.PodTemplateOverrides) {
+			cluster := &dbv1.MysqlCluster{Spec: dbv1.MysqlClusterSpec{PodTemplate: overrides}}
+			Expect(applyPodTemplateOverrides(newTemplate(), cluster)).NotTo(Succeed())
+		},
+		Entry("app标签", &dbv1.PodTemplateOverrides{Labels: map[string]string{"app": "other"}}),
+		Entry("mysql容器", &dbv1.PodTemplateOverrides{Containers: []corev1.Container{{Name: "mysql"}}}),
+		Entry("data卷", &dbv1.PodTemplateOverrides{Volumes: []corev1.Volume{{Name: "data"}}}),
+		Entry("数据目录", &dbv1.PodTemplateOverrides{VolumeMounts: []corev1.VolumeMount{{Name: "x", MountPath: "/var/lib/mysql"}}}),
+		Entry("root密码", &dbv1.PodTemplateOverrides{Env: []corev1.EnvVar{{Name: "MYSQL_ROOT_PASSWORD", Value: "x"}}}),
+	)
+})
@@ -2,16 +2,19 @@ package controller
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 
 	dbv1 "mysql-operator/api/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 // 数据库内部设置修正
 func (r *MysqlClusterReconciler) reconcileDatabaseSettings(ctx context.Context, snapshot *ClusterSnapshot, cluster *dbv1.MysqlCluster) error {
+	logger := log.FromContext(ctx)
 
 	var targetMasterNode *PodInfo
 	for _, node := range snapshot.Pods {
@@ -27,7 +30,7 @@ func (r *MysqlClusterReconciler) reconcileDatabaseSettings(ctx context.Context,
 
 	// master的无头服务
 
-	masterHost := fmt.Sprintf("%s.%s-svc-headless.%s", targetMasterNode.Pod.Name, cluster.Name, cluster.Namespace)
+	masterHost := replicationMasterHost(cluster, targetMasterNode.Pod.Name)
 
 	var wg sync.WaitGroup
 
@@ -44,30 +47,47 @@ func (r *MysqlClusterReconciler) reconcileDatabaseSettings(ctx context.Context,
 		go func(p *PodInfo) {
 			defer wg.Done()
 
-			dsn := fmt.Sprintf("root:%s@tcp(%s:3306)/mysql?timeout=1s&readTimeout=3s&parseTime=true&interpolateParams=true", snapshot.RootPassword, p.Pod.Status.PodIP)
-			db, err := sql.Open("mysql", dsn)
+			db, err := r.Mysql.Connect(ctx, p.Pod, snapshot.RootPassword)
 			if err != nil {
-				errChan <- fmt.Errorf("9.dsn格式错误或驱动未加载: %w", err)
-				return
-			}
-			defer db.Close()
-
-			if err := db.PingContext(ctx); err != nil {
+				recordConnectionError(p)
 				errChan <- fmt.Errorf("9.节点%s无法连接: %w", p.Pod.Name, err)
 				return
 			}
+			defer db.Close()
 
 			// 根据期望的角色执行配置
 			if p.Role == "master" {
 				err = r.configureMaster(ctx, db, p.Pod.Name)
+
+				// 心跳表建在主库上，随复制同步到从库，失败只记录日志，下一轮再试
+				if err == nil && cluster.Spec.Heartbeat != nil {
+					if hbErr := db.EnsureHeartbeatTable(ctx); hbErr != nil {
+						logger.Info("9.1主库创建心跳表失败", "pod名字", p.Pod.Name, "err", hbErr)
+					}
+				}
 			}
 			if p.Role == "slave" {
 				// slave节点需要知道master的地址和复制账号密码
-				err = r.configureSlave(ctx, db, p.Pod.Name, masterHost, snapshot.ReplPassword)
+				var reconfigured bool
+				reconfigured, err = r.configureSlave(ctx, db, p.Pod.Name, masterHost, snapshot.ReplPassword)
+				if reconfigured {
+					r.recordNormal(cluster, EventReasonReplicationConfigured, "从库%s已重新指向主库%s", p.Pod.Name, targetMasterNode.Pod.Name)
+				}
 			}
 
 			if err != nil {
 				errChan <- fmt.Errorf("9.配置%s数据库内部参数失败: %w", p.Pod.Name, err)
+				return
+			}
+
+			// 动态参数在线生效，失败不影响主从配置，记录到快照中，ConfigApplied显示为ApplyFailed
+			err = errors.Join(
+				r.applyDynamicVariables(ctx, db, p.Pod.Name, snapshot.DynamicConfig),
+				r.revertDynamicVariables(ctx, db, p.Pod.Name, snapshot.RevertConfig),
+			)
+			if err != nil {
+				logger.Info("9.动态参数生效失败", "pod名字", p.Pod.Name, "err", err)
+				p.ConfigApplyError = err.Error()
 			}
 
 		}(pod)
@@ -81,48 +101,89 @@ func (r *MysqlClusterReconciler) reconcileDatabaseSettings(ctx context.Context,
 		return <-errChan
 	}
 
+	// 所有节点都恢复了删除的参数，才能从status中去掉，否则下一轮继续恢复
+	allReverted := true
+	for _, pod := range snapshot.Pods {
+		if !pod.IsConnectable || pod.ConfigApplyError != "" {
+			allReverted = false
+		}
+	}
+	if allReverted {
+		snapshot.AppliedVariables = appliedMysqlVariables(snapshot.DynamicConfig)
+	}
+
 	return nil
 }
 
 // 配置主库
-func (r *MysqlClusterReconciler) configureMaster(ctx context.Context, db *sql.DB, podName string) error {
+func (r *MysqlClusterReconciler) configureMaster(ctx context.Context, db MysqlNode, podName string) error {
 	// 设置为可读写
-	if _, err := db.ExecContext(ctx, "SET GLOBAL read_only=0"); err != nil {
+	if err := db.SetReadOnly(ctx, false); err != nil {
 		return fmt.Errorf("9.1主库节点%s配置可读写失败: %w", podName, err)
 	}
 
 	// 如果该节点之前是slave，现在变成了master，需要停止它之前的同步任务
-	if _, err := db.ExecContext(ctx, "STOP SLAVE"); err != nil {
+	if err := db.StopSlave(ctx); err != nil {
 		// 忽略错误，可能本来就没启动
 	}
 	// 清除同步配置，防止它连接旧的主库
-	if _, err := db.ExecContext(ctx, "RESET SLAVE ALL"); err != nil {
+	if err := db.ResetSlaveAll(ctx); err != nil {
 		return fmt.Errorf("9.1主库节点%s清除同步配置失败: %w", podName, err)
 	}
 
 	return nil
 }
 
-// 配置从库
-func (r *MysqlClusterReconciler) configureSlave(ctx context.Context, db *sql.DB, podName, masterHost, replPwd string) error {
+// 可用节点不足时第8步返回ErrHA，走不到上面的主从配置
+// 开启心跳时节点启动时只读，唯一的主库重启后会一直不可写，所以在这里只打开它的写入，不改动复制配置
+func (r *MysqlClusterReconciler) ensureLoneMasterWritable(ctx context.Context, snapshot *ClusterSnapshot) error {
+	var masters []*PodInfo
+	for _, node := range snapshot.Pods {
+		if node.Role == "master" {
+			masters = append(masters, node)
+		}
+	}
+
+	// 还配置着复制的说明没有完成提升，保持只读
+	if len(masters) != 1 || !masters[0].IsConnectable || masters[0].Replication != nil {
+		return nil
+	}
+	master := masters[0]
+
+	db, err := r.Mysql.Connect(ctx, master.Pod, snapshot.RootPassword)
+	if err != nil {
+		recordConnectionError(master)
+		return fmt.Errorf("8.5主库节点%s无法连接: %w", master.Pod.Name, err)
+	}
+	defer db.Close()
+
+	if err := db.SetReadOnly(ctx, false); err != nil {
+		return fmt.Errorf("8.5主库节点%s配置可读写失败: %w", master.Pod.Name, err)
+	}
+
+	return nil
+}
+
+// 配置从库，返回值bool表示是否重新配置了复制
+func (r *MysqlClusterReconciler) configureSlave(ctx context.Context, db MysqlNode, podName, masterHost, replPwd string) (bool, error) {
 
 	// 设置为只读
-	if _, err := db.ExecContext(ctx, "SET GLOBAL read_only=1"); err != nil {
-		return fmt.Errorf("9.2从库节点%s配置只读失败: %w", podName, err)
+	if err := db.SetReadOnly(ctx, true); err != nil {
+		return false, fmt.Errorf("9.2从库节点%s配置只读失败: %w", podName, err)
 	}
 
 	// 幂等性检查：检查当前是否已经正常同步且Master地址正确
 	isConfigured, err := r.isReplicatingCorrectly(ctx, db, masterHost)
 	if err != nil {
-		return fmt.Errorf("9.2从库节点%s检查数据库同步状态失败: %w", podName, err)
+		return false, fmt.Errorf("9.2从库节点%s检查数据库同步状态失败: %w", podName, err)
 	}
 	if isConfigured {
-		return nil
+		return false, nil
 	}
 
 	// 停止同步
-	if _, err := db.ExecContext(ctx, "STOP SLAVE"); err != nil {
-		return fmt.Errorf("9.2从库节点%s停止同步失败: %w", podName, err)
+	if err := db.StopSlave(ctx); err != nil {
+		return false, fmt.Errorf("9.2从库节点%s停止同步失败: %w", podName, err)
 	}
 
 	// 这部分逻辑取消掉，只要在reconcileUserForPod里开启SET SESSION sql_log_bin = 0
@@ -141,76 +202,41 @@ func (r *MysqlClusterReconciler) configureSlave(ctx context.Context, db *sql.DB,
 	//}
 
 	// 清除旧的同步连接参数
-	if _, err := db.ExecContext(ctx, "RESET SLAVE ALL"); err != nil {
-		return fmt.Errorf("9.2从库节点%s清除同步参数失败: %w", podName, err)
+	if err := db.ResetSlaveAll(ctx); err != nil {
+		return false, fmt.Errorf("9.2从库节点%s清除同步参数失败: %w", podName, err)
 	}
 
 	// 配置同步源
-
-	changeMasterSQL := fmt.Sprintf(`
-		CHANGE MASTER TO 
-		MASTER_HOST='%s', 
-		MASTER_USER='repl', 
-		MASTER_PASSWORD='%s', 
-		MASTER_PORT=3306, 
-		MASTER_CONNECT_RETRY=10, 
-		MASTER_AUTO_POSITION=1;
-	`, masterHost, replPwd)
-
-	if _, err := db.ExecContext(ctx, changeMasterSQL); err != nil {
-		return fmt.Errorf("9.2从库节点%s配置同步源失败: %w", podName, err)
+	if err := db.ChangeMaster(ctx, masterHost, ReplUser, replPwd); err != nil {
+		return false, fmt.Errorf("9.2从库节点%s配置同步源失败: %w", podName, err)
 	}
 
 	// 启动同步
-	if _, err := db.ExecContext(ctx, "START SLAVE"); err != nil {
-		return fmt.Errorf("9.2从库节点%s启动同步失败: %w", podName, err)
+	if err := db.StartSlave(ctx); err != nil {
+		return false, fmt.Errorf("9.2从库节点%s启动同步失败: %w", podName, err)
 	}
 
-	return nil
+	return true, nil
+}
+
+// 从库CHANGE MASTER时使用的主库地址，即主库pod在无头服务下的域名
+func replicationMasterHost(cluster *dbv1.MysqlCluster, masterPodName string) string {
+	return fmt.Sprintf("%s.%s-svc-headless.%s", masterPodName, cluster.Name, cluster.Namespace)
 }
 
 // 辅助函数：检查slave状态
-func (r *MysqlClusterReconciler) isReplicatingCorrectly(ctx context.Context, db *sql.DB, targetMasterHost string) (bool, error) {
+func (r *MysqlClusterReconciler) isReplicatingCorrectly(ctx context.Context, db MysqlNode, targetMasterHost string) (bool, error) {
 
-	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	statusMap, err := db.SlaveStatus(ctx)
 	if err != nil {
 		return false, err
 	}
-	defer rows.Close()
 
-	if !rows.Next() {
+	if statusMap == nil {
 		// 如果为空，说明还没有配置过slave
 		return false, nil
 	}
 
-	// 获取列名，以便扫描，因为不同列的顺序可能会变
-	columns, err := rows.Columns()
-	if err != nil {
-		return false, err
-	}
-
-	// 创建一个 map 来存储列值
-	values := make([]interface{}, len(columns))
-	scanArgs := make([]interface{}, len(columns))
-	for i := range values {
-		scanArgs[i] = &values[i]
-	}
-
-	if err := rows.Scan(scanArgs...); err != nil {
-		return false, err
-	}
-
-	// 将结果解析为 Map 方便查找
-	statusMap := make(map[string]string)
-	for i, colName := range columns {
-		val := values[i]
-		if b, ok := val.([]byte); ok {
-			statusMap[colName] = string(b)
-		} else {
-			statusMap[colName] = ""
-		}
-	}
-
 	// 检查逻辑：
 	// I/O线程必须是Yes
 	// SQL线程必须是Yes
@@ -227,3 +253,50 @@ func (r *MysqlClusterReconciler) isReplicatingCorrectly(ctx context.Context, db
 
 	return false, nil
 }
+
+// 通过SET GLOBAL让动态参数在线生效，my.cnf里也有同样的值，pod重启后依然有效
+// mysql5.7没有SET PERSIST，所以以configMap为准，这里只修正运行时的值
+func (r *MysqlClusterReconciler) applyDynamicVariables(ctx context.Context, db MysqlNode, podName string, variables map[string]string) error {
+
+	var errs []error
+	for name, value := range variables {
+
+		// 变量名来自白名单
+		// 部分变量（如文件路径）可能是NULL
+		current, valid, err := db.GlobalVariable(ctx, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("9.3节点%s查询变量%s失败: %w", podName, name, err))
+			continue
+		}
+
+		if valid && mysqlVariableEqual(current, value) {
+			continue
+		}
+
+		if err := db.SetGlobalVariable(ctx, name, mysqlVariableValue(value)); err != nil {
+			errs = append(errs, fmt.Errorf("9.3节点%s设置变量%s=%s失败: %w", podName, name, value, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// 恢复已经从spec中删除的动态参数，my.cnf中有值时设置成该值，否则恢复成mysqld的默认值
+// 只在status.appliedDynamicVariables中还有这些参数时执行，DEFAULT无法和当前值比较，所以直接设置
+func (r *MysqlClusterReconciler) revertDynamicVariables(ctx context.Context, db MysqlNode, podName string, variables map[string]string) error {
+
+	var errs []error
+	configured := make(map[string]string)
+	for name, value := range variables {
+		if value != "" {
+			configured[name] = value
+			continue
+		}
+		if err := db.ResetGlobalVariable(ctx, name); err != nil {
+			errs = append(errs, fmt.Errorf("9.3节点%s恢复变量%s的默认值失败: %w", podName, name, err))
+		}
+	}
+
+	errs = append(errs, r.applyDynamicVariables(ctx, db, podName, configured))
+	return errors.Join(errs...)
+}
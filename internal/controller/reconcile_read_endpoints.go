@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	dbv1 "mysql-operator/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 读服务（-svc-slave）按这个标签选择pod，由operator根据复制状态维护
+const readableLabel = "readable"
+
+// 读服务允许的最大复制延迟（秒）：readService.maxLagSeconds > maxReplicationLagSeconds > 默认值
+func readMaxLagSeconds(cluster *dbv1.MysqlCluster) int64 {
+	if cluster.Spec.ReadService != nil && cluster.Spec.ReadService.MaxLagSeconds != nil {
+		return int64(*cluster.Spec.ReadService.MaxLagSeconds)
+	}
+	if cluster.Spec.MaxReplicationLagSeconds != nil {
+		return int64(*cluster.Spec.MaxReplicationLagSeconds)
+	}
+	return defaultMaxReplicationLagSeconds
+}
+
+// 没有可读的从库时是否把主库加入读服务，默认开启
+func readFallbackToMaster(cluster *dbv1.MysqlCluster) bool {
+	if cluster.Spec.ReadService != nil && cluster.Spec.ReadService.FallbackToMaster != nil {
+		return *cluster.Spec.ReadService.FallbackToMaster
+	}
+	return true
+}
+
+// 计算每个pod是否可以承接读流量，key为pod名字
+// 从库：ready、可连接、复制线程在运行、指向当前主库、延迟已知且在阈值以内
+// 主库：只有开启了回退且没有任何可读的从库时才可读
+func desiredReadablePods(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) map[string]bool {
+	readable := make(map[string]bool, len(snapshot.Pods))
+
+	var master *PodInfo
+	for _, pod := range snapshot.Pods {
+		if pod.Role == "master" && pod.IsConnectable {
+			master = pod
+		}
+	}
+
+	maxLag := readMaxLagSeconds(cluster)
+	anySlave := false
+
+	for _, pod := range snapshot.Pods {
+		readable[pod.Pod.Name] = false
+
+		if pod.Role != "slave" || !pod.IsReady || !pod.IsConnectable || master == nil {
+			continue
+		}
+
+		status := pod.Replication
+		if status == nil || !status.Running() || status.MasterHost != replicationMasterHost(cluster, master.Pod.Name) {
+			continue
+		}
+
+		lag, ok := status.Lag()
+		if !ok || lag.Seconds() > float64(maxLag) {
+			continue
+		}
+
+		readable[pod.Pod.Name] = true
+		anySlave = true
+	}
+
+	if master != nil && !anySlave && readFallbackToMaster(cluster) {
+		readable[master.Pod.Name] = true
+	}
+
+	return readable
+}
+
+// 给pod打上readable标签，然后确保读服务按readable选择pod
+// 先打标签再切换selector，升级operator时读服务不会出现没有endpoint的空窗
+func (r *MysqlClusterReconciler) reconcileReadEndpoints(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) error {
+	logger := log.FromContext(ctx)
+
+	readable := desiredReadablePods(cluster, snapshot)
+
+	for _, pod := range snapshot.Pods {
+		desired := "false"
+		if readable[pod.Pod.Name] {
+			desired = "true"
+		}
+
+		if pod.Pod.Labels[readableLabel] == desired {
+			continue
+		}
+
+		patch := client.MergeFrom(pod.Pod.DeepCopy())
+		pod.Pod.Labels[readableLabel] = desired
+		if err := r.Patch(ctx, pod.Pod, patch); err != nil {
+			return fmt.Errorf("9.4给节点%s打readable标签失败: %w", pod.Pod.Name, err)
+		}
+		logger.Info("9.4已更新readable标签", "pod名字", pod.Pod.Name, "readable", desired, "role", pod.Role)
+	}
+
+	// 旧版本创建的读服务按role=slave选择pod，标签打好后再切换
+	service := &corev1.Service{}
+	serviceName := fmt.Sprintf("%s-svc-slave", cluster.Name)
+	if err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: serviceName}, service); err != nil {
+		return fmt.Errorf("9.4获取%s失败: %w", serviceName, err)
+	}
+
+	desiredSelector := serviceSelector("slave", cluster)
+	if !equality.Semantic.DeepEqual(service.Spec.Selector, desiredSelector) {
+		service.Spec.Selector = desiredSelector
+		if err := r.Update(ctx, service); err != nil {
+			return fmt.Errorf("9.4更新%s的selector失败: %w", serviceName, err)
+		}
+		logger.Info("9.4读服务改为按readable标签选择pod", "service", serviceName)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("读服务endpoint", func() {
+
+	var cluster *dbv1.MysqlCluster
+	masterHost := "test-cluster-0.test-cluster-svc-headless.default"
+
+	BeforeEach(func() {
+		cluster = &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+	})
+
+	node := func(name, role string, lag *int64) *PodInfo {
+		pod := &PodInfo{
+			Pod:           &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}},
+			Role:          role,
+			IsReady:       true,
+			IsConnectable: true,
+		}
+		if role == "slave" {
+			pod.Replication = &ReplicationStatus{MasterHost: masterHost, IORunning: "Yes", SQLRunning: "Yes", SecondsBehindMaster: lag}
+		}
+		return pod
+	}
+
+	It("开启心跳时按第7步算出的心跳延迟判断，而不是Seconds_Behind_Master", func() {
+		cluster.Spec.Heartbeat = &dbv1.HeartbeatConfig{IntervalSeconds: 1}
+		now := time.Now()
+
+		master := node("test-cluster-0", "master", nil)
+		master.Heartbeat = &HeartbeatInfo{Latest: now, Age: 100 * time.Millisecond}
+		// io线程卡住时Seconds_Behind_Master显示为0，心跳落后了一分钟
+		stuck := node("test-cluster-1", "slave", ptr.To(int64(0)))
+		stuck.Heartbeat = &HeartbeatInfo{Latest: now.Add(-time.Minute)}
+		healthy := node("test-cluster-2", "slave", ptr.To(int64(0)))
+		healthy.Heartbeat = &HeartbeatInfo{Latest: now}
+
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{master, stuck, healthy}}
+		updateHeartbeatLag(cluster, snapshot)
+
+		Expect(*stuck.Replication.HeartbeatLag).To(Equal(time.Minute))
+		Expect(desiredReadablePods(cluster, snapshot)).To(Equal(map[string]bool{
+			"test-cluster-0": false,
+			"test-cluster-1": false,
+			"test-cluster-2": true,
+		}))
+	})
+
+	It("只有延迟在阈值以内的从库可读", func() {
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			node("test-cluster-0", "master", nil),
+			node("test-cluster-1", "slave", ptr.To(int64(2))),
+			node("test-cluster-2", "slave", ptr.To(int64(120))),
+		}}
+
+		Expect(desiredReadablePods(cluster, snapshot)).To(Equal(map[string]bool{
+			"test-cluster-0": false,
+			"test-cluster-1": true,
+			"test-cluster-2": false,
+		}))
+	})
+
+	It("阈值优先使用readService的配置", func() {
+		cluster.Spec.MaxReplicationLagSeconds = ptr.To(int32(300))
+		cluster.Spec.ReadService = &dbv1.ReadServiceConfig{MaxLagSeconds: ptr.To(int32(1))}
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{
+			node("test-cluster-0", "master", nil),
+			node("test-cluster-1", "slave", ptr.To(int64(2))),
+		}}
+
+		Expect(desiredReadablePods(cluster, snapshot)["test-cluster-1"]).To(BeFalse())
+	})
+
+	It("没有可读的从库时回退到主库，可以关闭", func() {
+		broken := node("test-cluster-1", "slave", nil)
+		broken.Replication.SQLRunning = "No"
+		snapshot := &ClusterSnapshot{Pods: []*PodInfo{node("test-cluster-0", "master", nil), broken}}
+
+		Expect(desiredReadablePods(cluster, snapshot)).To(Equal(map[string]bool{
+			"test-cluster-0": true,
+			"test-cluster-1": false,
+		}))
+
+		cluster.Spec.ReadService = &dbv1.ReadServiceConfig{FallbackToMaster: ptr.To(false)}
+		Expect(desiredReadablePods(cluster, snapshot)["test-cluster-0"]).To(BeFalse())
+	})
+
+	It("读服务按readable标签选择pod", func() {
+		Expect(serviceSelector("slave", cluster)).To(Equal(map[string]string{"app": "test-cluster", "readable": "true"}))
+		Expect(serviceSelector("master", cluster)).To(Equal(map[string]string{"app": "test-cluster", "role": "master"}))
+		Expect(serviceSelector("headless", cluster)).To(Equal(map[string]string{"app": "test-cluster"}))
+	})
+})
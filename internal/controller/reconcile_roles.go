@@ -5,6 +5,10 @@ import (
 	"fmt"
 
 	"errors"
+	"strings"
+	"time"
+
+	dbv1 "mysql-operator/api/v1"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -14,7 +18,7 @@ import (
 var ErrHA = errors.New("集群可用节点数量不足")
 
 // 返回值bool表示是否执行了patch操作
-func (r *MysqlClusterReconciler) reconcileRoles(ctx context.Context, snapshot *ClusterSnapshot) (bool, error) {
+func (r *MysqlClusterReconciler) reconcileRoles(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) (bool, error) {
 
 	logger := log.FromContext(ctx)
 
@@ -40,12 +44,33 @@ func (r *MysqlClusterReconciler) reconcileRoles(ctx context.Context, snapshot *C
 	var targetMaster *PodInfo
 	needElection := false
 
+	// 记录切换原因和耗时，用于指标
+	electionStart := time.Now()
+	failoverReason := ""
+
+	// gtid一样新时优先选择的可用区：用户指定的主可用区，否则是故障主库所在的可用区
+	preferredZone := cluster.Spec.PrimaryZone
+
+	// 被替换的主库，用于事件
+	oldMaster := ""
+
+	// 旧主库挂掉后查不到gtid，用之前记下的值估算丢失的事务
+	lastKnown := lastKnownMaster(cluster)
+
 	switch len(currentMasters) {
 
 	// 情况1: 无主，必须重选
 	case 0:
 		logger.Info("8.无主库，启动选举流程")
 		needElection = true
+		failoverReason = "no_master"
+		if cluster.Status.Phase == dbv1.MysqlClusterPhaseInitializing || cluster.Status.Phase == dbv1.MysqlClusterPhasePending {
+			failoverReason = "bootstrap"
+		}
+		// 主库pod被删除重建后没有标签，按之前记下的主库找故障的可用区
+		if preferredZone == "" {
+			preferredZone = lastMasterZone(cluster, snapshot, lastKnown)
+		}
 
 	// 情况2: 单主，检查现任健康状况
 	case 1:
@@ -55,45 +80,66 @@ func (r *MysqlClusterReconciler) reconcileRoles(ctx context.Context, snapshot *C
 		// 即使别的节点gtid追上来了也不换，避免因网络问题导致主库反复横跳
 		if existingMaster.IsReady && existingMaster.IsConnectable {
 			targetMaster = existingMaster
+
+			// 主库所在节点被cordon，说明即将排水，趁主库还健康时做计划内切换，避免被驱逐后再被动选主
+			if existingMaster.NodeUnschedulable {
+				successor := pickSwitchoverTarget(candidates, existingMaster, preferredZone)
+				if successor == nil {
+					logger.Info("8.主库所在节点被cordon，但没有可切换的目标，保持现状", "当前主库名字", existingMaster.Pod.Name)
+					break
+				}
+
+				logger.Info("8.主库所在节点被cordon，启动计划内切换", "当前主库名字", existingMaster.Pod.Name, "目标", successor.Pod.Name)
+				gtid, err := r.switchoverMaster(ctx, existingMaster, successor, snapshot.RootPassword)
+				if err != nil {
+					r.recordWarning(cluster, EventReasonSwitchoverFailed, "主库%s所在节点被cordon，切换到%s失败: %v", existingMaster.Pod.Name, successor.Pod.Name, err)
+					return false, err
+				}
+				// 新主已经追平旧主冻结时的gtid，快照中的值是切换前查的，已经过时
+				successor.GTID = gtid
+				r.recordNormal(cluster, EventReasonSwitchoverCompleted, "主库%s所在节点被cordon，已切换到%s（gtid: %s）", existingMaster.Pod.Name, successor.Pod.Name, successor.GTID)
+				targetMaster = successor
+				oldMaster = existingMaster.Pod.Name
+				failoverReason = "switchover"
+			}
 		} else {
 			logger.Info("8.当前主库不健康，启动选举流程", "当前主库名字", existingMaster.Pod.Name)
 			needElection = true
+			failoverReason = "master_unhealthy"
+			oldMaster = existingMaster.Pod.Name
+			if preferredZone == "" {
+				preferredZone = existingMaster.Zone
+			}
 		}
 
 	// 情况3: 脑裂，必须重选
 	default:
 		logger.Info("8.脑裂发生，启动选举流程", "当前主库数量", len(currentMasters))
 		needElection = true
+		failoverReason = "split_brain"
+
+		var names []string
+		for _, master := range currentMasters {
+			names = append(names, master.Pod.Name)
+		}
+		oldMaster = strings.Join(names, ",")
+		// 多个主库中只有之前记下的那个是真正的主库
+		if preferredZone == "" {
+			preferredZone = lastMasterZone(cluster, snapshot, lastKnown)
+		}
+		r.recordWarning(cluster, EventReasonSplitBrainDetected, "检测到%d个主库: %s，重新选主", len(currentMasters), oldMaster)
 	}
 
 	// 执行选举算法
 	if needElection {
+		targetMaster = pickBestCandidate(candidates, preferredZone)
+		logger.Info("8.已选出新主", "pod名字", targetMaster.Pod.Name, "gtid", targetMaster.GTID, "可用区", targetMaster.Zone)
 
-		// 候选人candidates已经是按podName排序的
-		// 逻辑：默认第一个是最佳，后面只有gtid严格大于它才能篡位。
-		best := candidates[0]
-		for i := 1; i < len(candidates); i++ {
-			challenger := candidates[i]
-
-			lenChallenger := len(challenger.GTID)
-			lenBest := len(best.GTID)
-
-			// 先比较gtid长度
-			if lenChallenger > lenBest {
-				best = challenger
-				continue
-			}
-
-			// 长度相等时，比较字典序
-			if lenChallenger == lenBest {
-				if challenger.GTID > best.GTID {
-					best = challenger
-				}
-			}
-
+		oldMasterDisplay := oldMaster
+		if oldMasterDisplay == "" {
+			oldMasterDisplay = "无"
 		}
-		targetMaster = best
-		logger.Info("8.已选出新主", "pod名字", targetMaster.Pod.Name, "gtid", targetMaster.GTID)
+		r.recordNormal(cluster, EventReasonMasterElected, "新主库%s（gtid: %s），旧主库%s，原因%s", targetMaster.Pod.Name, targetMaster.GTID, oldMasterDisplay, failoverReason)
 	}
 
 	// 打标签
@@ -117,9 +163,97 @@ func (r *MysqlClusterReconciler) reconcileRoles(ctx context.Context, snapshot *C
 				return false, fmt.Errorf("8.给节点%s打标签失败: %w", pod.Pod.Name, err)
 			}
 			logger.Info("8.已打标签", "pod名字", pod.Pod.Name, "from", pod.Role, "to", desiredRole)
+			r.recordNormal(cluster, EventReasonRoleLabelPatched, "节点%s的角色从%q变为%q", pod.Pod.Name, pod.Role, desiredRole)
 			patched = true
 		}
 	}
 
+	if patched && failoverReason != "" {
+		snapshot.FailoverReason = failoverReason
+		if failoverReason != "bootstrap" {
+			snapshot.FailoverRecord = buildFailoverRecord(failoverReason, currentMasters, lastKnown, targetMaster, electionStart)
+		}
+		failoversTotal.WithLabelValues(cluster.Namespace, cluster.Name, failoverReason).Inc()
+		electionDurationSeconds.WithLabelValues(cluster.Namespace, cluster.Name).Observe(time.Since(electionStart).Seconds())
+	}
+
+	if targetMaster.IsConnectable {
+		rememberMaster(cluster, snapshot, targetMaster)
+	}
+
 	return patched, nil
 }
+
+// 选举算法，candidates不能为空
+// 数据优先：选gtid集合包含其他所有候选人的节点，没有这样的节点时（gtid分叉）选缺少的事务最少的节点
+// 缺少的事务一样多的候选人中再优先选择preferredZone里的节点
+func pickBestCandidate(candidates []*PodInfo, preferredZone string) *PodInfo {
+
+	// 所有候选人的gtid并集，每个候选人缺少的事务数 = 并集 - 自己的集合
+	// 解析失败的gtid当作空集合，只有其他候选人也都是空的时候才可能当选
+	sets := make([]gtidSet, len(candidates))
+	all := make(gtidSet)
+	for i, node := range candidates {
+		set, err := parseGTIDSet(node.GTID)
+		if err != nil {
+			set = make(gtidSet)
+		}
+		sets[i] = set
+		all = all.union(set)
+	}
+
+	// 候选人candidates已经是按podName排序的
+	// 逻辑：默认第一个是最佳，后面只有缺少的事务更少，或者一样多但在preferredZone里才能篡位
+	best := candidates[0]
+	bestMissing := all.subtract(sets[0]).count()
+	for i := 1; i < len(candidates); i++ {
+		challenger := candidates[i]
+		missing := all.subtract(sets[i]).count()
+
+		if missing < bestMissing ||
+			(missing == bestMissing && preferredZone != "" && best.Zone != preferredZone && challenger.Zone == preferredZone) {
+			best = challenger
+			bestMissing = missing
+		}
+	}
+
+	return best
+}
+
+// 之前的主库所在的可用区，优先使用status中记录的值，主库pod被删除重建后可能已经调度到别的可用区
+func lastMasterZone(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot, lastKnown *knownMaster) string {
+	if lastKnown == nil {
+		return ""
+	}
+	for _, pod := range cluster.Status.Pods {
+		if pod.Name == lastKnown.Name && pod.Zone != "" {
+			return pod.Zone
+		}
+	}
+	for _, pod := range snapshot.Pods {
+		if pod.Pod.Name == lastKnown.Name {
+			return pod.Zone
+		}
+	}
+	return ""
+}
+
+// 计划内切换的目标：排除现任主库和同样被cordon的节点，剩下的按选举算法挑选
+func pickSwitchoverTarget(candidates []*PodInfo, currentMaster *PodInfo, preferredZone string) *PodInfo {
+	var eligible []*PodInfo
+	for _, node := range candidates {
+		if node == currentMaster || node.NodeUnschedulable {
+			continue
+		}
+		eligible = append(eligible, node)
+	}
+
+	if len(eligible) == 0 {
+		return nil
+	}
+	// 计划内切换没有指定主可用区时，留在旧主的可用区，避免跨区流量
+	if preferredZone == "" {
+		preferredZone = currentMaster.Zone
+	}
+	return pickBestCandidate(eligible, preferredZone)
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+const uuidC = "5a33ac69-93ec-33a3-ba55-ea2cc1641784"
+
+// 候选人按名字排序，和快照中的顺序一致
+type candidate struct {
+	name string
+	gtid string
+	zone string
+}
+
+func candidatePods(candidates []candidate) []*PodInfo {
+	var pods []*PodInfo
+	for _, c := range candidates {
+		pods = append(pods, &PodInfo{
+			Pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: c.name}},
+			GTID: c.gtid,
+			Zone: c.zone,
+		})
+	}
+	return pods
+}
+
+var _ = Describe("选主", func() {
+
+	DescribeTable("pickBestCandidate",
+		func(candidates []candidate, preferredZone, expected string) {
+			Expect(pickBestCandidate(candidatePods(candidates), preferredZone).Pod.Name).To(Equal(expected))
+		},
+		Entry("选包含其他所有候选人的gtid集合", []candidate{
+			{"pod-0", uuidA + ":1-5", ""},
+			{"pod-1", uuidA + ":1-9", ""},
+			{"pod-2", uuidA + ":1-7", ""},
+		}, "", "pod-1"),
+		Entry("多个uuid时不按字符串长度比较", []candidate{
+			{"pod-0", uuidB + ":1-5," + uuidC + ":1-9", ""},
+			{"pod-1", uuidA + ":1-100," + uuidB + ":1-5," + uuidC + ":1-9", ""},
+		}, "", "pod-1"),
+		Entry("区间写法不同但集合相同，保持名字顺序", []candidate{
+			{"pod-0", uuidA + ":1-5:6-9", ""},
+			{"pod-1", uuidA + ":1-9", ""},
+		}, "", "pod-0"),
+		Entry("gtid分叉时选缺少的事务最少的节点", []candidate{
+			{"pod-0", uuidA + ":1-100", ""},
+			{"pod-1", uuidB + ":1-5," + uuidC + ":1-9", ""},
+		}, "", "pod-0"),
+		Entry("集合相同时优先选择preferredZone", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-5:6-9", "zone-b"},
+		}, "zone-b", "pod-1"),
+		Entry("数据优先于可用区", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-8", "zone-b"},
+		}, "zone-b", "pod-0"),
+		Entry("解析失败的gtid当作空集合", []candidate{
+			{"pod-0", "invalid", ""},
+			{"pod-1", uuidA + ":1", ""},
+		}, "", "pod-1"),
+		Entry("都是空集合时保持名字顺序", []candidate{
+			{"pod-0", "", "zone-a"},
+			{"pod-1", "", "zone-b"},
+		}, "", "pod-0"),
+	)
+
+	DescribeTable("pickSwitchoverTarget",
+		func(candidates []candidate, cordoned []string, preferredZone, expected string) {
+			pods := candidatePods(candidates)
+			for _, pod := range pods {
+				for _, name := range cordoned {
+					if pod.Pod.Name == name {
+						pod.NodeUnschedulable = true
+					}
+				}
+			}
+
+			target := pickSwitchoverTarget(pods, pods[0], preferredZone)
+			if expected == "" {
+				Expect(target).To(BeNil())
+				return
+			}
+			Expect(target).NotTo(BeNil())
+			Expect(target.Pod.Name).To(Equal(expected))
+		},
+		Entry("排除现任主库，选数据最全的从库", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-8", "zone-b"},
+			{"pod-2", uuidA + ":1-9", "zone-c"},
+		}, []string{"pod-0"}, "", "pod-2"),
+		Entry("没有指定主可用区时留在旧主的可用区", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-9", "zone-b"},
+			{"pod-2", uuidA + ":1-9", "zone-a"},
+		}, []string{"pod-0"}, "", "pod-2"),
+		Entry("指定的主可用区优先于旧主的可用区", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-9", "zone-b"},
+			{"pod-2", uuidA + ":1-9", "zone-a"},
+		}, []string{"pod-0"}, "zone-b", "pod-1"),
+		Entry("排除同样被cordon的节点", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-9", "zone-b"},
+			{"pod-2", uuidA + ":1-8", "zone-a"},
+		}, []string{"pod-0", "pod-1"}, "", "pod-2"),
+		Entry("没有可切换的目标", []candidate{
+			{"pod-0", uuidA + ":1-9", "zone-a"},
+			{"pod-1", uuidA + ":1-9", "zone-b"},
+		}, []string{"pod-0", "pod-1"}, "", ""),
+	)
+
+	It("没有主库或脑裂时按之前记下的主库找故障的可用区", func() {
+		cluster := &dbv1.MysqlCluster{}
+		snapshot := &ClusterSnapshot{Pods: candidatePods([]candidate{
+			{"pod-0", "", "zone-c"},
+			{"pod-1", "", "zone-b"},
+		})}
+		lastKnown := &knownMaster{Name: "pod-0"}
+
+		Expect(lastMasterZone(cluster, snapshot, nil)).To(BeEmpty())
+		Expect(lastMasterZone(cluster, snapshot, lastKnown)).To(Equal("zone-c"))
+
+		// 主库pod重建后调度到了别的可用区，以status中记录的故障前的可用区为准
+		cluster.Status.Pods = []dbv1.PodStatus{{Name: "pod-0", Zone: "zone-a"}}
+		Expect(lastMasterZone(cluster, snapshot, lastKnown)).To(Equal("zone-a"))
+	})
+})
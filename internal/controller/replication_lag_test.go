@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1 "mysql-operator/api/v1"
+)
+
+var _ = Describe("复制延迟判断", func() {
+
+	const masterHost = "test-cluster-0.test-cluster-svc-headless.default"
+
+	slave := func(status *ReplicationStatus) *PodInfo {
+		return &PodInfo{Role: "slave", IsConnectable: true, Replication: status}
+	}
+	lag := func(seconds int64) *int64 { return &seconds }
+
+	It("延迟超过阈值或复制线程停止时视为异常", func() {
+		Expect(isSlaveLagging(slave(&ReplicationStatus{
+			MasterHost: masterHost, IORunning: "Yes", SQLRunning: "Yes", SecondsBehindMaster: lag(5),
+		}), masterHost, 30)).To(BeFalse())
+
+		Expect(isSlaveLagging(slave(&ReplicationStatus{
+			MasterHost: masterHost, IORunning: "Yes", SQLRunning: "Yes", SecondsBehindMaster: lag(31),
+		}), masterHost, 30)).To(BeTrue())
+
+		Expect(isSlaveLagging(slave(&ReplicationStatus{
+			MasterHost: masterHost, IORunning: "Connecting", SQLRunning: "Yes", SecondsBehindMaster: lag(0),
+		}), masterHost, 30)).To(BeTrue())
+
+		Expect(isSlaveLagging(slave(&ReplicationStatus{
+			MasterHost: masterHost, IORunning: "Yes", SQLRunning: "No",
+		}), masterHost, 30)).To(BeTrue())
+	})
+
+	It("还没有配置复制或仍指向旧主库时不算异常", func() {
+		Expect(isSlaveLagging(slave(nil), masterHost, 30)).To(BeFalse())
+
+		Expect(isSlaveLagging(slave(&ReplicationStatus{
+			MasterHost: "test-cluster-1.test-cluster-svc-headless.default", IORunning: "Connecting", SQLRunning: "Yes",
+		}), masterHost, 30)).To(BeFalse())
+	})
+})
+
+var _ = Describe("心跳延迟", func() {
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	node := func(latest time.Time, age time.Duration) *PodInfo {
+		return &PodInfo{Heartbeat: &HeartbeatInfo{Latest: latest, Age: age}}
+	}
+
+	It("用主库和从库上最新的心跳时间戳相减", func() {
+		master := node(now, 500*time.Millisecond)
+		slave := node(now.Add(-3*time.Second), 0)
+
+		lag := heartbeatLag(master, slave, time.Second)
+		Expect(lag).NotTo(BeNil())
+		Expect(*lag).To(Equal(3 * time.Second))
+
+		// 从库的心跳比主库还新（查询时刚好写入了一次）时按0处理
+		lag = heartbeatLag(master, node(now.Add(time.Second), 0), time.Second)
+		Expect(*lag).To(BeZero())
+	})
+
+	It("主库心跳停止写入或没有心跳数据时不使用心跳", func() {
+		Expect(heartbeatLag(node(now, time.Minute), node(now, 0), time.Second)).To(BeNil())
+		Expect(heartbeatLag(&PodInfo{}, node(now, 0), time.Second)).To(BeNil())
+		Expect(heartbeatLag(node(now, 0), &PodInfo{}, time.Second)).To(BeNil())
+	})
+
+	It("心跳sidecar只在带master标签、可写且没有配置复制的节点上写入", func() {
+		cluster := &dbv1.MysqlCluster{ObjectMeta: metav1.ObjectMeta{Name: "test-cluster", Namespace: "default"}}
+		cluster.Spec.Heartbeat = &dbv1.HeartbeatConfig{IntervalSeconds: 2}
+
+		container := heartbeatContainer(cluster)
+		script := container.Command[len(container.Command)-1]
+		Expect(script).To(ContainSubstring(`grep -qx 'role="master"' /etc/podinfo/labels`))
+		Expect(script).To(ContainSubstring("@@global.read_only = 0"))
+		Expect(script).To(ContainSubstring("NOT EXISTS (SELECT 1 FROM performance_schema.replication_connection_configuration)"))
+		Expect(script).To(HaveSuffix("sleep 2; done"))
+		Expect(container.VolumeMounts).To(ConsistOf(HaveField("Name", podInfoVolumeName)))
+
+		sts, err := (&MysqlClusterReconciler{}).createStatefulSet("test-cluster-statefulset", "hash", cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sts.Spec.Template.Spec.Volumes).To(ContainElement(podInfoVolume()))
+	})
+
+	It("判断延迟时心跳优先于Seconds_Behind_Master", func() {
+		seconds := int64(0)
+		heartbeat := 45 * time.Second
+		pod := &PodInfo{Role: "slave", Replication: &ReplicationStatus{
+			MasterHost: "m", IORunning: "Yes", SQLRunning: "Yes",
+			SecondsBehindMaster: &seconds, HeartbeatLag: &heartbeat,
+		}}
+		Expect(isSlaveLagging(pod, "m", 30)).To(BeTrue())
+	})
+})
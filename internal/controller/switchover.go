@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// 计划内切换时等待新主追平的最长时间，单位秒
+const switchoverCatchUpTimeout = 10
+
+// 计划内切换：先冻结旧主的写入，等目标从库追平旧主的gtid，再交给后面的打标签和第9步完成角色互换
+// 追不上时恢复旧主的写入并返回错误，下次调谐再重试，保证不丢数据
+// 返回旧主冻结写入时的gtid，新主已经追平了它
+func (r *MysqlClusterReconciler) switchoverMaster(ctx context.Context, oldMaster, newMaster *PodInfo, rootPwd string) (string, error) {
+	logger := log.FromContext(ctx)
+
+	oldDB, err := r.Mysql.Connect(ctx, oldMaster.Pod, rootPwd)
+	if err != nil {
+		return "", fmt.Errorf("8.1计划内切换失败: %w", err)
+	}
+	defer oldDB.Close()
+
+	newDB, err := r.Mysql.Connect(ctx, newMaster.Pod, rootPwd)
+	if err != nil {
+		return "", fmt.Errorf("8.1计划内切换失败: %w", err)
+	}
+	defer newDB.Close()
+
+	// super_read_only连root的写入也会拒绝，read_only只能挡住普通用户
+	if err := oldDB.SetSuperReadOnly(ctx, true); err != nil {
+		return "", fmt.Errorf("8.2旧主%s禁止写入失败: %w", oldMaster.Pod.Name, err)
+	}
+
+	// 写入已经冻结，此时的gtid就是旧主最终的数据
+	gtid, err := oldDB.GTIDExecuted(ctx)
+	if err == nil {
+		err = waitForGTID(ctx, newDB, gtid)
+	}
+
+	if err != nil {
+		// 回滚：恢复旧主的写入，read_only=0会同时关闭super_read_only
+		if rollbackErr := oldDB.SetReadOnly(ctx, false); rollbackErr != nil {
+			logger.Error(rollbackErr, "8.2计划内切换回滚失败，旧主仍处于只读状态", "pod名字", oldMaster.Pod.Name)
+		}
+		return "", fmt.Errorf("8.3等待%s追平旧主%s失败: %w", newMaster.Pod.Name, oldMaster.Pod.Name, err)
+	}
+
+	// 关闭super_read_only，只保留read_only，否则第6步在旧主上维护账号时会被拒绝
+	if err := oldDB.SetSuperReadOnly(ctx, false); err != nil {
+		return "", fmt.Errorf("8.4旧主%s关闭super_read_only失败: %w", oldMaster.Pod.Name, err)
+	}
+
+	logger.Info("8.计划内切换完成数据追平", "旧主", oldMaster.Pod.Name, "新主", newMaster.Pod.Name, "gtid", gtid)
+	return gtid, nil
+}
+
+// 在从库上等待指定的gtid集合执行完毕
+func waitForGTID(ctx context.Context, db MysqlNode, gtid string) error {
+	caughtUp, err := db.WaitForGTID(ctx, gtid, switchoverCatchUpTimeout*time.Second)
+	if err != nil {
+		return err
+	}
+	if !caughtUp {
+		return fmt.Errorf("%d秒内没有追平", switchoverCatchUpTimeout)
+	}
+	return nil
+}
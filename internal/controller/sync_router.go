@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	dbv1 "mysql-operator/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ProxySQL中的一条后端记录
+type routerBackend struct {
+	Hostgroup int
+	Hostname  string
+}
+
+// 计算ProxySQL期望的后端列表，按主机组和地址排序
+// 写主机组只有当前主库，读主机组和读服务一致，也就是readable的节点
+// 读主机组为空时SELECT会一直等到超时，所以即使关闭了fallbackToMaster也放入主库
+// 使用无头服务下的域名，pod重建后ip变化也不需要重新同步
+func desiredRouterBackends(cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) []routerBackend {
+	var backends []routerBackend
+	var writers []string
+
+	readable := desiredReadablePods(cluster, snapshot)
+
+	for _, pod := range snapshot.Pods {
+		host := replicationMasterHost(cluster, pod.Pod.Name)
+
+		if pod.Role == "master" {
+			backends = append(backends, routerBackend{Hostgroup: routerWriterHostgroup, Hostname: host})
+			writers = append(writers, host)
+		}
+		if readable[pod.Pod.Name] {
+			backends = append(backends, routerBackend{Hostgroup: routerReaderHostgroup, Hostname: host})
+		}
+	}
+
+	if len(backends) == len(writers) {
+		for _, host := range writers {
+			backends = append(backends, routerBackend{Hostgroup: routerReaderHostgroup, Hostname: host})
+		}
+	}
+
+	sortRouterBackends(backends)
+	return backends
+}
+
+func sortRouterBackends(backends []routerBackend) {
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].Hostgroup != backends[j].Hostgroup {
+			return backends[i].Hostgroup < backends[j].Hostgroup
+		}
+		return backends[i].Hostname < backends[j].Hostname
+	})
+}
+
+// 把后端列表同步到所有ProxySQL pod
+// 新启动的ProxySQL没有任何后端，所以每轮调谐都会检查，只有不一致时才写入
+func (r *MysqlClusterReconciler) syncRouterBackends(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) error {
+	logger := log.FromContext(ctx)
+
+	if cluster.Spec.Router == nil || snapshot.RouterAdminPassword == "" {
+		return nil
+	}
+
+	backends := desiredRouterBackends(cluster, snapshot)
+
+	// 没有主库时保留ProxySQL现有的配置，避免把所有后端清空
+	hasWriter := false
+	for _, backend := range backends {
+		if backend.Hostgroup == routerWriterHostgroup {
+			hasWriter = true
+		}
+	}
+	if !hasWriter {
+		logger.Info("9.5没有主库，跳过同步ProxySQL后端")
+		return nil
+	}
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(cluster.Namespace), client.MatchingLabels(routerLabels(cluster))); err != nil {
+		return fmt.Errorf("9.5获取ProxySQL的pod列表失败: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(podList.Items))
+
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *corev1.Pod) {
+			defer wg.Done()
+
+			updated, err := r.syncRouterPod(ctx, p, snapshot.RouterAdminPassword, backends)
+			if err != nil {
+				errChan <- fmt.Errorf("9.5同步ProxySQL节点%s失败: %w", p.Name, err)
+				return
+			}
+			if updated {
+				logger.Info("9.5已更新ProxySQL后端", "pod名字", p.Name, "backends", backends)
+			}
+		}(pod)
+	}
+
+	wg.Wait()
+	close(errChan)
+
+	if len(errChan) > 0 {
+		return <-errChan
+	}
+
+	return nil
+}
+
+// 通过管理接口同步单个ProxySQL，返回值bool表示是否修改了配置
+func (r *MysqlClusterReconciler) syncRouterPod(ctx context.Context, pod *corev1.Pod, adminPassword string, backends []routerBackend) (bool, error) {
+
+	node, err := r.Mysql.ConnectRouter(ctx, pod, adminPassword)
+	if err != nil {
+		return false, err
+	}
+	defer node.Close()
+
+	current, err := node.Backends(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if routerBackendsEqual(current, backends) {
+		return false, nil
+	}
+
+	if err := node.ReplaceBackends(ctx, backends); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func routerBackendsEqual(a, b []routerBackend) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,15 +2,19 @@ package controller
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+
+	dbv1 "mysql-operator/api/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 // 并发执行，连接数据库填充快照的gtid和isConnectable
 
-func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, snapshot *ClusterSnapshot) error {
+func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, cluster *dbv1.MysqlCluster, snapshot *ClusterSnapshot) error {
 
 	var wg sync.WaitGroup
 
@@ -26,8 +30,8 @@ func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, sna
 		go func(p *PodInfo) {
 			defer wg.Done()
 
-			// 连接并查询gtid
-			gtid, err := r.queryPodGTID(ctx, p, snapshot.RootPassword)
+			// 连接并查询gtid和复制状态
+			gtid, replication, heartbeat, err := r.queryPodState(ctx, p, snapshot.RootPassword, cluster.Spec.Heartbeat != nil)
 			if err != nil {
 
 				// 标记为不可连
@@ -38,6 +42,8 @@ func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, sna
 			}
 
 			p.GTID = gtid
+			p.Replication = replication
+			p.Heartbeat = heartbeat
 			p.IsConnectable = true
 		}(pod)
 	}
@@ -45,6 +51,8 @@ func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, sna
 	wg.Wait()
 	close(errChan)
 
+	updateHeartbeatLag(cluster, snapshot)
+
 	var aggErr error
 	for err := range errChan {
 
@@ -54,28 +62,63 @@ func (r *MysqlClusterReconciler) updateSnapshotWithGTID(ctx context.Context, sna
 	return aggErr
 }
 
-// 单个节点的连接与查询gtid
-func (r *MysqlClusterReconciler) queryPodGTID(ctx context.Context, pod *PodInfo, password string) (string, error) {
+// 单个节点的连接与查询gtid、复制状态和心跳
+// 复制状态和心跳只是用于展示和判断延迟，查询失败不影响节点的可连接状态
+func (r *MysqlClusterReconciler) queryPodState(ctx context.Context, pod *PodInfo, password string, heartbeatEnabled bool) (string, *ReplicationStatus, *HeartbeatInfo, error) {
+	logger := log.FromContext(ctx)
 
-	dsn := fmt.Sprintf("root:%s@tcp(%s:3306)/mysql?timeout=1s&readTimeout=1s&parseTime=true&interpolateParams=true", password, pod.Pod.Status.PodIP)
+	node, err := r.Mysql.Connect(ctx, pod.Pod, password)
+	if err != nil {
+		recordConnectionError(pod)
+		return "", nil, nil, fmt.Errorf("7.2节点%s无法连接: %w", pod.Pod.Name, err)
+	}
+	defer node.Close()
 
-	db, err := sql.Open("mysql", dsn)
+	// 查询GTID
+	gtid, err := node.GTIDExecuted(ctx)
 	if err != nil {
-		return "", fmt.Errorf("7.1.1dsn格式错误或驱动未加载: %w", err)
+		return "", nil, nil, fmt.Errorf("7.3节点%s的gtid获取失败: %w", pod.Pod.Name, err)
 	}
-	defer db.Close()
 
-	if err := db.PingContext(ctx); err != nil {
-		return "", fmt.Errorf("7.2节点%s无法连接: %w", pod.Pod.Name, err)
+	replication, err := queryReplicationStatus(ctx, node)
+	if err != nil {
+		logger.Info("7.4节点复制状态获取失败", "pod名字", pod.Pod.Name, "err", err)
 	}
 
-	var gtid string
-	// 查询GTID
+	var heartbeat *HeartbeatInfo
+	if heartbeatEnabled {
+		heartbeat, err = node.Heartbeat(ctx)
+		if err != nil {
+			logger.Info("7.5节点心跳表查询失败", "pod名字", pod.Pod.Name, "err", err)
+		}
+	}
 
-	err = db.QueryRowContext(ctx, "SELECT @@global.gtid_executed").Scan(&gtid)
-	if err != nil {
-		return "", fmt.Errorf("7.3节点%s的gtid获取失败: %w", pod.Pod.Name, err)
+	return gtid, replication, heartbeat, nil
+}
+
+// 查询复制状态，没有配置过复制（如主库）时返回nil
+func queryReplicationStatus(ctx context.Context, node MysqlNode) (*ReplicationStatus, error) {
+	statusMap, err := node.SlaveStatus(ctx)
+	if err != nil || statusMap == nil {
+		return nil, err
+	}
+
+	status := &ReplicationStatus{
+		MasterHost: statusMap["Master_Host"],
+		IORunning:  statusMap["Slave_IO_Running"],
+		SQLRunning: statusMap["Slave_SQL_Running"],
+	}
+
+	// sql线程没有运行时Seconds_Behind_Master是NULL
+	if seconds, err := strconv.ParseInt(statusMap["Seconds_Behind_Master"], 10, 64); err == nil {
+		status.SecondsBehindMaster = &seconds
+	}
+
+	// io线程的错误更能说明问题（如连不上主库），优先展示
+	status.LastError = statusMap["Last_IO_Error"]
+	if status.LastError == "" {
+		status.LastError = statusMap["Last_SQL_Error"]
 	}
 
-	return gtid, nil
+	return status, nil
 }
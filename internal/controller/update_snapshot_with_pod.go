@@ -7,6 +7,7 @@ import (
 	"sort"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -33,6 +34,9 @@ func (r *MysqlClusterReconciler) updateSnapshotWithPod(ctx context.Context, clus
 
 	snapshot.Pods = make([]*PodInfo, len(podList.Items))
 
+	// 同一个节点上可能有多个pod，缓存一下避免重复查询
+	nodes := make(map[string]*corev1.Node)
+
 	// podList.Items是值切片而不是指针切片，不能简单使用for _, pod := range
 	for i := range podList.Items {
 		// 取地址，防止range变量复用问题，也可以避免拷贝
@@ -43,6 +47,11 @@ func (r *MysqlClusterReconciler) updateSnapshotWithPod(ctx context.Context, clus
 		if val, ok := pod.Labels["role"]; ok {
 			role = val
 		}
+		node, err := r.getNodeForPod(ctx, pod, nodes)
+		if err != nil {
+			return err
+		}
+
 		// 填充信息
 		snapshot.Pods[i] = &PodInfo{
 			Pod:           pod,
@@ -50,12 +59,42 @@ func (r *MysqlClusterReconciler) updateSnapshotWithPod(ctx context.Context, clus
 			IsReady:       isPodReady(pod),
 			IsConnectable: false,
 			GTID:          "",
+
+			// pod的annotation继承自statefulset模板，和最新哈希不一致说明还是旧配置启动的
+			PendingRestart: pod.Annotations["checksum/config"] != snapshot.ConfigHash,
+
+			NodeUnschedulable: node != nil && node.Spec.Unschedulable,
+		}
+		if node != nil {
+			snapshot.Pods[i].Zone = node.Labels[corev1.LabelTopologyZone]
 		}
 	}
 
 	return nil
 }
 
+// 查询pod所在的节点，pod还没调度或者节点已经被删除时返回nil
+func (r *MysqlClusterReconciler) getNodeForPod(ctx context.Context, pod *corev1.Pod, cache map[string]*corev1.Node) (*corev1.Node, error) {
+	nodeName := pod.Spec.NodeName
+	if nodeName == "" {
+		return nil, nil
+	}
+	if node, ok := cache[nodeName]; ok {
+		return node, nil
+	}
+
+	node := &corev1.Node{}
+	if err := r.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("5.查询节点%s失败: %w", nodeName, err)
+		}
+		node = nil
+	}
+
+	cache[nodeName] = node
+	return node, nil
+}
+
 // 判断pod是否ready，不仅要看phase是running，还要看conditons里的ready
 func isPodReady(pod *corev1.Pod) bool {
 
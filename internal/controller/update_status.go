@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"time"
 
 	dbv1 "mysql-operator/api/v1"
 
@@ -23,24 +24,52 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 		podsStatus  []dbv1.PodStatus
 	)
 
+	// 先找到主库，判断从库的复制是否指向它
+	for _, pod := range snapshot.Pods {
+		if pod.IsConnectable && pod.Role == "master" {
+			masterNode = pod
+		}
+	}
+	maxLag := defaultMaxReplicationLagSeconds
+	if cluster.Spec.MaxReplicationLagSeconds != nil {
+		maxLag = int64(*cluster.Spec.MaxReplicationLagSeconds)
+	}
+	var laggingSlaves []string
+
 	// 遍历快照生成状态列表
 
 	for _, pod := range snapshot.Pods {
 		// 计数统计
 		if pod.IsConnectable && pod.Role == "master" {
 			masterCount++
-			masterNode = pod
 		}
 		if pod.IsConnectable && pod.Role == "slave" {
 			slaveCount++
+			if masterNode != nil && isSlaveLagging(pod, replicationMasterHost(cluster, masterNode.Pod.Name), maxLag) {
+				laggingSlaves = append(laggingSlaves, pod.Pod.Name)
+			}
 		}
 
-		podsStatus = append(podsStatus, dbv1.PodStatus{
+		podStatus := dbv1.PodStatus{
 			Name:          pod.Pod.Name,
 			Role:          pod.Role,
 			IsReady:       pod.IsReady,
 			IsConnectable: pod.IsConnectable,
-		})
+			Zone:          pod.Zone,
+
+			PendingRestart: pod.PendingRestart,
+		}
+		if pod.Role == "slave" && pod.Replication != nil {
+			podStatus.SecondsBehindMaster = pod.Replication.SecondsBehindMaster
+			podStatus.SlaveIORunning = pod.Replication.IORunning
+			podStatus.SlaveSQLRunning = pod.Replication.SQLRunning
+			podStatus.LastError = pod.Replication.LastError
+			if pod.Replication.HeartbeatLag != nil {
+				millis := pod.Replication.HeartbeatLag.Milliseconds()
+				podStatus.HeartbeatLagMilliseconds = &millis
+			}
+		}
+		podsStatus = append(podsStatus, podStatus)
 	}
 
 	// phase推导
@@ -68,7 +97,7 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 	case isBootstrapped:
 		if masterNode == nil || !masterNode.IsConnectable {
 			phase = dbv1.MysqlClusterPhaseFailed
-		} else if slaveCount < desiredReplicas-1 {
+		} else if slaveCount < desiredReplicas-1 || len(laggingSlaves) > 0 {
 			phase = dbv1.MysqlClusterPhaseDegraded
 		} else {
 			phase = dbv1.MysqlClusterPhaseRunning
@@ -87,6 +116,8 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 		}
 	}
 
+	updateClusterMetrics(cluster, snapshot, phase)
+
 	// 显示字段
 	// 格式化为 "2/3" 的形式，优化kubectl get体验
 	masterDisplay := fmt.Sprintf("%d/%d", masterCount, int32(1))
@@ -97,6 +128,11 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 		currentMasterName = masterNode.Pod.Name
 	}
 
+	lastMaster := cluster.Status.LastMaster
+	if snapshot.LastMaster != nil {
+		lastMaster = snapshot.LastMaster
+	}
+
 	// 构建并更新status
 
 	newStatus := dbv1.MysqlClusterStatus{
@@ -111,8 +147,14 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 		// 详细列表
 		Pods: podsStatus,
 
-		// 保留原有的conditions
-		Conditions: cluster.Status.Conditions,
+		Conditions: buildConditions(cluster.Status.Conditions, cluster, snapshot, phase, laggingSlaves, desiredReplicas-1),
+
+		FailoverHistory: appendFailoverHistory(cluster.Status.FailoverHistory, snapshot.FailoverRecord),
+		LastMaster:      lastMaster,
+
+		ObservedGeneration: cluster.Generation,
+
+		AppliedDynamicVariables: snapshot.AppliedVariables,
 	}
 
 	// 只有当状态真的变了才发送请求
@@ -123,6 +165,15 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 
 			return fmt.Errorf("更新status失败：%w", err)
 		}
+
+		// 写入成功后才记录事件，写入失败或冲突时下一轮调谐还会看到同样的变化，避免重复记录
+		if phase != currentPhase {
+			if phase == dbv1.MysqlClusterPhaseFailed || phase == dbv1.MysqlClusterPhaseDegraded {
+				r.recordWarning(cluster, EventReasonPhaseChanged, "集群状态从%s变为%s", currentPhase, phase)
+			} else {
+				r.recordNormal(cluster, EventReasonPhaseChanged, "集群状态从%s变为%s", currentPhase, phase)
+			}
+		}
 		logger.Info("10.status已更新",
 			"phase", phase,
 			"master", currentMasterName,
@@ -133,3 +184,21 @@ func (r *MysqlClusterReconciler) updateStatus(ctx context.Context, cluster *dbv1
 
 	return nil
 }
+
+// 没有配置maxReplicationLagSeconds时允许的最大复制延迟（秒）
+const defaultMaxReplicationLagSeconds int64 = 30
+
+// 判断从库的复制是否异常：延迟超过阈值，或者复制线程没有在运行
+// 延迟优先使用心跳表计算的结果
+// 快照是在第9步重新配置复制之前采集的，刚切换完主库时从库还指向旧主库，这种情况不算异常，避免phase来回跳
+func isSlaveLagging(pod *PodInfo, masterHost string, maxLag int64) bool {
+	status := pod.Replication
+	if status == nil || status.MasterHost != masterHost {
+		return false
+	}
+	if !status.Running() {
+		return true
+	}
+	lag, ok := status.Lag()
+	return ok && lag > time.Duration(maxLag)*time.Second
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2025 rumraisin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// 每个用例注入一种故障，恢复后断言集群收敛为一主多从、没有errant gtid、确认过的写入不丢失
+// 用例共用一个集群，按顺序执行，前一个用例收敛后才开始下一个
+var _ = Describe("chaos", Ordered, func() {
+
+	var master string
+
+	BeforeAll(func() {
+		By("creating the test cluster")
+		_, _ = run(time.Minute, "", "kubectl", "create", "ns", namespace)
+		kubectlApply(clusterManifest())
+		kubectl("wait", "mysqlcluster/"+clusterName, "-n", namespace, "--for=condition=Ready", "--timeout=10m")
+
+		master = expectConverged()
+		prepareTable(master)
+		Expect(writeRows(master, 10)).To(Succeed())
+	})
+
+	AfterAll(func() {
+		By("removing the test namespace")
+		_, _ = run(5*time.Minute, "", "kubectl", "delete", "ns", namespace)
+	})
+
+	// 每个用例开始前写入一批数据，让gtid向前推进
+	BeforeEach(func() {
+		master = expectConverged()
+		Expect(writeRows(master, 5)).To(Succeed())
+	})
+
+	It("删除主库pod", func() {
+		kubectl("delete", "pod", master, "-n", namespace, "--grace-period=0", "--force", "--wait=false")
+
+		newMaster := expectConverged()
+		Expect(writeRows(newMaster, 5)).To(Succeed())
+		expectConverged()
+	})
+
+	It("用NetworkPolicy隔离主库", func() {
+		kubectlApply(partitionManifest(master))
+		DeferCleanup(func() {
+			_, _ = run(time.Minute, "", "kubectl", "delete", "networkpolicy", "chaos-partition", "-n", namespace, "--ignore-not-found")
+		})
+
+		By("operator连不上主库，提升其他节点")
+		newMaster := expectFailoverFrom(master)
+		Expect(writeRows(newMaster, 5)).To(Succeed())
+
+		By("解除隔离，旧主作为从库加入")
+		kubectl("delete", "networkpolicy", "chaos-partition", "-n", namespace)
+		expectConverged()
+	})
+
+	It("SIGSTOP冻结主库的mysqld", func() {
+		Expect(signalMysqld(master, "STOP")).To(Succeed())
+		DeferCleanup(func() {
+			// 容器可能已经被liveness探针重启，失败不要紧
+			_ = signalMysqld(master, "CONT")
+		})
+
+		newMaster := expectFailoverFrom(master)
+		Expect(writeRows(newMaster, 5)).To(Succeed())
+
+		// 恢复旧主，如果它还没有被重启的话
+		_ = signalMysqld(master, "CONT")
+		expectConverged()
+	})
+
+	It("写满主库的磁盘", func() {
+		// dd写到没有空间为止，返回错误是预期的
+		_, _ = fillDisk(master)
+		DeferCleanup(func() { _, _ = freeDisk(master) })
+
+		By("磁盘满时不能出现第二个主库")
+		Consistently(func() []string {
+			return podsWithRole("master")
+		}).WithTimeout(time.Minute).WithPolling(5 * time.Second).Should(HaveLen(1))
+
+		By("释放空间后恢复写入")
+		_, err := freeDisk(master)
+		Expect(err).NotTo(HaveOccurred())
+		current := expectConverged()
+		Expect(writeRows(current, 5)).To(Succeed())
+		expectConverged()
+	})
+
+	It("选主过程中重启operator", func() {
+		kubectl("delete", "pod", master, "-n", namespace, "--grace-period=0", "--force", "--wait=false")
+		// 等operator开始处理后立刻重启它
+		time.Sleep(2 * time.Second)
+		restartOperator()
+
+		newMaster := expectConverged()
+		Expect(writeRows(newMaster, 5)).To(Succeed())
+		expectConverged()
+	})
+
+	It("脑裂：两个pod带master标签", func() {
+		// 模拟operator在打标签的中途退出，旧主的标签没来得及改掉
+		before := lastFailover()
+		slave := podsWithRole("slave")[0]
+		kubectl("label", "pod", slave, "-n", namespace, "role=master", "--overwrite")
+
+		expectFailoverRecorded(before, "split_brain")
+		expectConverged()
+	})
+
+	It("没有主库：删除主库的role标签", func() {
+		before := lastFailover()
+		kubectl("label", "pod", master, "-n", namespace, "role-")
+
+		expectFailoverRecorded(before, "no_master")
+		expectConverged()
+	})
+})
@@ -0,0 +1,274 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"mysql-operator/test/utils"
+)
+
+const (
+	clusterName  = "chaos-cluster"
+	rootPassword = "chaos-root"
+)
+
+var (
+	// 测试集群所在的namespace，结束后删除
+	namespace = envOr("CHAOS_NAMESPACE", "mysql-chaos")
+	// operator所在的namespace，重启operator时使用
+	operatorNamespace = envOr("OPERATOR_NAMESPACE", "mysql-operator-system")
+	mysqlImage        = envOr("MYSQL_IMAGE", "mysql:5.7")
+	// 在k8s节点上执行命令的前缀，节点名追加在后面，默认适用于kind
+	nodeExec = strings.Fields(envOr("NODE_EXEC", "docker exec"))
+)
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// 执行命令，超时后杀掉，mysqld被冻结时kubectl exec会一直卡住
+func run(timeout time.Duration, stdin string, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	output, err := utils.Run(cmd)
+	return strings.TrimSpace(string(output)), err
+}
+
+func kubectl(args ...string) string {
+	output, err := run(time.Minute, "", "kubectl", args...)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return output
+}
+
+func kubectlApply(manifest string) {
+	_, err := run(time.Minute, manifest, "kubectl", "apply", "-f", "-")
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+}
+
+// 带指定role标签的pod，不包括正在删除的
+func podsWithRole(role string) []string {
+	output := kubectl("get", "pods", "-n", namespace, "-l", fmt.Sprintf("app=%s,role=%s", clusterName, role),
+		"-o", "go-template={{ range .items }}{{ if not .metadata.deletionTimestamp }}{{ .metadata.name }}{{ \"\\n\" }}{{ end }}{{ end }}")
+	return utils.GetNonEmptyLines(output)
+}
+
+// 当前唯一的主库，有多个或者没有时返回空
+func currentMaster() string {
+	masters := podsWithRole("master")
+	if len(masters) != 1 {
+		return ""
+	}
+	return masters[0]
+}
+
+func clusterField(jsonpath string) string {
+	return kubectl("get", "mysqlcluster", clusterName, "-n", namespace, "-o", "jsonpath="+jsonpath)
+}
+
+// 通过kubectl exec在pod的mysql容器中执行sql，-r关闭转义，gtid中的换行原样返回
+func mysqlQuery(pod, query string) (string, error) {
+	return run(30*time.Second, "", "kubectl", "exec", "-n", namespace, pod, "-c", "mysql", "--",
+		"env", "MYSQL_PWD="+rootPassword, "mysql", "-uroot", "-N", "-B", "-r", "-e", query)
+}
+
+func gtidExecuted(pod string) (string, error) {
+	gtid, err := mysqlQuery(pod, "SELECT @@GLOBAL.gtid_executed")
+	return strings.ReplaceAll(gtid, "\n", ""), err
+}
+
+// 已经确认的写入数量，每个节点上的行数都不能少于它
+var ackedRows int
+
+func prepareTable(master string) {
+	_, err := mysqlQuery(master, "CREATE DATABASE IF NOT EXISTS chaos; "+
+		"CREATE TABLE IF NOT EXISTS chaos.writes (id INT AUTO_INCREMENT PRIMARY KEY, master VARCHAR(64), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)")
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+}
+
+// 在主库上写入n个事务，每个事务单独提交
+func writeRows(master string, n int) error {
+	var statements []string
+	for i := 0; i < n; i++ {
+		statements = append(statements, fmt.Sprintf("INSERT INTO chaos.writes (master) VALUES ('%s')", master))
+	}
+	if _, err := mysqlQuery(master, strings.Join(statements, "; ")); err != nil {
+		return err
+	}
+	ackedRows += n
+	return nil
+}
+
+// 等待集群收敛：只有一个主库且可写，phase为Running，所有从库都复制这个主库
+// 从库的gtid必须是主库的子集（没有errant gtid），追平后确认过的写入一条都不少
+func expectConverged() string {
+	var master string
+	EventuallyWithOffset(1, func(g Gomega) {
+		masters := podsWithRole("master")
+		g.Expect(masters).To(HaveLen(1), "主库应该只有一个")
+		master = masters[0]
+
+		g.Expect(clusterField("{.status.phase}")).To(Equal("Running"))
+		g.Expect(mysqlQuery(master, "SELECT @@GLOBAL.read_only")).To(Equal("0"))
+
+		masterGTID, err := gtidExecuted(master)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		for _, slave := range podsWithRole("slave") {
+			g.Expect(mysqlQuery(slave, "SELECT @@GLOBAL.read_only")).To(Equal("1"), "从库%s应该只读", slave)
+
+			replication, err := mysqlQuery(slave, "SELECT c.HOST, s.SERVICE_STATE, a.SERVICE_STATE "+
+				"FROM performance_schema.replication_connection_configuration c "+
+				"JOIN performance_schema.replication_connection_status s USING (CHANNEL_NAME) "+
+				"JOIN performance_schema.replication_applier_status a USING (CHANNEL_NAME)")
+			g.Expect(err).NotTo(HaveOccurred())
+			fields := strings.Fields(replication)
+			g.Expect(fields).To(HaveLen(3), "从库%s没有配置复制", slave)
+			g.Expect(fields[0]).To(HavePrefix(master+"."), "从库%s应该复制%s", slave, master)
+			g.Expect(fields[1:]).To(Equal([]string{"ON", "ON"}), "从库%s的复制线程没有运行", slave)
+
+			subset, err := mysqlQuery(slave, fmt.Sprintf("SELECT GTID_SUBSET(@@GLOBAL.gtid_executed, '%s')", masterGTID))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(subset).To(Equal("1"), "从库%s有errant gtid", slave)
+
+			caughtUp, err := mysqlQuery(slave, fmt.Sprintf("SELECT WAIT_FOR_EXECUTED_GTID_SET('%s', 10)", masterGTID))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(caughtUp).To(Equal("0"), "从库%s没有追平主库", slave)
+		}
+
+		for _, pod := range append(podsWithRole("slave"), master) {
+			count, err := mysqlQuery(pod, "SELECT COUNT(*) FROM chaos.writes")
+			g.Expect(err).NotTo(HaveOccurred())
+			rows, _ := strconv.Atoi(count)
+			g.Expect(rows).To(BeNumerically(">=", ackedRows), "%s丢失了确认过的写入", pod)
+		}
+	}).WithTimeout(6 * time.Minute).WithPolling(5 * time.Second).Should(Succeed())
+	return master
+}
+
+// 等待主库切换到其他pod
+func expectFailoverFrom(oldMaster string) string {
+	var master string
+	EventuallyWithOffset(1, func() string {
+		master = currentMaster()
+		return master
+	}).WithTimeout(5 * time.Minute).WithPolling(2 * time.Second).ShouldNot(Or(BeEmpty(), Equal(oldMaster)))
+	return master
+}
+
+// 最近一次切换记录，格式为"时间 原因"
+func lastFailover() string {
+	return clusterField("{.status.failoverHistory[-1:].time} {.status.failoverHistory[-1:].reason}")
+}
+
+// 等待出现一条新的切换记录，并且原因符合预期，这样能确认走的是reconcileRoles中对应的分支
+func expectFailoverRecorded(before, reason string) {
+	EventuallyWithOffset(1, lastFailover).WithTimeout(3 * time.Minute).WithPolling(5 * time.Second).
+		Should(And(Not(Equal(before)), HaveSuffix(" "+reason)))
+}
+
+// 在数据目录写一个大文件直到没有空间，返回错误是预期的
+func fillDisk(pod string) (string, error) {
+	return run(10*time.Minute, "", "kubectl", "exec", "-n", namespace, pod, "-c", "mysql", "--",
+		"sh", "-c", "dd if=/dev/zero of=/var/lib/mysql/chaos.fill bs=4M")
+}
+
+func freeDisk(pod string) (string, error) {
+	return run(time.Minute, "", "kubectl", "exec", "-n", namespace, pod, "-c", "mysql", "--",
+		"rm", "-f", "/var/lib/mysql/chaos.fill")
+}
+
+// 在pod所在的k8s节点上执行命令
+func execOnNode(pod string, args ...string) (string, error) {
+	node, err := run(time.Minute, "", "kubectl", "get", "pod", pod, "-n", namespace, "-o", "jsonpath={.spec.nodeName}")
+	if err != nil {
+		return "", err
+	}
+	command := append(append(append([]string{}, nodeExec[1:]...), node), args...)
+	return run(time.Minute, "", nodeExec[0], command...)
+}
+
+// mysqld在容器里是1号进程，容器内的kill对它无效，只能在节点上按宿主机pid发信号
+func signalMysqld(pod, signal string) error {
+	containerID, err := run(time.Minute, "", "kubectl", "get", "pod", pod, "-n", namespace,
+		"-o", `jsonpath={.status.containerStatuses[?(@.name=="mysql")].containerID}`)
+	if err != nil {
+		return err
+	}
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		containerID = containerID[i+3:]
+	}
+
+	pid, err := execOnNode(pod, "crictl", "inspect", "--output", "go-template", "--template", "{{ .info.pid }}", containerID)
+	if err != nil {
+		return err
+	}
+	_, err = execOnNode(pod, "kill", "-"+signal, pid)
+	return err
+}
+
+func restartOperator() {
+	kubectl("delete", "pod", "-n", operatorNamespace, "-l", "control-plane=controller-manager", "--wait=false")
+}
+
+func clusterManifest() string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: Secret
+metadata:
+  name: %[1]s-secret
+  namespace: %[2]s
+stringData:
+  root-password: %[3]s
+  repl-password: chaos-repl
+---
+apiVersion: apps.rumraisin.me/v1
+kind: MysqlCluster
+metadata:
+  name: %[1]s
+  namespace: %[2]s
+spec:
+  image: %[4]s
+  replicas: 3
+  storage:
+    size: 1Gi
+  resources:
+    requests:
+      cpu: 250m
+      memory: 512Mi
+    limits:
+      memory: 512Mi
+  secretName:
+    name: %[1]s-secret
+`, clusterName, namespace, rootPassword, mysqlImage)
+}
+
+// 隔离一个pod的所有进出流量，需要CNI支持NetworkPolicy
+func partitionManifest(pod string) string {
+	return fmt.Sprintf(`apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: chaos-partition
+  namespace: %s
+spec:
+  podSelector:
+    matchLabels:
+      statefulset.kubernetes.io/pod-name: %s
+  policyTypes:
+  - Ingress
+  - Egress
+`, namespace, pod)
+}
@@ -136,5 +136,6 @@ func GetProjectDir() (string, error) {
 		return wd, err
 	}
 	wd = strings.Replace(wd, "/test/e2e", "", -1)
+	wd = strings.Replace(wd, "/test/chaos", "", -1)
 	return wd, nil
 }